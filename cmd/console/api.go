@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// apiClient mock 控制接口（-controlAddr）的客户端
+type apiClient struct {
+	base string
+}
+
+// 与 cmd/mock 控制接口返回的 JSON 对应
+type device struct {
+	Mac       string   `json:"mac"`
+	Model     string   `json:"model"`
+	Profile   string   `json:"profile"`
+	Online    bool     `json:"online"`
+	Connected bool     `json:"connected"`
+	Broker    string   `json:"broker"`
+	Paused    []string `json:"paused"`
+	Absent    []string `json:"absent"`
+}
+
+type generator struct {
+	Name     string `json:"name"`
+	Interval string `json:"interval"`
+	Default  string `json:"default"`
+	Paused   bool   `json:"paused"`
+}
+
+type message struct {
+	Kind      string    `json:"kind"` // 只有 /watch 的事件有
+	Mac       string    `json:"mac"`  // 只有 /watch 的事件有
+	Time      time.Time `json:"time"`
+	Type      string    `json:"type"`
+	Topic     string    `json:"topic"`
+	Cmd       string    `json:"cmd"`
+	Size      int       `json:"size"`
+	Data      string    `json:"data"`
+	Truncated bool      `json:"truncated"`
+	Error     string    `json:"error"`
+}
+
+func newAPIClient(addr string) *apiClient {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	return &apiClient{base: strings.TrimSuffix(addr, "/")}
+}
+
+// 发送请求，body 不为 nil 时编码为 JSON，reply 不为 nil 时解析 JSON 响应
+func (a *apiClient) do(method, path string, body, reply any) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, a.base+path, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s", strings.TrimSpace(string(msg)))
+	}
+	if reply == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(reply)
+}
+
+func (a *apiClient) devices() ([]device, error) {
+	var devices []device
+	err := a.do(http.MethodGet, "/devices", nil, &devices)
+	return devices, err
+}
+
+func (a *apiClient) generators() ([]generator, error) {
+	var generators []generator
+	err := a.do(http.MethodGet, "/generators", nil, &generators)
+	return generators, err
+}
+
+func devicePath(mac string, parts ...string) string {
+	return "/devices/" + url.PathEscape(mac) + strings.Join(append([]string{""}, parts...), "/")
+}
+
+// 订阅 /watch 事件流，直到 ctx 结束或连接断开；dropped 为服务端丢弃的条数
+func (a *apiClient) watch(ctx context.Context, q url.Values, onMessage func(message), onDropped func(n int)) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.base+"/watch?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s", strings.TrimSpace(string(msg)))
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	event := ""
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			event = ""
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data := strings.TrimPrefix(line, "data: ")
+			if event == "dropped" {
+				var n int
+				fmt.Sscan(data, &n)
+				onDropped(n)
+				continue
+			}
+			var m message
+			if err := json.Unmarshal([]byte(data), &m); err == nil {
+				onMessage(m)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return io.EOF
+}
@@ -0,0 +1,595 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// console 一个交互会话
+type console struct {
+	api *apiClient
+	out io.Writer
+
+	mu      sync.Mutex
+	monitor context.CancelFunc            // 显示所有床的命令和应答
+	watches map[string]context.CancelFunc // mac -> 显示这张床收发的所有消息
+	macs    []string                      // 补全用的 MAC，定时刷新
+	macsAt  time.Time
+	types   []string // 补全用的消息类型
+}
+
+// command 一条控制台命令
+type command struct {
+	name  string
+	usage string
+	help  string
+	run   func(c *console, args []string) error
+}
+
+var commandList = []command{
+	{"devices", "devices [pattern]", "list devices, pattern is a MAC glob like *-1?", (*console).listDevices},
+	{"add", "add [count] [profile]", "add devices using the MAC template, profile is couple, single, single-right or unbound", (*console).addDevices},
+	{"remove", "remove <mac|pattern>", "disconnect and remove devices", (*console).removeDevices},
+	{"bed", "bed <mac|pattern|*> [left|right] <action> [args]", "drive beds: getout, getin, posture [0-6], fault [code], reboot [downtime], pause [types], resume [types]", (*console).bed},
+	{"messages", "messages <mac> [n]", "recent messages published by a bed, newest first", (*console).messages},
+	{"types", "types", "list message types with their interval", (*console).listTypes},
+	{"interval", "interval <type> <duration>", "change the interval of a message type for all beds", (*console).interval},
+	{"pause", "pause <type>", "pause a message type for all beds", pauseType(true)},
+	{"resume", "resume <type>", "resume a message type for all beds", pauseType(false)},
+	{"watch", "watch <mac|pattern>...", "show every message a bed sends and receives", (*console).watch},
+	{"unwatch", "unwatch [mac]...", "stop watching beds, all beds without arguments", (*console).unwatch},
+	{"monitor", "monitor on|off", "show incoming control commands and outgoing acks of all beds", (*console).setMonitorCmd},
+}
+
+var (
+	sides   = []string{"left", "right"}
+	actions = []string{"getout", "getin", "posture", "fault", "reboot", "pause", "resume"}
+)
+
+// 同时发出的请求数，bed * 作用于大量床时使用
+const concurrency = 16
+
+func findCommand(name string) (command, bool) {
+	for _, cmd := range commandList {
+		if cmd.name == name {
+			return cmd, true
+		}
+	}
+	return command{}, false
+}
+
+func (c *console) help() {
+	for _, cmd := range commandList {
+		c.printf("  %-50s %s", cmd.usage, cmd.help)
+	}
+	c.printf("  %-50s %s", "help", "show this help")
+	c.printf("  %-50s %s", "quit", "exit the console, the mock keeps running")
+}
+
+// 展开设备参数：包含 * ? [ 时按 glob 匹配当前的设备，否则原样返回
+func (c *console) resolve(pattern string) ([]string, error) {
+	if !strings.ContainsAny(pattern, "*?[") {
+		return []string{pattern}, nil
+	}
+	devices, err := c.api.devices()
+	if err != nil {
+		return nil, err
+	}
+	var macs []string
+	for _, d := range devices {
+		if ok, err := path.Match(pattern, d.Mac); err != nil {
+			return nil, err
+		} else if ok {
+			macs = append(macs, d.Mac)
+		}
+	}
+	if len(macs) == 0 {
+		return nil, fmt.Errorf("no device matches %s", pattern)
+	}
+	return macs, nil
+}
+
+// 对每张床执行 fn；只有一张床时输出结果，多张时输出失败的床和汇总
+func (c *console) each(name string, macs []string, fn func(mac string) (string, error)) error {
+	if len(macs) == 1 {
+		out, err := fn(macs[0])
+		if err == nil && out != "" {
+			c.printf("%s", out)
+		}
+		return err
+	}
+	var (
+		wg     sync.WaitGroup
+		sem    = make(chan struct{}, concurrency)
+		mu     sync.Mutex
+		failed int
+	)
+	for _, mac := range macs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if _, err := fn(mac); err != nil {
+				mu.Lock()
+				failed++
+				mu.Unlock()
+				c.printf("%s %s: %v", name, mac, err)
+			}
+		}()
+	}
+	wg.Wait()
+	c.printf("%s: %d beds ok, %d failed", name, len(macs)-failed, failed)
+	return nil
+}
+
+func formatDevice(d device) string {
+	state := "offline"
+	if d.Online {
+		state = "online"
+	}
+	line := fmt.Sprintf("%-28s %-7s %-6s %-12s", d.Mac, state, d.Model, d.Profile)
+	if len(d.Paused) > 0 {
+		line += " paused=" + strings.Join(d.Paused, ",")
+	}
+	if len(d.Absent) > 0 {
+		line += " absent=" + strings.Join(d.Absent, ",")
+	}
+	return strings.TrimRight(line, " ")
+}
+
+// 一条消息一行：时间、方向、种类、MAC、类型、命令字和明文
+func formatMessage(m message) string {
+	dir := "->"
+	if m.Kind == "command" {
+		dir = "<-"
+	}
+	line := m.Time.Local().Format("15:04:05.000") + " " + dir
+	if m.Kind != "" {
+		line += fmt.Sprintf(" %-7s %s", m.Kind, m.Mac)
+	}
+	line += fmt.Sprintf(" %s cmd=%s %s", m.Type, m.Cmd, m.Data)
+	if m.Truncated {
+		line += fmt.Sprintf("... (%d bytes)", m.Size)
+	}
+	if m.Error != "" {
+		line += " error=" + m.Error
+	}
+	return line
+}
+
+func (c *console) listDevices(args []string) error {
+	devices, err := c.api.devices()
+	if err != nil {
+		return err
+	}
+	online, shown := 0, 0
+	for _, d := range devices {
+		if len(args) > 0 {
+			if ok, err := path.Match(args[0], d.Mac); err != nil {
+				return err
+			} else if !ok {
+				continue
+			}
+		}
+		shown++
+		if d.Online {
+			online++
+		}
+		c.printf("%s", formatDevice(d))
+	}
+	c.printf("%d devices, %d online", shown, online)
+	return nil
+}
+
+func (c *console) addDevices(args []string) error {
+	req := map[string]any{}
+	if len(args) > 0 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid count %q", args[0])
+		}
+		req["count"] = n
+	}
+	if len(args) > 1 {
+		req["profile"] = args[1]
+	}
+	var added []device
+	if err := c.api.do(http.MethodPost, "/devices", req, &added); err != nil {
+		return err
+	}
+	for _, d := range added {
+		c.printf("added %s", formatDevice(d))
+	}
+	c.macsAt = time.Time{}
+	return nil
+}
+
+func (c *console) removeDevices(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: remove <mac|pattern>")
+	}
+	macs, err := c.resolve(args[0])
+	if err != nil {
+		return err
+	}
+	c.macsAt = time.Time{}
+	return c.each("remove", macs, func(mac string) (string, error) {
+		return "removed " + mac, c.api.do(http.MethodDelete, devicePath(mac), nil, nil)
+	})
+}
+
+// bed <mac|pattern> [left|right] <action> [args]
+func (c *console) bed(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("usage: bed <mac|pattern|*> [left|right] <action> [args]")
+	}
+	macs, err := c.resolve(args[0])
+	if err != nil {
+		return err
+	}
+	side := ""
+	args = args[1:]
+	if args[0] == "left" || args[0] == "right" {
+		side, args = args[0], args[1:]
+		if len(args) == 0 {
+			return fmt.Errorf("missing action after %s", side)
+		}
+	}
+	action, params := args[0], args[1:]
+
+	event := map[string]any{}
+	if side != "" {
+		event["side"] = side
+	}
+	switch action {
+	case "getout", "getin":
+		event["type"] = map[string]string{"getout": "bedExit", "getin": "bedEnter"}[action]
+		return c.each(action, macs, func(mac string) (string, error) {
+			var d device
+			err := c.api.do(http.MethodPost, devicePath(mac, "events"), event, &d)
+			return formatDevice(d), err
+		})
+	case "posture", "fault":
+		event["type"] = action
+		if len(params) > 0 {
+			// 故障码可以写成 0x03
+			v, err := strconv.ParseInt(params[0], 0, 0)
+			if err != nil {
+				return fmt.Errorf("invalid %s %q", action, params[0])
+			}
+			event[map[string]string{"posture": "posture", "fault": "code"}[action]] = v
+		}
+		return c.each(action, macs, func(mac string) (string, error) {
+			var published []message
+			err := c.api.do(http.MethodPost, devicePath(mac, "events"), event, &published)
+			lines := make([]string, 0, len(published))
+			for _, m := range published {
+				lines = append(lines, formatMessage(m))
+			}
+			return strings.Join(lines, "\n"), err
+		})
+	case "reboot":
+		event["type"] = "reboot"
+		if len(params) > 0 {
+			event["downtime"] = params[0]
+		}
+		return c.each(action, macs, func(mac string) (string, error) {
+			return mac + " rebooting", c.api.do(http.MethodPost, devicePath(mac, "events"), event, nil)
+		})
+	case "pause", "resume":
+		if side != "" {
+			return fmt.Errorf("%s applies to the whole bed", action)
+		}
+		body := map[string][]string{"types": params}
+		return c.each(action, macs, func(mac string) (string, error) {
+			var d device
+			err := c.api.do(http.MethodPost, devicePath(mac, action), body, &d)
+			return formatDevice(d), err
+		})
+	}
+	return fmt.Errorf("unknown action %q, expected one of %s", action, strings.Join(actions, ", "))
+}
+
+func (c *console) messages(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: messages <mac> [n]")
+	}
+	n := 10
+	if len(args) > 1 {
+		var err error
+		if n, err = strconv.Atoi(args[1]); err != nil || n <= 0 {
+			return fmt.Errorf("invalid count %q", args[1])
+		}
+	}
+	var msgs []message
+	if err := c.api.do(http.MethodGet, devicePath(args[0], "messages"), nil, &msgs); err != nil {
+		return err
+	}
+	for _, m := range msgs[:min(n, len(msgs))] {
+		c.printf("%s", formatMessage(m))
+	}
+	return nil
+}
+
+func (c *console) listTypes(args []string) error {
+	generators, err := c.api.generators()
+	if err != nil {
+		return err
+	}
+	for _, g := range generators {
+		line := fmt.Sprintf("%-28s %-8s", g.Name, g.Interval)
+		if g.Interval != g.Default {
+			line += " (default " + g.Default + ")"
+		}
+		if g.Paused {
+			line += " paused"
+		}
+		c.printf("%s", strings.TrimRight(line, " "))
+	}
+	return nil
+}
+
+func (c *console) interval(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: interval <type> <duration>")
+	}
+	var g generator
+	if err := c.api.do(http.MethodPatch, "/generators/"+url.PathEscape(args[0]), map[string]string{"interval": args[1]}, &g); err != nil {
+		return err
+	}
+	c.printf("%s every %s", g.Name, g.Interval)
+	return nil
+}
+
+func pauseType(pause bool) func(c *console, args []string) error {
+	action := "resume"
+	if pause {
+		action = "pause"
+	}
+	return func(c *console, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("usage: %s <type>", action)
+		}
+		var g generator
+		if err := c.api.do(http.MethodPost, "/generators/"+url.PathEscape(args[0])+"/"+action, nil, &g); err != nil {
+			return err
+		}
+		c.printf("%s paused=%t", g.Name, g.Paused)
+		return nil
+	}
+}
+
+func (c *console) watch(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: watch <mac|pattern>...")
+	}
+	var macs []string
+	for _, arg := range args {
+		m, err := c.resolve(arg)
+		if err != nil {
+			return err
+		}
+		macs = append(macs, m...)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, mac := range macs {
+		if _, ok := c.watches[mac]; ok {
+			continue
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		c.watches[mac] = cancel
+		go c.stream(ctx, "watch "+mac, url.Values{"mac": {mac}})
+	}
+	c.printf("watching %d beds", len(c.watches))
+	return nil
+}
+
+func (c *console) unwatch(args []string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for mac, cancel := range c.watches {
+		if len(args) > 0 {
+			if ok, _ := path.Match(args[0], mac); !ok && !contains(args, mac) {
+				continue
+			}
+		}
+		cancel()
+		delete(c.watches, mac)
+	}
+	c.printf("watching %d beds", len(c.watches))
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *console) setMonitorCmd(args []string) error {
+	if len(args) != 1 || (args[0] != "on" && args[0] != "off") {
+		return fmt.Errorf("usage: monitor on|off")
+	}
+	c.setMonitor(args[0] == "on")
+	return nil
+}
+
+func (c *console) setMonitor(on bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case on && c.monitor == nil:
+		ctx, cancel := context.WithCancel(context.Background())
+		c.monitor = cancel
+		go c.stream(ctx, "monitor", url.Values{"kind": {"command", "ack"}})
+	case !on && c.monitor != nil:
+		c.monitor()
+		c.monitor = nil
+	}
+}
+
+func (c *console) watched(mac string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.watches[mac]
+	return ok
+}
+
+// 显示事件流直到 ctx 结束，断开后每 2 秒重连
+func (c *console) stream(ctx context.Context, name string, q url.Values) {
+	monitor := name == "monitor"
+	for {
+		err := c.api.watch(ctx, q, func(m message) {
+			// 被 watch 的床由自己的事件流显示
+			if monitor && c.watched(m.Mac) {
+				return
+			}
+			c.printf("%s", formatMessage(m))
+		}, func(n int) {
+			c.printf("%s: %d messages dropped, the console can't keep up", name, n)
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		c.printf("%s: %v, reconnecting", name, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+// 补全用的 MAC 列表，超过 3 秒重新获取
+func (c *console) macList() []string {
+	if time.Since(c.macsAt) > 3*time.Second {
+		if devices, err := c.api.devices(); err == nil {
+			c.macs = c.macs[:0]
+			for _, d := range devices {
+				c.macs = append(c.macs, d.Mac)
+			}
+			c.macsAt = time.Now()
+		}
+	}
+	return c.macs
+}
+
+func (c *console) typeList() []string {
+	if c.types == nil {
+		if generators, err := c.api.generators(); err == nil {
+			for _, g := range generators {
+				c.types = append(c.types, g.Name)
+			}
+		}
+	}
+	return c.types
+}
+
+// 当前位置的候选词，prev 为之前的词
+func (c *console) candidates(prev []string) []string {
+	if len(prev) == 0 {
+		names := []string{"help", "quit"}
+		for _, cmd := range commandList {
+			names = append(names, cmd.name)
+		}
+		return names
+	}
+	n := len(prev)
+	switch prev[0] {
+	case "bed":
+		switch {
+		case n == 1:
+			return append([]string{"*"}, c.macList()...)
+		case n == 2:
+			return append(append([]string(nil), sides...), actions...)
+		case n == 3 && contains(sides, prev[2]):
+			return actions
+		case prev[2] == "pause" || prev[2] == "resume":
+			return c.typeList()
+		}
+	case "remove", "messages":
+		if n == 1 {
+			return c.macList()
+		}
+	case "watch":
+		return c.macList()
+	case "unwatch":
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		macs := make([]string, 0, len(c.watches))
+		for mac := range c.watches {
+			macs = append(macs, mac)
+		}
+		return macs
+	case "interval", "pause", "resume":
+		if n == 1 {
+			return c.typeList()
+		}
+	case "monitor":
+		if n == 1 {
+			return []string{"on", "off"}
+		}
+	case "add":
+		if n == 2 {
+			return []string{"couple", "single", "single-right", "unbound"}
+		}
+	}
+	return nil
+}
+
+// tab 补全当前的词；有多个候选时补全到公共前缀，无法继续补全时列出候选
+func (c *console) complete(line string, pos int, key rune) (string, int, bool) {
+	if key != '\t' {
+		return "", 0, false
+	}
+	head := line[:pos]
+	words := strings.Fields(head)
+	if head == "" || strings.HasSuffix(head, " ") {
+		words = append(words, "")
+	}
+	word := words[len(words)-1]
+	var matches []string
+	for _, s := range c.candidates(words[:len(words)-1]) {
+		if strings.HasPrefix(s, word) {
+			matches = append(matches, s)
+		}
+	}
+	if len(matches) == 0 {
+		return "", 0, false
+	}
+	sort.Strings(matches)
+	completion := matches[0]
+	for _, s := range matches[1:] {
+		for !strings.HasPrefix(s, completion) {
+			completion = completion[:len(completion)-1]
+		}
+	}
+	if len(matches) == 1 {
+		completion += " "
+	}
+	if completion == word {
+		const limit = 40
+		list := strings.Join(matches[:min(len(matches), limit)], "  ")
+		if len(matches) > limit {
+			list += fmt.Sprintf("  ... %d more", len(matches)-limit)
+		}
+		c.printf("%s", list)
+		return "", 0, false
+	}
+	newHead := head[:len(head)-len(word)] + completion
+	return newHead + line[pos:], len(newHead), true
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// 模拟 mock 的控制接口，记录收到的请求
+type fakeAPI struct {
+	mu       sync.Mutex
+	requests []string // "方法 路径 请求体"
+}
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	f.mu.Lock()
+	f.requests = append(f.requests, strings.TrimSpace(r.Method+" "+r.URL.Path+" "+string(body)))
+	f.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case r.URL.Path == "/devices":
+		json.NewEncoder(w).Encode([]device{{Mac: "BED-1", Online: true}, {Mac: "BED-2"}, {Mac: "OTHER-1"}})
+	case r.URL.Path == "/generators":
+		json.NewEncoder(w).Encode([]generator{{Name: "status"}, {Name: "sleep_stage"}})
+	case strings.HasPrefix(r.URL.Path, "/devices/NOPE"):
+		http.Error(w, "unknown device NOPE", http.StatusNotFound)
+	case strings.HasSuffix(r.URL.Path, "/events") && strings.Contains(string(body), `"fault"`):
+		json.NewEncoder(w).Encode([]message{{Type: "error_code", Cmd: "A3"}})
+	default:
+		fmt.Fprint(w, "{}")
+	}
+}
+
+// 除 GET /devices 以外收到的请求，排序后返回
+func (f *fakeAPI) calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var calls []string
+	for _, r := range f.requests {
+		if r != "GET /devices" && r != "GET /generators" {
+			calls = append(calls, r)
+		}
+	}
+	f.requests = nil
+	sort.Strings(calls)
+	return calls
+}
+
+func testConsole(t *testing.T) (*console, *fakeAPI, *bytes.Buffer) {
+	api := &fakeAPI{}
+	srv := httptest.NewServer(api)
+	t.Cleanup(srv.Close)
+	var out bytes.Buffer
+	c := &console{api: newAPIClient(srv.URL), out: &lockedWriter{w: &out}, watches: make(map[string]context.CancelFunc)}
+	return c, api, &out
+}
+
+func TestBedCommand(t *testing.T) {
+	c, api, out := testConsole(t)
+	cases := []struct {
+		line  string
+		calls []string
+	}{
+		{"bed * fault 0x03", []string{
+			`POST /devices/BED-1/events {"code":3,"type":"fault"}`,
+			`POST /devices/BED-2/events {"code":3,"type":"fault"}`,
+			`POST /devices/OTHER-1/events {"code":3,"type":"fault"}`,
+		}},
+		{"bed BED-? left getout", []string{
+			`POST /devices/BED-1/events {"side":"left","type":"bedExit"}`,
+			`POST /devices/BED-2/events {"side":"left","type":"bedExit"}`,
+		}},
+		{"bed BED-1 right posture 3", []string{`POST /devices/BED-1/events {"posture":3,"side":"right","type":"posture"}`}},
+		{"bed BED-1 reboot 10s", []string{`POST /devices/BED-1/events {"downtime":"10s","type":"reboot"}`}},
+		{"bed BED-2 pause status sleep_stage", []string{`POST /devices/BED-2/pause {"types":["status","sleep_stage"]}`}},
+		{"bed BED-2 resume", []string{`POST /devices/BED-2/resume {"types":[]}`}},
+	}
+	for _, tc := range cases {
+		c.run(tc.line)
+		if got := api.calls(); fmt.Sprint(got) != fmt.Sprint(tc.calls) {
+			t.Errorf("%s:\ngot  %v\nwant %v", tc.line, got, tc.calls)
+		}
+	}
+	if !strings.Contains(out.String(), "fault: 3 beds ok, 0 failed") {
+		t.Errorf("missing summary in output:\n%s", out)
+	}
+
+	// 参数错误时不发请求，输出错误
+	errors := map[string]string{
+		"bed BED-1":            "usage: bed",
+		"bed BED-1 left":       "missing action after left",
+		"bed BED-1 jump":       `unknown action "jump"`,
+		"bed BED-1 fault x":    `invalid fault "x"`,
+		"bed BED-1 left pause": "pause applies to the whole bed",
+		"bed NOPE-* fault":     "no device matches NOPE-*",
+		"bed NOPE fault":       "unknown device NOPE",
+		"jump":                 `unknown command "jump"`,
+	}
+	for line, want := range errors {
+		out.Reset()
+		c.run(line)
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("%s: output %q, want %q", line, out.String(), want)
+		}
+		if calls := api.calls(); len(calls) > 0 && line != "bed NOPE fault" {
+			t.Errorf("%s: unexpected requests %v", line, calls)
+		}
+	}
+	if c.run("quit") {
+		t.Error("quit should end the session")
+	}
+}
+
+func TestComplete(t *testing.T) {
+	c, _, out := testConsole(t)
+	cases := []struct {
+		line string
+		want string // 空表示不补全
+	}{
+		{"int", "interval "},
+		{"bed B", "bed BED-"},
+		{"bed BED-1", "bed BED-1 "},
+		{"bed BED-1 l", "bed BED-1 left "},
+		{"bed BED-1 left f", "bed BED-1 left fault "},
+		{"bed * pause sl", "bed * pause sleep_stage "},
+		{"remove O", "remove OTHER-1 "},
+		{"monitor o", "monitor o"}, // on 和 off 没有更长的公共前缀
+		{"bed X", ""},
+	}
+	for _, tc := range cases {
+		line, pos, ok := c.complete(tc.line, len(tc.line), '\t')
+		if tc.want == "" || tc.want == tc.line {
+			if ok {
+				t.Errorf("%q: unexpected completion %q", tc.line, line)
+			}
+			continue
+		}
+		if !ok || line != tc.want || pos != len(tc.want) {
+			t.Errorf("%q: got %q,%d,%v, want %q", tc.line, line, pos, ok, tc.want)
+		}
+	}
+	// 无法继续补全时列出候选
+	out.Reset()
+	c.complete("bed BED-", 8, '\t')
+	if got := strings.TrimSpace(out.String()); got != "BED-1  BED-2" {
+		t.Errorf("candidates %q", got)
+	}
+	// 光标在中间时保留后面的内容
+	if line, pos, ok := c.complete("bed O fault", 5, '\t'); !ok || line != "bed OTHER-1  fault" || pos != 12 {
+		t.Errorf("mid-line completion %q,%d,%v", line, pos, ok)
+	}
+	if _, _, ok := c.complete("bed B", 5, 'x'); ok {
+		t.Error("only tab completes")
+	}
+}
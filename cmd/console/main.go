@@ -0,0 +1,123 @@
+// console 交互式控制台，通过 mock 的控制接口（-controlAddr）操作单张床，
+// 实时显示后台下发的命令和床的应答，供手工测试使用：
+//
+//	mock -bedNum 10 -controlAddr 127.0.0.1:8080
+//	console -control 127.0.0.1:8080
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/term"
+)
+
+func main() {
+	control := flag.String("control", "127.0.0.1:8080", "address of the mock control API (-controlAddr of cmd/mock)")
+	monitor := flag.Bool("monitor", true, "show incoming control commands and outgoing acks of all beds")
+	flag.Parse()
+
+	c := &console{api: newAPIClient(*control), watches: make(map[string]context.CancelFunc)}
+	if _, err := c.api.devices(); err != nil {
+		fmt.Println("control API error:", err)
+		os.Exit(1)
+	}
+
+	// 不是终端时按行读取命令，便于脚本调用
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		c.out = &lockedWriter{w: os.Stdout}
+		if *monitor {
+			c.setMonitor(true)
+		}
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			if !c.run(scanner.Text()) {
+				break
+			}
+		}
+		return
+	}
+
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		fmt.Println("terminal error:", err)
+		os.Exit(1)
+	}
+	defer term.Restore(fd, state)
+	t := term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}, "mock> ")
+	if w, h, err := term.GetSize(fd); err == nil && w > 0 {
+		t.SetSize(w, h)
+	}
+	t.AutoCompleteCallback = c.complete
+	c.out = t
+	c.printf("connected to %s, type help for commands, tab completes commands and MACs", c.api.base)
+	if *monitor {
+		c.setMonitor(true)
+	}
+	for {
+		line, err := t.ReadLine()
+		if errors.Is(err, io.EOF) {
+			return
+		}
+		if err != nil && !errors.Is(err, term.ErrPasteIndicator) {
+			c.printf("read error: %v", err)
+			return
+		}
+		if !c.run(line) {
+			return
+		}
+	}
+}
+
+// lockedWriter 不是终端时多个协程共用标准输出
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
+
+// 输出一行，终端模式下显示在提示符上方
+func (c *console) printf(format string, args ...any) {
+	fmt.Fprintf(c.out, format+"\n", args...)
+}
+
+// 执行一行命令，返回 false 时退出
+func (c *console) run(line string) bool {
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		return true
+	}
+	name, args := args[0], args[1:]
+	switch name {
+	case "quit", "exit":
+		return false
+	case "help":
+		c.help()
+		return true
+	}
+	cmd, ok := findCommand(name)
+	if !ok {
+		c.printf("unknown command %q, type help for commands", name)
+		return true
+	}
+	if err := cmd.run(c, args); err != nil {
+		c.printf("%s: %v", name, err)
+	}
+	return true
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"mock-bed/pkg/brokerauth"
+	"mock-bed/pkg/identity"
+)
+
+// 每台设备只能访问自己的主题，ota 客户端订阅的是 qrem/ota-{mac}/ota
+func deviceTopics(mac string) (readwrite, read []string) {
+	return []string{fmt.Sprintf("qrem/%s/#", mac)}, []string{fmt.Sprintf("qrem/ota-%s/ota", mac)}
+}
+
+func main() {
+	var idOpts identity.Options
+	idOpts.RegisterFlags(flag.CommandLine)
+	start := flag.Int("start", 0, "first device number")
+	count := flag.Int("count", 1500, "number of devices")
+	secret := flag.String("authSecret", brokerauth.DefaultSecret, "secret used to derive device passwords, must match cmd/mock")
+	format := flag.String("format", "all", "mosquitto, emqx or all")
+	outDir := flag.String("outDir", ".", "output directory")
+	backendUser := flag.String("backendUser", "", "extra user allowed to access all qrem/# topics")
+	backendPassword := flag.String("backendPassword", "", "password of -backendUser")
+	flag.Parse()
+
+	if *format != "mosquitto" && *format != "emqx" && *format != "all" {
+		fail(fmt.Errorf("unknown format %q", *format))
+	}
+
+	devices, err := idOpts.Devices(*start, *start+*count)
+	if err != nil {
+		fail(err)
+	}
+	if err := os.MkdirAll(*outDir, 0o755); err != nil {
+		fail(err)
+	}
+
+	type account struct {
+		user, password  string
+		readwrite, read []string
+	}
+	accounts := make([]account, 0, len(devices)+1)
+	if *backendUser != "" {
+		accounts = append(accounts, account{user: *backendUser, password: *backendPassword, readwrite: []string{"qrem/#"}})
+	}
+	for _, dev := range devices {
+		rw, r := deviceTopics(dev.Mac)
+		accounts = append(accounts, account{user: dev.Mac, password: brokerauth.Password(*secret, dev.Mac), readwrite: rw, read: r})
+	}
+
+	if *format == "mosquitto" || *format == "all" {
+		err := writeFile(filepath.Join(*outDir, "mosquitto.passwd"), func(w *bufio.Writer) error {
+			for _, a := range accounts {
+				hash, err := brokerauth.MosquittoHash(a.password)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(w, "%s:%s\n", a.user, hash)
+			}
+			return nil
+		})
+		if err != nil {
+			fail(err)
+		}
+		err = writeFile(filepath.Join(*outDir, "mosquitto.acl"), func(w *bufio.Writer) error {
+			for _, a := range accounts {
+				w.WriteString(brokerauth.MosquittoACL(a.user, a.readwrite, a.read))
+			}
+			return nil
+		})
+		if err != nil {
+			fail(err)
+		}
+	}
+
+	if *format == "emqx" || *format == "all" {
+		// 内置数据库认证导入文件，password_hash_algorithm 需配置为 sha256 + suffix
+		// -backendUser 可能包含逗号或引号，用 encoding/csv 转义
+		err := writeFile(filepath.Join(*outDir, "emqx_users.csv"), func(w *bufio.Writer) error {
+			cw := csv.NewWriter(w)
+			cw.Write([]string{"user_id", "password_hash", "salt", "is_superuser"})
+			for _, a := range accounts {
+				hash, salt, err := brokerauth.EMQXHash(a.password)
+				if err != nil {
+					return err
+				}
+				cw.Write([]string{a.user, hash, salt, "false"})
+			}
+			cw.Flush()
+			return cw.Error()
+		})
+		if err != nil {
+			fail(err)
+		}
+		err = writeFile(filepath.Join(*outDir, "emqx_acl.conf"), func(w *bufio.Writer) error {
+			for _, a := range accounts {
+				w.WriteString(brokerauth.EMQXACL(a.user, a.readwrite, a.read))
+			}
+			w.WriteString("{deny, all}.\n")
+			return nil
+		})
+		if err != nil {
+			fail(err)
+		}
+	}
+	fmt.Printf("%d accounts written to %s\n", len(accounts), *outDir)
+}
+
+// 写入、Flush 和 Close 的错误都要返回，否则磁盘满时会留下不完整的文件
+func writeFile(name string, fill func(w *bufio.Writer) error) error {
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	if err := fill(w); err != nil {
+		file.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "gen-broker-auth:", err)
+	os.Exit(1)
+}
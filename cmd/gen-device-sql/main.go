@@ -1,11 +1,168 @@
 package main
 
-import "fmt"
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"mock-bed/pkg/identity"
+)
+
+// bed 表的列，顺序和 bedRow 返回的值一一对应
+var bedCols = []string{
+	"name", "mac", "third_device_pressure_pad_id", "type", "user_ids", "this_city", "this_address", "latitude", "longitude",
+	"create_time", "create_by", "update_time", "update_by", "del_flag", "left_bind_user", "right_bind_user", "region",
+	"bed_end_light", "bed_network", "mattress_model", "kernel_version", "linux_app_version", "algorithm_version",
+	"mcu_left_version", "mcu_right_version", "online_status",
+}
+
+// 用户表的列，只包含生成测试用户所需的字段
+var userCols = []string{"id", "username", "nickname", "create_time", "create_by", "update_time", "update_by", "del_flag"}
+
+// 版本等写入 bed 表的固定字段
+type bedFields struct {
+	name             string
+	createTime       string
+	createBy         string
+	kernelVersion    string
+	linuxAppVersion  string
+	algorithmVersion string
+	mcuLeftVersion   string
+	mcuRightVersion  string
+}
 
 func main() {
-	for i := range 1500 {
-		sql := fmt.Sprintf("INSERT INTO qrem_device.bed ( name, mac, third_device_pressure_pad_id, type, user_ids, this_city, this_address, latitude, longitude, create_time, create_by, update_time, update_by, del_flag, left_bind_user, right_bind_user, region, bed_end_light, bed_network, mattress_model, kernel_version, linux_app_version, algorithm_version, mcu_left_version, mcu_right_version, online_status) VALUES ( 'Jay-Bed', '25MM111111110038100000-%d', null, 0, '', '', null, null, null, '2025-03-24 11:39:49', 'admin', '2025-03-24 11:39:49', 'admin', 0, null, null, null, null, null, 'EK-E', '', '', '', '', '', 0);", i)
-		fmt.Println(sql)
+	var idOpts identity.Options
+	idOpts.RegisterFlags(flag.CommandLine)
+	start := flag.Int("start", 0, "first device number")
+	count := flag.Int("count", 1500, "number of devices")
+	prefix := flag.String("prefix", "", "MAC prefix, shorthand for -macTemplate <prefix>%d")
+	dialectName := flag.String("dialect", "mysql", "SQL dialect: mysql, postgres or sqlite")
+	mode := flag.String("mode", "insert", "insert, upsert or delete")
+	batch := flag.Int("batch", 1, "rows per INSERT/DELETE statement")
+	tableName := flag.String("table", "", "bed table name (default qrem_device.bed, bed for sqlite)")
+	users := flag.Bool("users", false, "also generate the users bound by -bind or the device file")
+	userTable := flag.String("userTable", "", "user table name (default qrem_user.user, user for sqlite)")
+	tx := flag.Bool("tx", false, "wrap the script in a transaction")
+	out := flag.String("o", "", "output file (default stdout)")
+
+	var fields bedFields
+	flag.StringVar(&fields.name, "name", "Jay-Bed", "bed name")
+	flag.StringVar(&fields.createTime, "createTime", "", "create_time/update_time value (default now)")
+	flag.StringVar(&fields.createBy, "createBy", "admin", "create_by/update_by value")
+	flag.StringVar(&fields.kernelVersion, "kernelVersion", "", "kernel_version value")
+	flag.StringVar(&fields.linuxAppVersion, "linuxAppVersion", "", "linux_app_version value")
+	flag.StringVar(&fields.algorithmVersion, "algorithmVersion", "", "algorithm_version value")
+	flag.StringVar(&fields.mcuLeftVersion, "mcuLeftVersion", "", "mcu_left_version value")
+	flag.StringVar(&fields.mcuRightVersion, "mcuRightVersion", "", "mcu_right_version value")
+	flag.Parse()
+
+	d, ok := dialects[*dialectName]
+	if !ok {
+		fail(fmt.Errorf("unknown dialect %q", *dialectName))
+	}
+	if *mode != "insert" && *mode != "upsert" && *mode != "delete" {
+		fail(fmt.Errorf("unknown mode %q", *mode))
+	}
+	if *tableName == "" {
+		*tableName = d.bedTable
+	}
+	if *userTable == "" {
+		*userTable = d.userTable
+	}
+	if *batch < 1 {
+		*batch = 1
+	}
+	if *prefix != "" {
+		idOpts.Template = *prefix + "%d"
+	}
+	if fields.createTime == "" {
+		fields.createTime = time.Now().Format(time.DateTime)
+	}
+
+	devices, err := idOpts.Devices(*start, *start+*count)
+	if err != nil {
+		fail(err)
+	}
 
+	beds := table{name: *tableName, key: "mac", cols: bedCols}
+	userRows := table{name: *userTable, key: "id", cols: userCols}
+	// 设备文件中同一个用户可能绑定在多张床或同一张床的两侧，只生成一次
+	seen := make(map[string]bool)
+	for _, dev := range devices {
+		beds.rows = append(beds.rows, bedRow(d, dev, fields))
+		for _, id := range boundUsers(dev) {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			userRows.rows = append(userRows.rows, userRow(d, id, fields))
+		}
 	}
+
+	output := os.Stdout
+	if *out != "" {
+		output, err = os.Create(*out)
+		if err != nil {
+			fail(err)
+		}
+	}
+	// 写入错误由 bufio.Writer 保存，最后 Flush 时返回；磁盘满或管道断开时以非 0 退出
+	w := bufio.NewWriter(output)
+
+	s := &sqlWriter{w: w, dialect: d, batch: *batch, upsert: *mode == "upsert", tx: *tx}
+	if !*users {
+		userRows.rows = nil
+	}
+	s.script(beds, userRows, *mode == "delete")
+	if err := w.Flush(); err != nil {
+		fail(err)
+	}
+	if *out != "" {
+		if err := output.Close(); err != nil {
+			fail(err)
+		}
+	}
+}
+
+// 设备左右两侧绑定的用户 id
+func boundUsers(dev identity.Device) []string {
+	ids := make([]string, 0, 2)
+	for _, id := range []string{dev.LeftUser, dev.RightUser} {
+		if id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func bedRow(d dialect, dev identity.Device, f bedFields) []string {
+	return []string{
+		d.quote(f.name), d.quote(dev.Mac), "null", "0", d.quote(strings.Join(boundUsers(dev), ",")), "''", "null", "null", "null",
+		d.quote(f.createTime), d.quote(f.createBy), d.quote(f.createTime), d.quote(f.createBy), "0",
+		d.sqlString(dev.LeftUser), d.sqlString(dev.RightUser), "null", "null", "null", d.quote(dev.Model),
+		d.quote(f.kernelVersion), d.quote(f.linuxAppVersion), d.quote(f.algorithmVersion),
+		d.quote(f.mcuLeftVersion), d.quote(f.mcuRightVersion), "0",
+	}
+}
+
+// 生成的用户 id 是数字，设备文件中的用户 id 可能不是
+func userRow(d dialect, id string, f bedFields) []string {
+	idValue := id
+	if _, err := strconv.Atoi(id); err != nil {
+		idValue = d.quote(id)
+	}
+	return []string{
+		idValue, d.quote("mock_" + id), d.quote("Mock User " + id),
+		d.quote(f.createTime), d.quote(f.createBy), d.quote(f.createTime), d.quote(f.createBy), "0",
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "gen-device-sql:", err)
+	os.Exit(1)
 }
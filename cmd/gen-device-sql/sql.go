@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+)
+
+// dialect 不同数据库在 upsert 语法、字符串转义和默认表名上的差异
+type dialect struct {
+	name      string
+	bedTable  string // 默认的 bed 表名，sqlite 没有 schema，不能带库名
+	userTable string // 默认的用户表名
+	backslash bool   // 字符串中的 \ 是转义符（MySQL 默认的 sql_mode）
+	// upsert 返回追加在 INSERT 语句后面的冲突处理子句
+	upsert func(key string, cols []string) string
+}
+
+var dialects = map[string]dialect{
+	"mysql": {
+		name:      "mysql",
+		bedTable:  "qrem_device.bed",
+		userTable: "qrem_user.user",
+		backslash: true,
+		upsert: func(key string, cols []string) string {
+			sets := make([]string, 0, len(cols))
+			for _, col := range updateCols(key, cols) {
+				sets = append(sets, fmt.Sprintf("%s = VALUES(%s)", col, col))
+			}
+			return " ON DUPLICATE KEY UPDATE " + strings.Join(sets, ", ")
+		},
+	},
+	"postgres": {
+		name:      "postgres",
+		bedTable:  "qrem_device.bed",
+		userTable: "qrem_user.user",
+		upsert: func(key string, cols []string) string {
+			return onConflict(key, cols, "EXCLUDED")
+		},
+	},
+	"sqlite": {
+		name:      "sqlite",
+		bedTable:  "bed",
+		userTable: "user",
+		upsert: func(key string, cols []string) string {
+			return onConflict(key, cols, "excluded")
+		},
+	},
+}
+
+// upsert 时更新的列：唯一键和创建时间、创建人保持原值
+func updateCols(key string, cols []string) []string {
+	var update []string
+	for _, col := range cols {
+		if col != key && col != "create_time" && col != "create_by" {
+			update = append(update, col)
+		}
+	}
+	return update
+}
+
+// PostgreSQL 和 SQLite 共用的 ON CONFLICT 子句
+func onConflict(key string, cols []string, excluded string) string {
+	sets := make([]string, 0, len(cols))
+	for _, col := range updateCols(key, cols) {
+		sets = append(sets, fmt.Sprintf("%s = %s.%s", col, excluded, col))
+	}
+	return fmt.Sprintf(" ON CONFLICT (%s) DO UPDATE SET %s", key, strings.Join(sets, ", "))
+}
+
+// table 一张表的种子数据，rows 中的值已经是 SQL 字面量
+type table struct {
+	name string
+	key  string // 唯一键列，用于 upsert 和 delete
+	cols []string
+	rows [][]string
+}
+
+// sqlWriter 按批次输出 INSERT/DELETE 语句
+type sqlWriter struct {
+	w       *bufio.Writer
+	dialect dialect
+	batch   int
+	upsert  bool
+	tx      bool // 整个脚本放在一个事务中
+}
+
+// script 输出完整的脚本：先插入用户再插入床，删除时顺序相反；users 没有行时跳过
+func (s *sqlWriter) script(beds, users table, del bool) {
+	if s.tx {
+		s.w.WriteString("BEGIN;\n")
+	}
+	if del {
+		s.delete(beds)
+		s.delete(users)
+	} else {
+		s.insert(users)
+		s.insert(beds)
+	}
+	if s.tx {
+		s.w.WriteString("COMMIT;\n")
+	}
+}
+
+// insert 每 batch 行合并成一条多行 INSERT
+func (s *sqlWriter) insert(t table) {
+	for i := 0; i < len(t.rows); i += s.batch {
+		rows := t.rows[i:min(i+s.batch, len(t.rows))]
+		fmt.Fprintf(s.w, "INSERT INTO %s (%s) VALUES ", t.name, strings.Join(t.cols, ", "))
+		for j, row := range rows {
+			if j > 0 {
+				s.w.WriteString(", ")
+			}
+			fmt.Fprintf(s.w, "(%s)", strings.Join(row, ", "))
+		}
+		if s.upsert {
+			s.w.WriteString(s.dialect.upsert(t.key, t.cols))
+		}
+		s.w.WriteString(";\n")
+	}
+}
+
+// delete 按唯一键批量删除，用于清理测试环境
+func (s *sqlWriter) delete(t table) {
+	keyIdx := 0
+	for i, col := range t.cols {
+		if col == t.key {
+			keyIdx = i
+		}
+	}
+	for i := 0; i < len(t.rows); i += s.batch {
+		rows := t.rows[i:min(i+s.batch, len(t.rows))]
+		keys := make([]string, 0, len(rows))
+		for _, row := range rows {
+			keys = append(keys, row[keyIdx])
+		}
+		fmt.Fprintf(s.w, "DELETE FROM %s WHERE %s IN (%s);\n", t.name, t.key, strings.Join(keys, ", "))
+	}
+}
+
+// 空字符串输出 null，其余加引号
+func (d dialect) sqlString(s string) string {
+	if s == "" {
+		return "null"
+	}
+	return d.quote(s)
+}
+
+// 单引号转义后加引号，MySQL 还要转义反斜杠
+func (d dialect) quote(s string) string {
+	if d.backslash {
+		s = strings.ReplaceAll(s, `\`, `\\`)
+	}
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
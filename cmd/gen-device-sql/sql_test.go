@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func testTable(name string, keys ...string) table {
+	t := table{name: name, key: "id", cols: []string{"id", "name", "create_time", "create_by"}}
+	for _, k := range keys {
+		t.rows = append(t.rows, []string{k, "'n" + k + "'", "'t'", "'admin'"})
+	}
+	return t
+}
+
+// 生成脚本并返回输出
+func render(d dialect, batch int, upsert, tx, del bool, beds, users table) string {
+	var b strings.Builder
+	w := bufio.NewWriter(&b)
+	s := &sqlWriter{w: w, dialect: d, batch: batch, upsert: upsert, tx: tx}
+	s.script(beds, users, del)
+	w.Flush()
+	return b.String()
+}
+
+func TestScript(t *testing.T) {
+	beds := testTable("bed", "1", "2", "3")
+	none := testTable("user")
+	cases := []struct {
+		name    string
+		dialect string
+		batch   int
+		upsert  bool
+		del     bool
+		want    string
+	}{
+		{"insert batch 1", "sqlite", 1, false, false,
+			"INSERT INTO bed (id, name, create_time, create_by) VALUES (1, 'n1', 't', 'admin');\n" +
+				"INSERT INTO bed (id, name, create_time, create_by) VALUES (2, 'n2', 't', 'admin');\n" +
+				"INSERT INTO bed (id, name, create_time, create_by) VALUES (3, 'n3', 't', 'admin');\n"},
+		// 3 行按 2 行一批，最后一批不满
+		{"insert batch 2", "postgres", 2, false, false,
+			"INSERT INTO bed (id, name, create_time, create_by) VALUES (1, 'n1', 't', 'admin'), (2, 'n2', 't', 'admin');\n" +
+				"INSERT INTO bed (id, name, create_time, create_by) VALUES (3, 'n3', 't', 'admin');\n"},
+		{"upsert mysql", "mysql", 3, true, false,
+			"INSERT INTO bed (id, name, create_time, create_by) VALUES (1, 'n1', 't', 'admin'), (2, 'n2', 't', 'admin'), (3, 'n3', 't', 'admin')" +
+				" ON DUPLICATE KEY UPDATE name = VALUES(name);\n"},
+		{"upsert postgres", "postgres", 3, true, false,
+			"INSERT INTO bed (id, name, create_time, create_by) VALUES (1, 'n1', 't', 'admin'), (2, 'n2', 't', 'admin'), (3, 'n3', 't', 'admin')" +
+				" ON CONFLICT (id) DO UPDATE SET name = EXCLUDED.name;\n"},
+		{"upsert sqlite", "sqlite", 3, true, false,
+			"INSERT INTO bed (id, name, create_time, create_by) VALUES (1, 'n1', 't', 'admin'), (2, 'n2', 't', 'admin'), (3, 'n3', 't', 'admin')" +
+				" ON CONFLICT (id) DO UPDATE SET name = excluded.name;\n"},
+		{"delete batch 2", "mysql", 2, false, true,
+			"DELETE FROM bed WHERE id IN (1, 2);\nDELETE FROM bed WHERE id IN (3);\n"},
+	}
+	for _, c := range cases {
+		if got := render(dialects[c.dialect], c.batch, c.upsert, false, c.del, beds, none); got != c.want {
+			t.Errorf("%s:\ngot  %q\nwant %q", c.name, got, c.want)
+		}
+	}
+}
+
+// 先插入用户再插入床，删除时先删床再删用户，整个脚本在一个事务中
+func TestScriptUsersOrder(t *testing.T) {
+	beds, users := testTable("bed", "1"), testTable("user", "7")
+	got := render(dialects["sqlite"], 1, false, true, false, beds, users)
+	if !strings.HasPrefix(got, "BEGIN;\nINSERT INTO user ") || !strings.Contains(got, ";\nINSERT INTO bed ") || !strings.HasSuffix(got, "COMMIT;\n") {
+		t.Errorf("insert order:\n%s", got)
+	}
+	got = render(dialects["sqlite"], 1, false, false, true, beds, users)
+	if got != "DELETE FROM bed WHERE id IN (1);\nDELETE FROM user WHERE id IN (7);\n" {
+		t.Errorf("delete order:\n%s", got)
+	}
+}
+
+func TestQuote(t *testing.T) {
+	if got := dialects["mysql"].quote(`it's C:\`); got != `'it''s C:\\'` {
+		t.Errorf("mysql quote = %s", got)
+	}
+	if got := dialects["postgres"].quote(`it's C:\`); got != `'it''s C:\'` {
+		t.Errorf("postgres quote = %s", got)
+	}
+	if got := dialects["sqlite"].sqlString(""); got != "null" {
+		t.Errorf("sqlString(\"\") = %s", got)
+	}
+}
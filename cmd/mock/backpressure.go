@@ -0,0 +1,199 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/panjf2000/ants/v2"
+)
+
+// 协程池满时的处理方式
+const (
+	policyBlock      = "block"      // 等待空闲协程，调度会被拖慢，旧的行为
+	policyDropNewest = "dropNewest" // 队列满时丢弃新提交的发布
+	policyDropOldest = "dropOldest" // 队列满时丢弃最早排队的发布
+	policyCoalesce   = "coalesce"   // 同一张床同一种消息只保留最新的一次，队列满时丢弃新提交的发布
+)
+
+// 同一种消息两次告警的最小间隔
+const lateWarnInterval = 10 * time.Second
+
+// job 一张床一种消息的一次发布
+type job struct {
+	key      string // mac/消息类型，coalesce 时按它合并
+	name     string
+	due      time.Time // 计划发布的时间
+	interval time.Duration
+	fn       func()
+}
+
+// dispatcher 调度和协程池之间的缓冲，按 -backpressure 处理协程池饱和；
+// block 直接提交到协程池，其他策略先放入有界队列，由单独的协程依次提交
+type dispatcher struct {
+	policy string
+	pool   *ants.Pool
+	limit  int
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queue   *list.List               // *job
+	pending map[string]*list.Element // coalesce 时 key -> 队列中的 job
+	closed  bool
+	done    chan struct{}
+
+	lastWarn map[string]*atomic.Int64 // 消息类型 -> 上次告警的时间（UnixNano），创建后只读
+}
+
+func validatePolicy(policy string) error {
+	switch policy {
+	case policyBlock, policyDropNewest, policyDropOldest, policyCoalesce:
+		return nil
+	}
+	return fmt.Errorf("unknown backpressure policy %q, expected block, dropNewest, dropOldest or coalesce", policy)
+}
+
+// limit 为队列长度，block 策略下不使用
+func newDispatcher(policy string, pool *ants.Pool, limit int) *dispatcher {
+	d := &dispatcher{
+		policy:   policy,
+		pool:     pool,
+		limit:    limit,
+		queue:    list.New(),
+		pending:  make(map[string]*list.Element),
+		done:     make(chan struct{}),
+		lastWarn: make(map[string]*atomic.Int64),
+	}
+	d.cond = sync.NewCond(&d.mu)
+	for _, g := range generators {
+		d.lastWarn[g.name] = new(atomic.Int64)
+	}
+	if policy == policyBlock {
+		close(d.done)
+	} else {
+		go d.pump()
+	}
+	return d
+}
+
+// 提交一次发布
+func (d *dispatcher) submit(j *job) {
+	if d.policy == policyBlock {
+		if err := d.pool.Submit(d.run(j)); err != nil {
+			d.drop(j, "closed")
+		}
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		d.drop(j, "closed")
+		return
+	}
+	if d.policy == policyCoalesce {
+		if e, ok := d.pending[j.key]; ok {
+			// 还没开始发布，直接换成新的一次，保留原来的排队位置
+			old := e.Value.(*job)
+			e.Value = j
+			runStats.coalesced.Add(1)
+			metrics.dropped.WithLabelValues(old.name, policyCoalesce).Inc()
+			return
+		}
+	}
+	if d.queue.Len() >= d.limit {
+		if d.policy == policyDropOldest {
+			d.remove(d.queue.Front())
+		} else {
+			d.drop(j, d.policy)
+			return
+		}
+	}
+	e := d.queue.PushBack(j)
+	if d.policy == policyCoalesce {
+		d.pending[j.key] = e
+	}
+	d.cond.Signal()
+}
+
+// 调用方持有 mu
+func (d *dispatcher) remove(e *list.Element) {
+	j := d.queue.Remove(e).(*job)
+	delete(d.pending, j.key)
+	d.drop(j, d.policy)
+}
+
+func (d *dispatcher) drop(j *job, reason string) {
+	runStats.dropped.Add(1)
+	metrics.dropped.WithLabelValues(j.name, reason).Inc()
+}
+
+// 依次把队列里的发布提交到协程池，协程池满时在这里等待
+func (d *dispatcher) pump() {
+	defer close(d.done)
+	for {
+		d.mu.Lock()
+		for d.queue.Len() == 0 && !d.closed {
+			d.cond.Wait()
+		}
+		if d.queue.Len() == 0 {
+			d.mu.Unlock()
+			return
+		}
+		j := d.queue.Remove(d.queue.Front()).(*job)
+		delete(d.pending, j.key)
+		d.mu.Unlock()
+		if err := d.pool.Submit(d.run(j)); err != nil {
+			d.drop(j, "closed")
+		}
+	}
+}
+
+// 包装发布函数，开始执行时检查是否迟到
+func (d *dispatcher) run(j *job) func() {
+	return func() {
+		// 落后超过一个周期时，下一次发布已经该开始了，算作迟到
+		late := time.Since(j.due)
+		if late > j.interval {
+			runStats.late.Add(1)
+			metrics.late.WithLabelValues(j.name).Inc()
+			d.warn(j, late)
+		}
+		j.fn()
+	}
+}
+
+// 每种消息最多每 10 秒告警一次
+func (d *dispatcher) warn(j *job, late time.Duration) {
+	last, ok := d.lastWarn[j.name]
+	if !ok {
+		return
+	}
+	now := time.Now().UnixNano()
+	prev := last.Load()
+	if now-prev < int64(lateWarnInterval) || !last.CompareAndSwap(prev, now) {
+		return
+	}
+	line := fmt.Sprintf("warning: %s can't keep its %s interval, publishes are %s late", j.name, j.interval, late.Round(time.Millisecond))
+	fmt.Println(line)
+	log.Println(line)
+}
+
+// 排队中的发布数
+func (d *dispatcher) queued() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.queue.Len()
+}
+
+// 不再接受新的发布，等待队列中的发布都提交到协程池
+func (d *dispatcher) close() {
+	d.mu.Lock()
+	d.closed = true
+	d.cond.Broadcast()
+	d.mu.Unlock()
+	<-d.done
+}
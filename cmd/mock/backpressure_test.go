@@ -0,0 +1,120 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/panjf2000/ants/v2"
+)
+
+// 协程池只有一个协程，第一个发布占住它直到 release 关闭
+type saturated struct {
+	p       *ants.Pool
+	release chan struct{}
+	mu      sync.Mutex
+	ran     []string
+}
+
+func newSaturated() *saturated {
+	p, _ := ants.NewPool(1)
+	return &saturated{p: p, release: make(chan struct{})}
+}
+
+func (s *saturated) job(key string, first bool) *job {
+	return &job{key: key, name: "status", due: time.Now(), interval: time.Hour, fn: func() {
+		if first {
+			<-s.release
+		}
+		s.mu.Lock()
+		s.ran = append(s.ran, key)
+		s.mu.Unlock()
+	}}
+}
+
+// 放行所有发布，等待它们执行完，返回执行顺序
+func (s *saturated) finish(t *testing.T, d *dispatcher) string {
+	close(s.release)
+	return s.wait(t, d)
+}
+
+func (s *saturated) wait(t *testing.T, d *dispatcher) string {
+	d.close()
+	if err := s.p.ReleaseTimeout(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return strings.Join(s.ran, "")
+}
+
+// a 占住协程池，b 由队列协程取出后阻塞在提交上，之后的发布进入长度为 2 的队列
+func TestBackpressureQueue(t *testing.T) {
+	cases := []struct {
+		policy    string
+		keys      string
+		ran       string
+		dropped   int64
+		coalesced int64
+	}{
+		{policyDropNewest, "abcde", "abcd", 1, 0},
+		{policyDropOldest, "abcde", "abde", 1, 0},
+		// 第二个 c 替换排队中的 c，保留原来的位置；队列满后 e 被丢弃
+		{policyCoalesce, "abcdce", "abcd", 1, 1},
+	}
+	for _, c := range cases {
+		t.Run(c.policy, func(t *testing.T) {
+			s := newSaturated()
+			d := newDispatcher(c.policy, s.p, 2)
+			dropped, coalesced := runStats.dropped.Load(), runStats.coalesced.Load()
+			for i, key := range c.keys {
+				d.submit(s.job(string(key), i == 0))
+				switch i {
+				case 0:
+					waitFor(t, "pool to be busy", func() bool { return s.p.Running() == 1 })
+				case 1:
+					waitFor(t, "pump to block", func() bool { return s.p.Waiting() == 1 && d.queued() == 0 })
+				}
+			}
+			if got := runStats.dropped.Load() - dropped; got != c.dropped {
+				t.Errorf("dropped %d, want %d", got, c.dropped)
+			}
+			if got := runStats.coalesced.Load() - coalesced; got != c.coalesced {
+				t.Errorf("coalesced %d, want %d", got, c.coalesced)
+			}
+			if got := s.finish(t, d); got != c.ran {
+				t.Errorf("ran %s, want %s", got, c.ran)
+			}
+		})
+	}
+}
+
+// block 策略不丢弃，提交阻塞到协程池有空闲
+func TestBackpressureBlock(t *testing.T) {
+	s := newSaturated()
+	d := newDispatcher(policyBlock, s.p, 0)
+	dropped := runStats.dropped.Load()
+	d.submit(s.job("a", true))
+	waitFor(t, "pool to be busy", func() bool { return s.p.Running() == 1 })
+
+	var submitted atomic.Bool
+	go func() {
+		d.submit(s.job("b", false))
+		submitted.Store(true)
+	}()
+	waitFor(t, "submit to block", func() bool { return s.p.Waiting() == 1 })
+	if submitted.Load() {
+		t.Fatal("submit returned while the pool was saturated")
+	}
+	// 关闭协程池前等提交完成，否则阻塞的提交会因为协程池关闭而丢弃
+	close(s.release)
+	waitFor(t, "submit to return", submitted.Load)
+	if got := s.wait(t, d); got != "ab" {
+		t.Errorf("ran %s, want ab", got)
+	}
+	if got := runStats.dropped.Load() - dropped; got != 0 {
+		t.Errorf("dropped %d, want 0", got)
+	}
+}
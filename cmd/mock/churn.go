@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"mock-bed/pkg/identity"
+)
+
+const (
+	disconnectClean  = "clean"  // 发送 DISCONNECT，代理不发布遗嘱
+	disconnectAbrupt = "abrupt" // 模拟掉电，直接关闭连接，代理发布遗嘱
+)
+
+// churnOptions 上下线模拟参数，每张床的在线时长和离线时长服从指数分布
+type churnOptions struct {
+	mtbf time.Duration // 平均在线时长，0 表示不模拟
+	mttr time.Duration // 平均离线时长
+	mode string        // 下线方式：clean 或 abrupt
+}
+
+func (o churnOptions) validate() error {
+	if o.mode != disconnectClean && o.mode != disconnectAbrupt {
+		return fmt.Errorf("unknown disconnect mode %q, expected clean or abrupt", o.mode)
+	}
+	if o.mtbf > 0 && o.mttr <= 0 {
+		return fmt.Errorf("churnMTTR must be positive")
+	}
+	return nil
+}
+
+// 上下线次数统计
+var churnStats struct {
+	offline       atomic.Int64
+	online        atomic.Int64
+	reconnectErrs atomic.Int64
+}
+
+// 按均值随机生成一个服从指数分布的时长
+func expDuration(mean time.Duration) time.Duration {
+	return time.Duration(rand.ExpFloat64() * float64(mean))
+}
+
+// 等待 d，ctx 结束时提前返回 false
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// 每张床一个协程，按 MTBF/MTTR 反复下线、上线，直到 ctx 结束
+func runChurn(ctx context.Context, beds []*bed, o churnOptions) {
+	for _, b := range beds {
+		go func() {
+			for {
+				if !sleepCtx(ctx, expDuration(o.mtbf)) || b.removed.Load() {
+					return
+				}
+				b.goOffline(o.mode)
+				// 重连失败时继续离线一段时间再试
+				for {
+					if !sleepCtx(ctx, expDuration(o.mttr)) || b.removed.Load() {
+						return
+					}
+					if _, err := b.goOnline(); err != nil {
+						churnStats.reconnectErrs.Add(1)
+						log.Println(fmt.Sprintf("reconnect mac=%s,err=%v", b.Mac, err))
+						errorLog.add(b.Mac, "reconnect", err)
+						continue
+					}
+					break
+				}
+			}
+		}()
+	}
+}
+
+// 下线，床的所有连接一起断开
+func (b *bed) goOffline(mode string) {
+	b.online.Store(false)
+	for _, c := range b.conns() {
+		if mode == disconnectAbrupt {
+			c.Drop()
+		} else {
+			c.Disconnect(250 * time.Millisecond)
+		}
+	}
+	churnStats.offline.Add(1)
+	log.Println(fmt.Sprintf("offline mac=%s,mode=%s", b.Mac, mode))
+}
+
+// 设备启动后依次上报心跳、硬件状态和算法状态
+var bootSequence = []func(dev identity.Device, now time.Time) []frame{
+	buildHeartBeat,
+	buildGET_HARDWARE_ALL_STATUS,
+	buildGET_ALGOR_ALL_STATUS,
+}
+
+// 重新上线，订阅由客户端自动恢复；上线后上报启动序列，返回床客户端的连接耗时
+func (b *bed) goOnline() (time.Duration, error) {
+	start := time.Now()
+	if err := b.client.Connect(); err != nil {
+		return 0, err
+	}
+	connectTime := time.Since(start)
+	if b.otaClient != nil {
+		if err := b.otaClient.Connect(); err != nil {
+			b.client.Disconnect(250 * time.Millisecond)
+			return 0, err
+		}
+	}
+	b.online.Store(true)
+	churnStats.online.Add(1)
+	log.Println(fmt.Sprintf("online mac=%s,connect=%s", b.Mac, connectTime))
+	now := time.Now()
+	for _, build := range bootSequence {
+		// 按当前的在床状态上报，离床的一侧按没有人处理
+		for _, f := range build(b.device(), now) {
+			encryptedData, err := f.payload()
+			if err != nil {
+				fmt.Println("Encrypt error:", err)
+				runStats.errors.Add(1)
+				metrics.encryptError(statBoot)
+				continue
+			}
+			if err := publish(b.client, statBoot, b.Mac, f.topic, encryptedData); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+	return connectTime, nil
+}
+
+// 当前在线的床数
+func onlineBeds(beds []*bed) int {
+	n := 0
+	for _, b := range beds {
+		if b.online.Load() {
+			n++
+		}
+	}
+	return n
+}
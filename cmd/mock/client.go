@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+
+	"mock-bed/pkg/brokerauth"
+	"mock-bed/pkg/encryption"
+	"mock-bed/pkg/mqttclient"
+	"mock-bed/pkg/tlsconf"
+)
+
+// brokerOptions 连接代理的参数，由命令行参数填充
+type brokerOptions struct {
+	url        string
+	username   string
+	password   string
+	deviceAuth bool            // 每台设备使用独立账号
+	authSecret string          // 推导设备密码的密钥
+	tls        *tlsconf.Source // 为 nil 时不使用 TLS
+	protocol   mqttclient.ProtocolOptions
+	will       willOptions
+	qos        qosOptions
+	shard      shardOptions
+	impair     impairOptions
+}
+
+// willOptions 床客户端的遗嘱消息，topic 中的 %s 替换为设备 MAC
+type willOptions struct {
+	enabled bool
+	topic   string
+	payload string // 明文帧的十六进制，和其他帧一样加密后发布
+	qos     int
+	retain  bool
+}
+
+// 设备 mac 的遗嘱消息，未启用时返回 nil
+func (w willOptions) message(mac string) (*mqttclient.Will, error) {
+	if !w.enabled {
+		return nil, nil
+	}
+	data, err := hex.DecodeString(w.payload)
+	if err != nil || len(data) == 0 {
+		return nil, fmt.Errorf("invalid will payload %q", w.payload)
+	}
+	enc, err := encryption.Encrypt(data)
+	if err != nil {
+		return nil, err
+	}
+	topic := w.topic
+	if strings.Contains(topic, "%s") {
+		topic = fmt.Sprintf(topic, mac)
+	}
+	return &mqttclient.Will{Topic: topic, Payload: enc, QoS: byte(w.qos), Retained: w.retain}, nil
+}
+
+var broker = brokerOptions{url: brokerHost, username: username, password: pwd}
+
+// 返回设备连接使用的用户名和密码
+func (o brokerOptions) credentials(mac string) (string, string) {
+	if o.deviceAuth {
+		return mac, brokerauth.Password(o.authSecret, mac)
+	}
+	return o.username, o.password
+}
+
+// 设备 devMac 使用 clientID 连接时的客户端选项，床和 ota 客户端共用
+func newClientOptions(devMac, clientID string) mqttclient.Options {
+	user, password := broker.credentials(devMac)
+	server, failover := broker.shard.servers(devMac)
+	opts := mqttclient.Options{
+		Broker:   server,   // MQTT 代理服务器地址
+		Failover: failover, // 断线后依次尝试的其他代理
+		ClientID: clientID, // 设置客户端ID
+		Username: user,     // 设置用户名
+		Password: password, // 设置密码
+	}
+	broker.protocol.Apply(&opts)
+	opts.WrapConn = broker.impair.wrapper(devMac)
+	if broker.tls != nil {
+		cfg, err := broker.tls.Config(devMac)
+		if err != nil {
+			log.Println("can't load tls config.")
+			panic(err)
+		}
+		opts.TLS = cfg
+	}
+	return opts
+}
+
+// 创建客户端并连接到 MQTT 代理，失败时 panic
+func connect(opts mqttclient.Options) mqttclient.Client {
+	client, err := mqttclient.New(opts) // 创建 MQTT 客户端实例
+	if err != nil {
+		panic(err)
+	}
+	if err := client.Connect(); err != nil { // 连接到 MQTT 代理
+		log.Println("can't connect to broker.")
+		panic(err)
+	}
+	return client
+}
+
+// 床客户端订阅的主题，withOta 为 true 时同时订阅 ota 主题（shared 拓扑）
+func bedTopics(mac string, withOta bool) []string {
+	topics := []string{fmt.Sprintf(controlSubTopic, mac), fmt.Sprintf(getBedStatusSubTopic, mac)}
+	if withOta {
+		topics = append(topics, fmt.Sprintf(otaSubTopic, mac))
+	}
+	return topics
+}
+
+func getMqttClient(mac string, topics []string) mqttclient.Client {
+	opts := newClientOptions(mac, mac)
+	opts.OnConnect = onConnnect // 设置连接处理器
+	will, err := broker.will.message(mac)
+	if err != nil {
+		panic(err)
+	}
+	opts.Will = will
+
+	client := connect(opts)
+	subscribeTopics(client, topics)
+	return client
+}
+
+// ota 客户端与设备共用账号，客户端ID为 "ota-"+mac
+func getOtaMqttClient(devMac string) mqttclient.Client {
+	mac := "ota-" + devMac
+	opts := newClientOptions(devMac, mac)
+	opts.OnConnect = onConnnect2 // 设置连接处理器
+
+	client := connect(opts)
+	subscribeTopics(client, []string{fmt.Sprintf(otaSubTopic, mac)})
+	return client
+}
+
+// 多张床共用的客户端，使用共享账号，客户端ID为 "mux-"+第一张床在完整设备列表中的序号，
+// 多个工作进程连接同一个代理时不会重复；不设置遗嘱
+func getMuxMqttClient(id int, devMac string, topics []string) mqttclient.Client {
+	opts := newClientOptions(devMac, fmt.Sprintf("mux-%d", id))
+	opts.OnConnect = onConnnect
+
+	client := connect(opts)
+	subscribeTopics(client, topics)
+	return client
+}
+
+// 连接成功后订阅主题，失败时 panic
+func subscribeTopics(client mqttclient.Client, topics []string) {
+	if !client.IsConnected() {
+		return
+	}
+	log.Println("Connect to broker successed. ")
+	for _, topic := range topics {
+		if err := subscribe(client, topic, controlMsgRecHandler); err != nil {
+			// 订阅已记录，连接断开后重连时会自动订阅，不再退出
+			log.Println("Can't not subscribe " + topic + " topic.")
+			log.Println(err)
+		}
+	}
+	log.Println("Start subscribe  topic.")
+}
+
+// 连接处理器函数
+func onConnnect(client mqttclient.Client) {
+	runStats.connects.Add(1)
+	metrics.connects.Inc()
+	if st := broker.shard.stat(client); st != nil {
+		st.connects.Add(1)
+	}
+}
+
+// 连接处理器函数
+func onConnnect2(client mqttclient.Client) {
+	runStats.connects.Add(1)
+	metrics.connects.Inc()
+	if st := broker.shard.stat(client); st != nil {
+		st.connects.Add(1)
+	}
+}
@@ -0,0 +1,561 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/panjf2000/ants/v2"
+
+	"mock-bed/pkg/identity"
+)
+
+// 运行时控制接口：查看和增删设备，按消息类型或设备暂停发布，修改周期，触发事件，查看一张床最近的消息。
+// 请求和响应都是 JSON，错误时返回文本；同一个地址还提供仪表盘，见 dashboard.go。
+// 运行时加入的设备按周期发布、响应命令，但不参与断线（-churnMTBF）和重连风暴（-outageAt），
+// -rate 的估计速率也只按启动时的设备计算，加入后由速率控制按实际速率调整
+//
+//	GET    /devices                   所有设备及状态
+//	POST   /devices                   加入设备：{"count": 10}（最多 1000）或 {"mac": "..."}，可选 model、profile
+//	GET    /devices/{mac}             一台设备的状态
+//	DELETE /devices/{mac}             断开并移除设备
+//	GET    /devices/{mac}/messages    最近发布的消息，从新到旧
+//	POST   /devices/{mac}/pause       暂停设备的消息：{"types": ["pressure_pad"]}，省略 types 时暂停全部
+//	POST   /devices/{mac}/resume      恢复设备的消息，参数同上
+//	POST   /devices/{mac}/events      触发事件：{"type": "fault|bedExit|bedEnter|posture|reboot", ...}
+//	GET    /watch                     收发消息的事件流（SSE），可按 mac 和 kind（command、ack、publish）过滤，参数可重复
+//	GET    /generators                所有消息类型的周期和状态
+//	PATCH  /generators/{name}         修改周期：{"interval": "500ms"}
+//	POST   /generators/{name}/pause   所有设备暂停这种消息
+//	POST   /generators/{name}/resume  所有设备恢复这种消息
+
+// 控制接口允许设置的最短周期，再短时间轮的刻度跟不上
+const minInterval = 10 * time.Millisecond
+
+// 一次最多加入的设备数，加入时逐台同步连接，期间不能增删其他设备
+const maxAddCount = 1000
+
+// 事件类型
+const (
+	eventFault    = "fault"    // 上报一条故障码
+	eventBedExit  = "bedExit"  // 离床，这一侧按没有人生成数据
+	eventBedEnter = "bedEnter" // 上床
+	eventPosture  = "posture"  // 上报一次睡姿
+	eventReboot   = "reboot"   // 掉电重启，离线 downtime 后重新上线并上报启动序列
+)
+
+// controlServer 控制接口，修改运行中的 fleet 和发布调度
+type controlServer struct {
+	fleet    *fleet
+	plan     *plan
+	pool     *ants.Pool
+	topology topologyOptions
+	ids      *identity.Options
+
+	mu   sync.Mutex // 串行化设备的增删
+	next int        // 下一个按模板生成的 MAC 编号
+}
+
+// deviceView 一台设备的状态
+type deviceView struct {
+	Mac       string   `json:"mac"`
+	Model     string   `json:"model"`
+	Profile   string   `json:"profile"`
+	Online    bool     `json:"online"`
+	Connected bool     `json:"connected"`
+	Broker    string   `json:"broker,omitempty"`
+	Paused    []string `json:"paused,omitempty"` // 暂停的消息类型，全部暂停时为 ["*"]
+	Absent    []string `json:"absent,omitempty"` // 离床的一侧
+}
+
+// generatorView 一种消息的周期和状态
+type generatorView struct {
+	Name     string `json:"name"`
+	Interval string `json:"interval"`
+	Default  string `json:"default"`
+	Paused   bool   `json:"paused"`
+}
+
+type addRequest struct {
+	Mac     string `json:"mac"`
+	Count   int    `json:"count"`
+	Model   string `json:"model"`
+	Profile string `json:"profile"`
+}
+
+type typesRequest struct {
+	Types []string `json:"types"`
+}
+
+type intervalRequest struct {
+	Interval string `json:"interval"`
+}
+
+type eventRequest struct {
+	Type     string `json:"type"`
+	Side     string `json:"side"`     // left 或 right，省略时两侧
+	Posture  *int   `json:"posture"`  // 睡姿 0-6，省略时随机
+	Code     *int   `json:"code"`     // 故障码 1-255，省略时随机
+	Downtime string `json:"downtime"` // 重启的离线时长，默认 5s
+}
+
+// 在 addr 上启动控制接口，addr 为空时不启动
+func (s *controlServer) serve(addr string) {
+	if addr == "" {
+		return
+	}
+	go func() {
+		if err := http.ListenAndServe(addr, s.handler()); err != nil {
+			fmt.Println("control server error:", err)
+			log.Println(err)
+		}
+	}()
+	fmt.Println("control API on http://" + addr + "/devices, dashboard on http://" + addr + "/")
+}
+
+func (s *controlServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /devices", s.listDevices)
+	mux.HandleFunc("POST /devices", s.addDevices)
+	mux.HandleFunc("GET /devices/{mac}", s.getDevice)
+	mux.HandleFunc("DELETE /devices/{mac}", s.removeDevice)
+	mux.HandleFunc("GET /devices/{mac}/messages", s.messages)
+	mux.HandleFunc("POST /devices/{mac}/pause", s.pauseDevice(true))
+	mux.HandleFunc("POST /devices/{mac}/resume", s.pauseDevice(false))
+	mux.HandleFunc("POST /devices/{mac}/events", s.trigger)
+	mux.HandleFunc("GET /generators", s.listGenerators)
+	mux.HandleFunc("PATCH /generators/{name}", s.setInterval)
+	mux.HandleFunc("POST /generators/{name}/pause", s.pauseGenerator(true))
+	mux.HandleFunc("POST /generators/{name}/resume", s.pauseGenerator(false))
+	mux.HandleFunc("GET /watch", s.watch)
+	mux.HandleFunc("GET /{$}", s.dashboard)
+	mux.HandleFunc("GET /dashboard/fleet", s.fleetEvents)
+	mux.HandleFunc("GET /dashboard/beds/{mac}", s.bedEvents)
+	return mux
+}
+
+func (b *bed) view() deviceView {
+	dev := b.device()
+	v := deviceView{
+		Mac:       b.Mac,
+		Model:     b.Model,
+		Profile:   b.Profile,
+		Online:    b.online.Load(),
+		Connected: b.client.IsConnected(),
+		Broker:    b.client.Server(),
+		Paused:    b.pausedTypes(),
+	}
+	if b.Device.Occupied(identity.Left) && !dev.Occupied(identity.Left) {
+		v.Absent = append(v.Absent, "left")
+	}
+	if b.Device.Occupied(identity.Right) && !dev.Occupied(identity.Right) {
+		v.Absent = append(v.Absent, "right")
+	}
+	return v
+}
+
+func (g generator) view() generatorView {
+	return generatorView{Name: g.name, Interval: g.period().String(), Default: g.interval.String(), Paused: g.ctl.paused.Load()}
+}
+
+func (s *controlServer) listDevices(w http.ResponseWriter, r *http.Request) {
+	beds := s.fleet.list()
+	views := make([]deviceView, 0, len(beds))
+	for _, b := range beds {
+		views = append(views, b.view())
+	}
+	writeJSON(w, views)
+}
+
+// 路径中的设备，不存在时返回 404
+func (s *controlServer) bed(w http.ResponseWriter, r *http.Request) *bed {
+	b := s.fleet.get(r.PathValue("mac"))
+	if b == nil {
+		http.Error(w, "unknown device "+r.PathValue("mac"), http.StatusNotFound)
+	}
+	return b
+}
+
+func (s *controlServer) getDevice(w http.ResponseWriter, r *http.Request) {
+	if b := s.bed(w, r); b != nil {
+		writeJSON(w, b.view())
+	}
+}
+
+func (s *controlServer) messages(w http.ResponseWriter, r *http.Request) {
+	if b := s.bed(w, r); b != nil {
+		writeJSON(w, b.recent.list())
+	}
+}
+
+// 加入设备并连接，mux 拓扑的连接按组创建，不能单独加入
+func (s *controlServer) addDevices(w http.ResponseWriter, r *http.Request) {
+	if s.topology.mode == topologyMux {
+		http.Error(w, "the mux topology can't add devices at runtime", http.StatusConflict)
+		return
+	}
+	var req addRequest
+	if err := decodeBody(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Mac == "" && req.Count <= 0 {
+		req.Count = 1
+	}
+	if req.Mac != "" && req.Count > 1 {
+		http.Error(w, "mac and count can't be combined", http.StatusBadRequest)
+		return
+	}
+	if req.Count > maxAddCount {
+		http.Error(w, fmt.Sprintf("count must be at most %d", maxAddCount), http.StatusBadRequest)
+		return
+	}
+	if req.Model == "" {
+		req.Model = s.ids.Model
+	}
+	switch req.Profile {
+	case "", identity.ProfileCouple, identity.ProfileSingle, identity.ProfileSingleRight, identity.ProfileUnbound:
+	default:
+		http.Error(w, fmt.Sprintf("unknown profile %q", req.Profile), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	devices, err := s.newDevices(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	beds, err := s.connect(devices)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	s.fleet.add(beds)
+	s.pool.Tune(s.pool.Cap() + 10*len(beds))
+	views := make([]deviceView, 0, len(beds))
+	for _, b := range beds {
+		s.plan.add(b)
+		views = append(views, b.view())
+	}
+	line := fmt.Sprintf("control: added %d beds", len(beds))
+	fmt.Println(line)
+	log.Println(line)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, views)
+}
+
+// 按请求生成设备，没有指定 MAC 时按模板从 next 开始跳过已存在的编号
+func (s *controlServer) newDevices(req addRequest) ([]identity.Device, error) {
+	if req.Mac != "" {
+		if err := identity.CheckMac(req.Mac); err != nil {
+			return nil, err
+		}
+		if s.fleet.get(req.Mac) != nil {
+			return nil, fmt.Errorf("device %s already exists", req.Mac)
+		}
+		return []identity.Device{{Mac: req.Mac, Model: req.Model, Profile: req.Profile}}, nil
+	}
+	devices := make([]identity.Device, 0, req.Count)
+	for len(devices) < req.Count {
+		d, err := identity.Range(s.ids.Template, s.ids.Pad, s.next, s.next+1)
+		if err != nil {
+			return nil, err
+		}
+		s.next++
+		if s.fleet.get(d[0].Mac) != nil {
+			continue
+		}
+		d[0].Model, d[0].Profile = req.Model, req.Profile
+		devices = append(devices, d[0])
+	}
+	return devices, nil
+}
+
+// 逐台连接，有一台失败时断开已经连接的设备并返回错误
+func (s *controlServer) connect(devices []identity.Device) ([]*bed, error) {
+	beds := make([]*bed, 0, len(devices))
+	for _, dev := range devices {
+		b, err := s.connectOne(dev)
+		if err != nil {
+			for _, b := range beds {
+				for _, c := range b.conns() {
+					c.Disconnect(250 * time.Millisecond)
+				}
+			}
+			return nil, err
+		}
+		beds = append(beds, b)
+	}
+	return beds, nil
+}
+
+// 创建客户端时连接失败会 panic，这里转成错误
+func (s *controlServer) connectOne(dev identity.Device) (b *bed, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = fmt.Errorf("connect %s: %v", dev.Mac, v)
+		}
+	}()
+	return s.topology.connect([]identity.Device{dev})[0], nil
+}
+
+// 停止发布并断开设备；mux 拓扑的连接还有其他床在用时只停止发布
+func (s *controlServer) removeDevice(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.bed(w, r)
+	if b == nil {
+		return
+	}
+	b.removed.Store(true)
+	b.online.Store(false)
+	s.fleet.remove(b.Mac)
+	// mux 拓扑的连接还有其他床在用时保留，组里最后一张床移除时断开
+	inUse := s.fleet.clients()
+	for _, c := range b.conns() {
+		if !slices.Contains(inUse, c) {
+			c.Disconnect(250 * time.Millisecond)
+		}
+	}
+	line := fmt.Sprintf("control: removed mac=%s", b.Mac)
+	fmt.Println(line)
+	log.Println(line)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *controlServer) pauseDevice(pause bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b := s.bed(w, r)
+		if b == nil {
+			return
+		}
+		var req typesRequest
+		if err := decodeBody(r, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, name := range req.Types {
+			if _, ok := findGenerator(name); !ok {
+				http.Error(w, fmt.Sprintf("unknown message type %q", name), http.StatusBadRequest)
+				return
+			}
+		}
+		switch {
+		case len(req.Types) == 0 && pause:
+			b.pauseAll.Store(true)
+		case len(req.Types) == 0:
+			// 全部恢复
+			b.pauseAll.Store(false)
+			b.paused.Clear()
+		case pause:
+			for _, name := range req.Types {
+				b.paused.Store(name, struct{}{})
+			}
+		default:
+			for _, name := range req.Types {
+				b.paused.Delete(name)
+			}
+		}
+		log.Println(fmt.Sprintf("control: mac=%s,paused=%t,types=%s", b.Mac, pause, typeNames(req.Types)))
+		writeJSON(w, b.view())
+	}
+}
+
+// 触发一次事件，fault 和 posture 立即发布，返回发布的消息
+func (s *controlServer) trigger(w http.ResponseWriter, r *http.Request) {
+	b := s.bed(w, r)
+	if b == nil {
+		return
+	}
+	var req eventRequest
+	if err := decodeBody(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sides := []identity.Side{identity.Left, identity.Right}
+	switch req.Side {
+	case "":
+	case "left":
+		sides = sides[:1]
+	case "right":
+		sides = sides[1:]
+	default:
+		http.Error(w, fmt.Sprintf("unknown side %q, expected left or right", req.Side), http.StatusBadRequest)
+		return
+	}
+
+	switch req.Type {
+	case eventFault:
+		frames := buildErrorCode(b.device(), time.Now())
+		if req.Code != nil {
+			if *req.Code < 1 || *req.Code > 0xff {
+				http.Error(w, "code must be in [1, 255]", http.StatusBadRequest)
+				return
+			}
+			frames = []frame{errorCodeFrame(b.Mac, time.Now(), byte(*req.Code))}
+		}
+		s.publish(w, b, "error_code", frames)
+	case eventPosture:
+		if req.Posture != nil && (*req.Posture < 0 || *req.Posture > 6) {
+			http.Error(w, "posture must be in [0, 6]", http.StatusBadRequest)
+			return
+		}
+		dev := b.device()
+		topic := fmt.Sprintf(bodyInfoPubTopic, b.Mac)
+		var frames []frame
+		for _, side := range sides {
+			if !dev.Occupied(side) {
+				continue
+			}
+			v := randInt(0, 7)
+			if req.Posture != nil {
+				v = *req.Posture
+			}
+			frames = append(frames, frame{topic: topic, data: intFrame(0x93, byte(side), "posture", v)})
+		}
+		if len(frames) == 0 {
+			http.Error(w, "nobody is in bed on this side", http.StatusConflict)
+			return
+		}
+		s.publish(w, b, "posture", frames)
+	case eventBedExit, eventBedEnter:
+		for _, side := range sides {
+			if req.Type == eventBedExit {
+				b.absent.Or(1 << side)
+			} else {
+				b.absent.And(^uint32(1 << side))
+			}
+		}
+		writeJSON(w, b.view())
+	case eventReboot:
+		if s.topology.mode == topologyMux {
+			http.Error(w, "mux connections are shared between beds and can't reboot one bed", http.StatusConflict)
+			return
+		}
+		downtime := 5 * time.Second
+		if req.Downtime != "" {
+			d, err := time.ParseDuration(req.Downtime)
+			if err != nil || d < 0 {
+				http.Error(w, fmt.Sprintf("invalid downtime %q", req.Downtime), http.StatusBadRequest)
+				return
+			}
+			downtime = d
+		}
+		if !b.online.Load() {
+			http.Error(w, "device is offline", http.StatusConflict)
+			return
+		}
+		b.goOffline(disconnectAbrupt)
+		go reboot(b, downtime)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		writeJSON(w, b.view())
+	default:
+		http.Error(w, fmt.Sprintf("unknown event %q, expected fault, bedExit, bedEnter, posture or reboot", req.Type), http.StatusBadRequest)
+	}
+}
+
+// 离线 downtime 后重新上线，失败时每隔几秒重试，设备被移除后放弃
+func reboot(b *bed, downtime time.Duration) {
+	time.Sleep(downtime)
+	for !b.removed.Load() {
+		_, err := b.goOnline()
+		if err == nil {
+			return
+		}
+		log.Println(fmt.Sprintf("reconnect mac=%s,err=%v", b.Mac, err))
+		errorLog.add(b.Mac, "reconnect", err)
+		time.Sleep(3 * time.Second)
+	}
+}
+
+// 立即发布事件产生的消息，离线时拒绝
+func (s *controlServer) publish(w http.ResponseWriter, b *bed, name string, frames []frame) {
+	if !b.online.Load() {
+		http.Error(w, "device is offline", http.StatusConflict)
+		return
+	}
+	// 和 messages 一样从新到旧
+	views := make([]messageView, len(frames))
+	for i, f := range frames {
+		views[len(frames)-1-i] = publishFrame(b, name, f).view()
+	}
+	writeJSON(w, views)
+}
+
+func (s *controlServer) listGenerators(w http.ResponseWriter, r *http.Request) {
+	views := make([]generatorView, 0, len(generators))
+	for _, g := range generators {
+		views = append(views, g.view())
+	}
+	writeJSON(w, views)
+}
+
+// 路径中的消息类型，不存在时返回 404
+func generatorOf(w http.ResponseWriter, r *http.Request) (generator, bool) {
+	g, ok := findGenerator(r.PathValue("name"))
+	if !ok {
+		http.Error(w, "unknown message type "+r.PathValue("name"), http.StatusNotFound)
+	}
+	return g, ok
+}
+
+func (s *controlServer) setInterval(w http.ResponseWriter, r *http.Request) {
+	g, ok := generatorOf(w, r)
+	if !ok {
+		return
+	}
+	var req intervalRequest
+	if err := decodeBody(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	interval, err := time.ParseDuration(req.Interval)
+	if err != nil || interval < minInterval {
+		http.Error(w, fmt.Sprintf("interval must be a duration of at least %s", minInterval), http.StatusBadRequest)
+		return
+	}
+	s.plan.setInterval(g, interval)
+	log.Println(fmt.Sprintf("control: interval %s=%s", g.name, interval))
+	writeJSON(w, g.view())
+}
+
+func (s *controlServer) pauseGenerator(pause bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		g, ok := generatorOf(w, r)
+		if !ok {
+			return
+		}
+		g.ctl.paused.Store(pause)
+		log.Println(fmt.Sprintf("control: %s paused=%t", g.name, pause))
+		writeJSON(w, g.view())
+	}
+}
+
+// 解析 JSON 请求体，允许为空，不允许未知字段
+func decodeBody(r *http.Request, v any) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("invalid request body: %w", err)
+	}
+	return nil
+}
+
+// 以逗号分隔的类型名，用于日志
+func typeNames(types []string) string {
+	if len(types) == 0 {
+		return "*"
+	}
+	return strings.Join(types, ",")
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/madflojo/tasks"
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/panjf2000/ants/v2"
+
+	"mock-bed/pkg/identity"
+)
+
+// 在随机端口上启动一个进程内代理，返回 tcp:// 地址
+func startBroker(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	server := mqtt.New(&mqtt.Options{InlineClient: true, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	if err := server.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.AddListener(listeners.NewTCP(listeners.Config{ID: "t1", Address: addr})); err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	t.Cleanup(func() { server.Close() })
+	return "tcp://" + addr
+}
+
+// 连接到进程内代理的控制接口，初始有 beds 张床，burst 调度的任务周期改为 1 小时前不会发布
+func startControl(t *testing.T, topology topologyOptions, beds int) (*controlServer, *httptest.Server) {
+	saved := broker
+	t.Cleanup(func() { broker = saved })
+	// 同一个代理的两个地址：有多个代理时连接回调才会更新代理的统计，测试结束前按它等回调执行完；
+	// 启动时的床都连第一个地址，mux 拓扑的床可以分到同一组
+	url := startBroker(t)
+	broker.shard = shardOptions{strategy: shardWeighted, weights: "1,0"}
+	if err := broker.shard.parse(url + "," + strings.Replace(url, "127.0.0.1", "localhost", 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	ids := &identity.Options{Template: "CTL-%d", Model: identity.DefaultModel}
+	devices, err := ids.Devices(0, beds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := broker.shard.assign(devices); err != nil {
+		t.Fatal(err)
+	}
+	fl := newFleet(topology.connect(devices))
+	pool, _ := ants.NewPool(10)
+	d := newDispatcher(policyBlock, pool, 0)
+	scheduler := tasks.New()
+	s := &controlServer{
+		fleet:    fl,
+		plan:     &plan{o: scheduleOptions{mode: scheduleBurst}, f: fl, d: d, scheduler: scheduler},
+		pool:     pool,
+		topology: topology,
+		ids:      ids,
+		next:     beds,
+	}
+	srv := httptest.NewServer(s.handler())
+	t.Cleanup(func() {
+		// 连接回调在客户端的协程里执行，等它们都执行完再恢复 broker
+		waitFor(t, "connect callbacks", func() bool {
+			var n int64
+			for _, st := range broker.shard.stats {
+				n += st.connects.Load()
+			}
+			return n >= int64(fl.connections())
+		})
+		srv.Close()
+		scheduler.Stop()
+		pool.Release()
+		for _, c := range fl.clients() {
+			c.Disconnect(0)
+		}
+	})
+	return s, srv
+}
+
+// 发送请求，返回状态码和响应体
+func call(t *testing.T, srv *httptest.Server, method, path, body string) (int, []byte) {
+	t.Helper()
+	req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, data
+}
+
+func callJSON[T any](t *testing.T, srv *httptest.Server, method, path, body string, want int) T {
+	t.Helper()
+	code, data := call(t, srv, method, path, body)
+	if code != want {
+		t.Fatalf("%s %s: %d %s, want %d", method, path, code, data, want)
+	}
+	var v T
+	if err := json.Unmarshal(data, &v); err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	return v
+}
+
+func TestControlDevices(t *testing.T) {
+	s, srv := startControl(t, topologyOptions{mode: topologySeparate}, 2)
+
+	if views := callJSON[[]deviceView](t, srv, "GET", "/devices", "", 200); len(views) != 2 || views[1].Mac != "CTL-1" || !views[1].Connected {
+		t.Fatalf("unexpected devices %+v", views)
+	}
+	if code, _ := call(t, srv, "GET", "/devices/NOPE", ""); code != 404 {
+		t.Fatalf("unknown device: %d", code)
+	}
+
+	added := callJSON[[]deviceView](t, srv, "POST", "/devices", `{"count": 2, "profile": "single"}`, 201)
+	if len(added) != 2 || added[0].Mac != "CTL-2" || added[1].Mac != "CTL-3" || added[1].Profile != "single" || !added[1].Connected {
+		t.Fatalf("unexpected added devices %+v", added)
+	}
+	for _, body := range []string{`{"mac": "CTL-0"}`, `{"count": 1001}`, `{"mac": "X", "count": 2}`, `{"profile": "coupel"}`, `{"mac": "a/b"}`, `{"bogus": 1}`} {
+		if code, data := call(t, srv, "POST", "/devices", body); code != 400 {
+			t.Errorf("add %s: %d %s, want 400", body, code, data)
+		}
+	}
+
+	name := generators[0].name
+	if v := callJSON[deviceView](t, srv, "POST", "/devices/CTL-0/pause", `{"types": ["`+name+`"]}`, 200); len(v.Paused) != 1 || v.Paused[0] != name {
+		t.Fatalf("paused %v", v.Paused)
+	}
+	if v := callJSON[deviceView](t, srv, "POST", "/devices/CTL-0/pause", "", 200); len(v.Paused) != 1 || v.Paused[0] != "*" {
+		t.Fatalf("paused %v", v.Paused)
+	}
+	if v := callJSON[deviceView](t, srv, "POST", "/devices/CTL-0/resume", "", 200); v.Paused != nil {
+		t.Fatalf("paused %v after resume", v.Paused)
+	}
+	if code, _ := call(t, srv, "POST", "/devices/CTL-0/pause", `{"types": ["nope"]}`); code != 400 {
+		t.Fatalf("pause unknown type: %d", code)
+	}
+
+	if v := callJSON[deviceView](t, srv, "POST", "/devices/CTL-1/events", `{"type": "bedExit", "side": "left"}`, 200); len(v.Absent) != 1 || v.Absent[0] != "left" {
+		t.Fatalf("absent %v", v.Absent)
+	}
+	if msgs := callJSON[[]messageView](t, srv, "POST", "/devices/CTL-1/events", `{"type": "fault", "code": 3}`, 200); len(msgs) != 1 || msgs[0].Type != "error_code" || msgs[0].Error != "" {
+		t.Fatalf("fault messages %+v", msgs)
+	}
+	if msgs := callJSON[[]messageView](t, srv, "GET", "/devices/CTL-1/messages", "", 200); len(msgs) != 1 || msgs[0].Type != "error_code" {
+		t.Fatalf("recent messages %+v", msgs)
+	}
+	for _, body := range []string{`{"type": "nope"}`, `{"type": "posture", "side": "middle"}`, `{"type": "fault", "code": 0}`, `{"type": "reboot", "downtime": "x"}`} {
+		if code, data := call(t, srv, "POST", "/devices/CTL-1/events", body); code != 400 {
+			t.Errorf("event %s: %d %s, want 400", body, code, data)
+		}
+	}
+
+	b := s.fleet.get("CTL-3")
+	if code, _ := call(t, srv, "DELETE", "/devices/CTL-3", ""); code != 204 {
+		t.Fatalf("remove: %d", code)
+	}
+	if b.client.IsConnected() || b.otaClient.IsConnected() || !b.removed.Load() {
+		t.Fatal("removed device is still connected")
+	}
+	if code, _ := call(t, srv, "GET", "/devices/CTL-3", ""); code != 404 {
+		t.Fatalf("removed device: %d", code)
+	}
+	if views := callJSON[[]deviceView](t, srv, "GET", "/devices", "", 200); len(views) != 3 {
+		t.Fatalf("%d devices after remove", len(views))
+	}
+}
+
+func TestControlGenerators(t *testing.T) {
+	_, srv := startControl(t, topologyOptions{mode: topologyShared}, 1)
+	g := generators[0]
+	defer g.ctl.interval.Store(int64(g.interval))
+	defer g.ctl.paused.Store(false)
+
+	if views := callJSON[[]generatorView](t, srv, "GET", "/generators", "", 200); len(views) != len(generators) {
+		t.Fatalf("%d generators", len(views))
+	}
+	if v := callJSON[generatorView](t, srv, "PATCH", "/generators/"+g.name, `{"interval": "1h"}`, 200); v.Interval != "1h0m0s" || g.period() != time.Hour {
+		t.Fatalf("interval %s", v.Interval)
+	}
+	if code, _ := call(t, srv, "PATCH", "/generators/"+g.name, `{"interval": "1ms"}`); code != 400 {
+		t.Fatalf("short interval: %d", code)
+	}
+	if code, _ := call(t, srv, "PATCH", "/generators/nope", `{"interval": "1s"}`); code != 404 {
+		t.Fatalf("unknown generator: %d", code)
+	}
+	if v := callJSON[generatorView](t, srv, "POST", "/generators/"+g.name+"/pause", "", 200); !v.Paused {
+		t.Fatal("generator not paused")
+	}
+}
+
+// mux 拓扑的连接在组里最后一张床移除后才断开
+func TestControlRemoveMux(t *testing.T) {
+	s, srv := startControl(t, topologyOptions{mode: topologyMux, muxBeds: 2}, 2)
+	client := s.fleet.get("CTL-0").client
+	if code, _ := call(t, srv, "POST", "/devices", `{"count": 1}`); code != 409 {
+		t.Fatalf("mux add: %d", code)
+	}
+	call(t, srv, "DELETE", "/devices/CTL-0", "")
+	if !client.IsConnected() {
+		t.Fatal("shared connection closed while a bed still uses it")
+	}
+	call(t, srv, "DELETE", "/devices/CTL-1", "")
+	if client.IsConnected() {
+		t.Fatal("shared connection still open after its last bed was removed")
+	}
+}
+
+// /watch 只推送指定设备和种类的消息
+func TestWatchFilter(t *testing.T) {
+	_, srv := startControl(t, topologyOptions{mode: topologyShared}, 2)
+	if code, _ := call(t, srv, "GET", "/watch?kind=nope", ""); code != 400 {
+		t.Fatalf("unknown kind: %d", code)
+	}
+
+	resp, err := http.Get(srv.URL + "/watch?mac=CTL-1&kind=publish")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("content type %s", ct)
+	}
+	waitFor(t, "watcher", traffic.active)
+	events := make(chan trafficEvent)
+	go func() {
+		sc := bufio.NewScanner(resp.Body)
+		for sc.Scan() {
+			if data, ok := strings.CutPrefix(sc.Text(), "data: "); ok {
+				var ev trafficEvent
+				json.Unmarshal([]byte(data), &ev)
+				events <- ev
+			}
+		}
+		close(events)
+	}()
+
+	// 第一条是其他设备的，不应该推送
+	call(t, srv, "POST", "/devices/CTL-0/events", `{"type": "fault"}`)
+	call(t, srv, "POST", "/devices/CTL-1/events", `{"type": "fault", "code": 7}`)
+	select {
+	case ev := <-events:
+		if ev.Mac != "CTL-1" || ev.Kind != kindPublish || ev.Type != "error_code" {
+			t.Fatalf("unexpected event %+v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event")
+	}
+}
@@ -0,0 +1,643 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+
+	"mock-bed/pkg/mqttclient"
+)
+
+// 分布式运行：协调者把设备列表分给多个工作进程，同步开始时间，汇总指标和报告。
+// 协调者和工作进程之间用 HTTP + JSON 通信，指标按 Prometheus 的 protobuf 格式推送
+
+// 协调者提供的接口
+const (
+	pathRegister = "/register" // 工作进程注册，所有工作进程到齐后返回分配的任务
+	pathReady    = "/ready"    // 床都已连接，所有工作进程就绪后返回开始时间
+	pathPush     = "/push"     // 每秒推送一次指标，返回是否需要停止
+	pathReport   = "/report"   // 运行结束后上传报告
+)
+
+// 开始后超过这么久没有推送指标的工作进程视为已退出
+const workerLostAfter = 10 * time.Second
+
+// 只在本进程生效、不下发给工作进程的参数
+var localFlags = map[string]bool{
+	"coordinator":  true,
+	"workers":      true,
+	"startDelay":   true,
+	"readyTimeout": true,
+	"worker":       true,
+	"report":       true,
+	"metricsAddr":  true,
+	"controlAddr":  true,
+}
+
+// coordinatorOptions 分布式运行的参数，addr 和 url 都为空时单进程运行
+type coordinatorOptions struct {
+	addr    string // 以协调者运行时监听的地址
+	workers int
+	delay   time.Duration
+	ready   time.Duration // 所有工作进程注册后等待它们就绪的最长时间
+	url     string        // 以工作进程运行时协调者的地址
+}
+
+func (o *coordinatorOptions) validate() error {
+	if o.addr != "" && o.url != "" {
+		return fmt.Errorf("-coordinator and -worker can't be combined")
+	}
+	if o.addr != "" && o.workers < 1 {
+		return fmt.Errorf("-workers must be at least 1")
+	}
+	if o.delay < 0 {
+		return fmt.Errorf("-startDelay can't be negative")
+	}
+	if o.addr != "" && o.ready <= 0 {
+		return fmt.Errorf("-readyTimeout must be positive")
+	}
+	return nil
+}
+
+// registration 工作进程注册时的信息
+type registration struct {
+	Host string `json:"host"`
+}
+
+// assignment 协调者分配给一个工作进程的任务
+type assignment struct {
+	ID     int      `json:"id"`
+	Offset int      `json:"offset"` // 在完整设备列表中的位置
+	Count  int      `json:"count"`
+	Total  int      `json:"total"` // 完整设备列表的床数
+	Args   []string `json:"args"`  // 协调者修改过的参数，-name=value 形式
+}
+
+type startReply struct {
+	StartAt time.Time `json:"startAt"`
+}
+
+type pushReply struct {
+	Stop bool `json:"stop"`
+}
+
+// workerState 协调者记录的一个工作进程
+type workerState struct {
+	host     string
+	offset   int
+	count    int
+	ready    bool
+	lastSeen time.Time
+	families []*dto.MetricFamily // 最近一次推送的指标，已加上 worker 标签
+	report   *runReport
+}
+
+type coordinator struct {
+	opts  coordinatorOptions
+	args  []string
+	total int
+
+	mu         sync.Mutex
+	nodes      []*workerState
+	registered chan struct{} // 所有工作进程注册后关闭
+	ready      chan struct{} // 所有工作进程就绪后关闭
+	joinedAt   time.Time     // 所有工作进程注册的时间
+	startAt    time.Time
+	stop       bool
+}
+
+func newCoordinator(o coordinatorOptions, total int) *coordinator {
+	return &coordinator{
+		opts:       o,
+		args:       sharedArgs(),
+		total:      total,
+		registered: make(chan struct{}),
+		ready:      make(chan struct{}),
+	}
+}
+
+// 修改过的参数中下发给工作进程的部分，可重复的参数按项展开
+func sharedArgs() []string {
+	var args []string
+	flag.Visit(func(f *flag.Flag) {
+		if localFlags[f.Name] {
+			return
+		}
+		if p, ok := f.Value.(*mqttclient.Properties); ok {
+			keys := make([]string, 0, len(*p))
+			for k := range *p {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				args = append(args, fmt.Sprintf("-%s=%s=%s", f.Name, k, (*p)[k]))
+			}
+			return
+		}
+		args = append(args, fmt.Sprintf("-%s=%s", f.Name, f.Value.String()))
+	})
+	return args
+}
+
+func (c *coordinator) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST "+pathRegister, c.register)
+	mux.HandleFunc("POST "+pathReady, c.markReady)
+	mux.HandleFunc("POST "+pathPush, c.push)
+	mux.HandleFunc("POST "+pathReport, c.upload)
+	return mux
+}
+
+func (c *coordinator) register(w http.ResponseWriter, r *http.Request) {
+	var reg registration
+	if err := json.NewDecoder(r.Body).Decode(&reg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	if len(c.nodes) >= c.opts.workers || c.stop {
+		c.mu.Unlock()
+		http.Error(w, "all workers have already joined", http.StatusConflict)
+		return
+	}
+	n := &workerState{host: reg.Host, lastSeen: time.Now()}
+	c.nodes = append(c.nodes, n)
+	joined := len(c.nodes)
+	if joined == c.opts.workers {
+		// 到齐后才按注册顺序分配床，中途离开的工作进程不占位置
+		for id, o := range c.nodes {
+			o.offset = c.total * id / c.opts.workers
+			o.count = c.total*(id+1)/c.opts.workers - o.offset
+		}
+		c.joinedAt = time.Now()
+		close(c.registered)
+	}
+	c.mu.Unlock()
+	line := fmt.Sprintf("worker joined from %s (%d/%d)", reg.Host, joined, c.opts.workers)
+	fmt.Println(line)
+	log.Println(line)
+
+	// 到齐后才返回，避免先到的工作进程提前开始
+	select {
+	case <-c.registered:
+	case <-r.Context().Done():
+		c.leave(n)
+		return
+	}
+	c.mu.Lock()
+	id := slices.Index(c.nodes, n)
+	c.mu.Unlock()
+	line = fmt.Sprintf("worker %d is %s, beds %d-%d", id, reg.Host, n.offset, n.offset+n.count)
+	fmt.Println(line)
+	log.Println(line)
+	writeJSON(w, assignment{ID: id, Offset: n.offset, Count: n.count, Total: c.total, Args: c.args})
+}
+
+// 注册请求在到齐前断开（工作进程退出或超时），释放它的位置
+func (c *coordinator) leave(n *workerState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.registered:
+		// 已经分配，之后按就绪超时处理
+		return
+	default:
+	}
+	if i := slices.Index(c.nodes, n); i >= 0 {
+		c.nodes = slices.Delete(c.nodes, i, i+1)
+		line := fmt.Sprintf("worker from %s left before all workers joined", n.host)
+		fmt.Println(line)
+		log.Println(line)
+	}
+}
+
+func (c *coordinator) markReady(w http.ResponseWriter, r *http.Request) {
+	_, n := c.node(w, r)
+	if n == nil {
+		return
+	}
+	c.mu.Lock()
+	if !n.ready {
+		n.ready = true
+		all := true
+		for _, o := range c.nodes {
+			all = all && o.ready
+		}
+		if all && len(c.nodes) == c.opts.workers {
+			c.startAt = time.Now().Add(c.opts.delay)
+			close(c.ready)
+			line := fmt.Sprintf("all %d workers connected, start at %s", len(c.nodes), c.startAt.Format(time.RFC3339Nano))
+			fmt.Println(line)
+			log.Println(line)
+		}
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-c.ready:
+	case <-r.Context().Done():
+		// 工作进程在开始前退出，不再算作就绪，等待超时
+		c.mu.Lock()
+		select {
+		case <-c.ready:
+		default:
+			n.ready = false
+		}
+		c.mu.Unlock()
+		return
+	}
+	c.mu.Lock()
+	startAt := c.startAt
+	c.mu.Unlock()
+	writeJSON(w, startReply{StartAt: startAt})
+}
+
+func (c *coordinator) push(w http.ResponseWriter, r *http.Request) {
+	id, n := c.node(w, r)
+	if n == nil {
+		return
+	}
+	families, err := decodeFamilies(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	name, value := "worker", strconv.Itoa(id)
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			m.Label = append(m.Label, &dto.LabelPair{Name: &name, Value: &value})
+		}
+	}
+	c.mu.Lock()
+	n.families = families
+	stop := c.stop
+	c.mu.Unlock()
+	writeJSON(w, pushReply{Stop: stop})
+}
+
+func (c *coordinator) upload(w http.ResponseWriter, r *http.Request) {
+	id, n := c.node(w, r)
+	if n == nil {
+		return
+	}
+	var rep runReport
+	if err := json.NewDecoder(r.Body).Decode(&rep); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	n.report = &rep
+	c.mu.Unlock()
+	line := fmt.Sprintf("worker %d finished, published=%d,errors=%d", id, rep.Totals.Published, rep.Totals.Errors)
+	fmt.Println(line)
+	log.Println(line)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// 按 ?id= 找到工作进程并更新最后通信时间，找不到时返回 404
+func (c *coordinator) node(w http.ResponseWriter, r *http.Request) (int, *workerState) {
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil || id < 0 || id >= len(c.nodes) {
+		http.Error(w, "unknown worker", http.StatusNotFound)
+		return 0, nil
+	}
+	n := c.nodes[id]
+	n.lastSeen = time.Now()
+	return id, n
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
+
+func decodeFamilies(r io.Reader) ([]*dto.MetricFamily, error) {
+	dec := expfmt.NewDecoder(r, expfmt.NewFormat(expfmt.TypeProtoDelim))
+	var families []*dto.MetricFamily
+	for {
+		f := new(dto.MetricFamily)
+		if err := dec.Decode(f); err != nil {
+			if errors.Is(err, io.EOF) {
+				return families, nil
+			}
+			return nil, err
+		}
+		families = append(families, f)
+	}
+}
+
+// 合并所有工作进程最近一次推送的指标，同名指标放在一起，用 worker 标签区分
+func (c *coordinator) gather() ([]*dto.MetricFamily, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	merged := make(map[string]*dto.MetricFamily)
+	for _, n := range c.nodes {
+		for _, f := range n.families {
+			m, ok := merged[f.GetName()]
+			if !ok {
+				m = &dto.MetricFamily{Name: f.Name, Help: f.Help, Type: f.Type}
+				merged[f.GetName()] = m
+			}
+			m.Metric = append(m.Metric, f.GetMetric()...)
+		}
+	}
+	families := make([]*dto.MetricFamily, 0, len(merged))
+	for _, f := range merged {
+		families = append(families, f)
+	}
+	sort.Slice(families, func(i, j int) bool { return families[i].GetName() < families[j].GetName() })
+	return families, nil
+}
+
+// 指标所有序列的和
+func sumMetric(families []*dto.MetricFamily, name string) float64 {
+	var v float64
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			v += m.GetCounter().GetValue() + m.GetGauge().GetValue() + m.GetUntyped().GetValue()
+		}
+	}
+	return v
+}
+
+func (c *coordinator) families() []*dto.MetricFamily {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var families []*dto.MetricFamily
+	for _, n := range c.nodes {
+		families = append(families, n.families...)
+	}
+	return families
+}
+
+func (c *coordinator) started() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.startAt.IsZero() && time.Now().After(c.startAt)
+}
+
+// 所有工作进程注册后超过 -readyTimeout 仍未全部就绪时，返回未就绪的工作进程
+func (c *coordinator) notReady() []int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.joinedAt.IsZero() || !c.startAt.IsZero() || time.Since(c.joinedAt) < c.opts.ready {
+		return nil
+	}
+	var ids []int
+	for id, n := range c.nodes {
+		if !n.ready {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// 所有工作进程都已上传报告或失去联系
+func (c *coordinator) finished() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.startAt.IsZero() {
+		return false
+	}
+	for _, n := range c.nodes {
+		seen := n.lastSeen
+		if c.startAt.After(seen) {
+			seen = c.startAt
+		}
+		if n.report == nil && time.Since(seen) < workerLostAfter {
+			return false
+		}
+	}
+	return true
+}
+
+// 所有工作进程的汇总，每秒输出一次；last 为上一次的累计条数
+func (c *coordinator) status(last *float64) string {
+	families := c.families()
+	c.mu.Lock()
+	online := 0
+	for _, n := range c.nodes {
+		if n.report == nil && time.Since(n.lastSeen) < workerLostAfter {
+			online++
+		}
+	}
+	c.mu.Unlock()
+	published := sumMetric(families, "mock_bed_published_total")
+	line := fmt.Sprintf("workers=%d/%d,connected=%.0f,published=%.0f,rate=%.0f/s,errors=%.0f,dropped=%.0f,",
+		online, c.opts.workers, sumMetric(families, "mock_bed_connected"), published, published-*last,
+		sumMetric(families, "mock_bed_publish_errors_total"), sumMetric(families, "mock_bed_dropped_total"))
+	*last = published
+	return line
+}
+
+// 以协调者运行，直到所有工作进程结束；ctx 结束时通知工作进程停止
+func runCoordinator(ctx context.Context, o coordinatorOptions, total int, reportPath, metricsAddr string) {
+	c := newCoordinator(o, total)
+	srv := &http.Server{Addr: o.addr, Handler: c.handler()}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fmt.Println("coordinator error:", err)
+			os.Exit(1)
+		}
+	}()
+	if metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.HandlerFor(prometheus.GathererFunc(c.gather), promhttp.HandlerOpts{}))
+		go func() {
+			if err := http.ListenAndServe(metricsAddr, mux); err != nil {
+				fmt.Println("metrics server error:", err)
+				log.Println(err)
+			}
+		}()
+		fmt.Println("metrics on http://" + metricsAddr + "/metrics")
+	}
+	fmt.Println(fmt.Sprintf("coordinator on http://%s, waiting for %d workers to share %d beds", o.addr, o.workers, total))
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var last float64
+	stopping := ctx.Done()
+	for !c.finished() {
+		select {
+		case <-stopping:
+			stopping = nil
+			c.mu.Lock()
+			c.stop = true
+			waiting := c.startAt.IsZero()
+			c.mu.Unlock()
+			if waiting {
+				// 还没有开始，等待中的工作进程会因为连接断开而退出
+				srv.Close()
+				return
+			}
+			fmt.Println("stopping workers...")
+		case <-ticker.C:
+			if c.started() {
+				fmt.Println(c.status(&last))
+			}
+			if ids := c.notReady(); len(ids) > 0 {
+				// 等待中的工作进程会因为连接断开而退出
+				srv.Close()
+				fmt.Println(fmt.Sprintf("coordinator error: workers %v not ready within %s", ids, o.ready))
+				os.Exit(1)
+			}
+		}
+	}
+
+	r := c.buildReport()
+	t := r.Totals
+	line := fmt.Sprintf("summary: duration=%s,workers=%d,beds=%d,published=%d,bytes=%d,errors=%d,dropped=%d,late=%d,reconnects=%d",
+		time.Duration(r.Duration*float64(time.Second)).Round(time.Millisecond), len(r.Workers), r.Fleet.Beds, t.Published, t.Bytes, t.Errors, t.Dropped, t.Late, t.Reconnects)
+	fmt.Println(line)
+	log.Println(line)
+	for _, w := range r.Workers {
+		if !w.Reported {
+			line := fmt.Sprintf("warning: worker %d (%s) was lost, its totals come from its last metrics push", w.ID, w.Host)
+			fmt.Println(line)
+			log.Println(line)
+		}
+	}
+	if reportPath != "" {
+		if err := r.write(reportPath); err != nil {
+			fmt.Println("report error:", err)
+		}
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv.Shutdown(shutdownCtx)
+}
+
+// 合并所有工作进程的报告，消息类型和命令的统计由合并后的指标重新计算
+func (c *coordinator) buildReport() *runReport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r := &runReport{}
+	r.addConfig()
+	var families []*dto.MetricFamily
+	var brokers []*brokerReport
+	timeline := make(map[int]*sample)
+	for id, n := range c.nodes {
+		families = append(families, n.families...)
+		r.Fleet.Beds += n.count
+		wr := workerReport{ID: id, Host: n.host, Beds: n.count, Reported: n.report != nil}
+		rep := n.report
+		if rep == nil {
+			// 没有报告时只能用最后一次推送的指标
+			wr.Published = int64(sumMetric(n.families, "mock_bed_published_total"))
+			wr.Errors = int64(sumMetric(n.families, "mock_bed_publish_errors_total"))
+			r.Workers = append(r.Workers, wr)
+			continue
+		}
+		wr.Published, wr.Errors, wr.MsgRate = rep.Totals.Published, rep.Totals.Errors, rep.Totals.MsgRate
+		r.Workers = append(r.Workers, wr)
+
+		if r.Start.IsZero() || rep.Start.Before(r.Start) {
+			r.Start = rep.Start
+		}
+		if rep.End.After(r.End) {
+			r.End = rep.End
+		}
+		if r.Fleet.Topology == "" {
+			beds := r.Fleet.Beds
+			r.Fleet = rep.Fleet
+			r.Fleet.Beds, r.Fleet.Connections = beds, 0
+		}
+		r.Fleet.Connections += rep.Fleet.Connections
+
+		t := &r.Totals
+		t.Published += rep.Totals.Published
+		t.Bytes += rep.Totals.Bytes
+		t.Errors += rep.Totals.Errors
+		t.Dropped += rep.Totals.Dropped
+		t.Coalesced += rep.Totals.Coalesced
+		t.Late += rep.Totals.Late
+		t.Reconnects += rep.Totals.Reconnects
+
+		for _, b := range rep.Brokers {
+			i := slices.IndexFunc(brokers, func(br *brokerReport) bool { return br.URL == b.URL })
+			if i < 0 {
+				brokers = append(brokers, &brokerReport{URL: b.URL})
+				i = len(brokers) - 1
+			}
+			brokers[i].Connects += b.Connects
+			brokers[i].Published += b.Published
+			brokers[i].Errors += b.Errors
+		}
+		if rep.Churn != nil {
+			if r.Churn == nil {
+				r.Churn = &churnReport{}
+			}
+			r.Churn.Offline += rep.Churn.Offline
+			r.Churn.Online += rep.Churn.Online
+			r.Churn.ReconnectErrors += rep.Churn.ReconnectErrors
+		}
+		if rep.Rate != nil {
+			if r.Rate == nil {
+				r.Rate = &rateSummary{Unit: rep.Rate.Unit, OnTarget: rep.Rate.OnTarget, Seconds: rep.Rate.Seconds}
+			}
+			r.Rate.Target += rep.Rate.Target
+			r.Rate.Achieved += rep.Rate.Achieved
+			// 每个工作进程只知道自己是否达标，取最少的秒数
+			r.Rate.OnTarget = min(r.Rate.OnTarget, rep.Rate.OnTarget)
+			r.Rate.Seconds = min(r.Rate.Seconds, rep.Rate.Seconds)
+		}
+		// 各工作进程同时开始，按开始后的秒数相加
+		for _, s := range rep.Timeline {
+			m, ok := timeline[s.Second]
+			if !ok {
+				m = &sample{Second: s.Second}
+				timeline[s.Second] = m
+			}
+			m.Published += s.Published
+			m.Bytes += s.Bytes
+			m.Errors += s.Errors
+			m.Connected += s.Connected
+			m.Waiting += s.Waiting
+		}
+	}
+	if r.Start.IsZero() {
+		r.Start = c.startAt
+	}
+	if r.End.IsZero() {
+		r.End = time.Now()
+	}
+	r.Duration = r.End.Sub(r.Start).Seconds()
+	if r.Duration > 0 {
+		r.Totals.MsgRate = float64(r.Totals.Published) / r.Duration
+		r.Totals.ByteRate = float64(r.Totals.Bytes) / r.Duration
+	}
+	r.addMetrics(families)
+	if len(brokers) > 1 {
+		for _, b := range brokers {
+			r.Brokers = append(r.Brokers, *b)
+		}
+	}
+	for _, s := range timeline {
+		r.Timeline = append(r.Timeline, *s)
+	}
+	sort.Slice(r.Timeline, func(i, j int) bool { return r.Timeline[i].Second < r.Timeline[j].Second })
+	return r
+}
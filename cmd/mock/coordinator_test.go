@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+func testCoordinator(workers int, ready time.Duration) (*coordinator, *httptest.Server) {
+	c := newCoordinator(coordinatorOptions{workers: workers, ready: ready}, 10)
+	c.args = nil
+	return c, httptest.NewServer(c.handler())
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func (c *coordinator) joined() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.nodes)
+}
+
+// 一个 type=status 的 mock_bed_published_total 计数器
+func publishedFamily(v float64) []byte {
+	name, typ, label, value := "mock_bed_published_total", dto.MetricType_COUNTER, "type", "status"
+	f := &dto.MetricFamily{Name: &name, Type: &typ, Metric: []*dto.Metric{{
+		Label:   []*dto.LabelPair{{Name: &label, Value: &value}},
+		Counter: &dto.Counter{Value: &v},
+	}}}
+	var buf bytes.Buffer
+	expfmt.NewEncoder(&buf, expfmt.NewFormat(expfmt.TypeProtoDelim)).Encode(f)
+	return buf.Bytes()
+}
+
+func TestCoordinatorRun(t *testing.T) {
+	c, srv := testCoordinator(2, time.Minute)
+	defer srv.Close()
+	body, _ := json.Marshal(registration{Host: "gone"})
+
+	// 到齐前断开的注册释放位置
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		w := &workerClient{url: srv.URL}
+		done <- w.post(ctx, pathRegister, "application/json", bytes.NewReader(body), &w.a)
+	}()
+	waitFor(t, "first registration", func() bool { return c.joined() == 1 })
+	cancel()
+	<-done
+	waitFor(t, "slot to be freed", func() bool { return c.joined() == 0 })
+
+	var wg sync.WaitGroup
+	assigned := make([]assignment, 2)
+	for i := range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := &workerClient{url: srv.URL}
+			body, _ := json.Marshal(registration{Host: "worker"})
+			if err := w.post(context.Background(), pathRegister, "application/json", bytes.NewReader(body), &w.a); err != nil {
+				t.Error(err)
+				return
+			}
+			assigned[i] = w.a
+			var start startReply
+			if err := w.post(context.Background(), pathReady, "application/json", nil, &start); err != nil || start.StartAt.IsZero() {
+				t.Error("ready:", err)
+				return
+			}
+			var reply pushReply
+			if err := w.post(context.Background(), pathPush, string(expfmt.NewFormat(expfmt.TypeProtoDelim)),
+				bytes.NewReader(publishedFamily(float64(100*(w.a.ID+1)))), &reply); err != nil || reply.Stop {
+				t.Error("push:", err, reply.Stop)
+				return
+			}
+			rep, _ := json.Marshal(runReport{Start: start.StartAt, End: start.StartAt.Add(time.Second),
+				Totals: totalsReport{Published: int64(100 * (w.a.ID + 1))}})
+			if err := w.post(context.Background(), pathReport, "application/json", bytes.NewReader(rep), nil); err != nil {
+				t.Error("report:", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+	if a, b := assigned[0], assigned[1]; a.ID == b.ID || a.Count+b.Count != 10 || a.Total != 10 {
+		t.Fatalf("unexpected assignments %+v %+v", a, b)
+	}
+	if !c.finished() {
+		t.Fatal("coordinator should be finished after both reports")
+	}
+
+	r := c.buildReport()
+	if r.Fleet.Beds != 10 || len(r.Workers) != 2 || !r.Workers[0].Reported || !r.Workers[1].Reported {
+		t.Fatalf("unexpected workers %+v fleet %+v", r.Workers, r.Fleet)
+	}
+	if r.Totals.Published != 300 {
+		t.Fatalf("published = %d, want 300", r.Totals.Published)
+	}
+	if len(r.Types) != 1 || r.Types[0].Type != "status" || r.Types[0].Published != 300 {
+		t.Fatalf("unexpected types %+v", r.Types)
+	}
+}
+
+// 工作进程在就绪前退出时，超时后报告未就绪的工作进程
+func TestCoordinatorReadyTimeout(t *testing.T) {
+	c, srv := testCoordinator(2, time.Hour)
+	defer srv.Close()
+	ids := make(chan int, 2)
+	for range 2 {
+		go func() {
+			w := &workerClient{url: srv.URL}
+			body, _ := json.Marshal(registration{Host: "worker"})
+			if err := w.post(context.Background(), pathRegister, "application/json", bytes.NewReader(body), &w.a); err != nil {
+				t.Error(err)
+			}
+			ids <- w.a.ID
+		}()
+	}
+	first, second := <-ids, <-ids
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		w := &workerClient{url: srv.URL, a: assignment{ID: first}}
+		w.post(ctx, pathReady, "application/json", nil, nil)
+	}()
+	waitFor(t, "first worker to be ready", func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.nodes[first].ready
+	})
+	if ids := c.notReady(); ids != nil {
+		t.Fatalf("timed out too early: %v", ids)
+	}
+	// 就绪的工作进程也退出了，超时后两个都要报告
+	cancel()
+	c.mu.Lock()
+	c.opts.ready = 0
+	c.mu.Unlock()
+	waitFor(t, "ready timeout", func() bool { return len(c.notReady()) == 2 })
+	if ids := c.notReady(); ids[0] != min(first, second) || ids[1] != max(first, second) {
+		t.Fatalf("not ready = %v", ids)
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"mock-bed/pkg/identity"
+)
+
+// 仪表盘：控制接口的 / 提供一个页面，通过两个 SSE 事件流实时更新，注入事件的按钮调用控制接口
+//
+//	GET /                       页面
+//	GET /dashboard/fleet        每秒一次：每张床的连接状态、按消息类型的速率、最近的错误
+//	GET /dashboard/beds/{mac}   每 500ms 一次：一张床当前的模拟状态，在床、睡姿、体征和压力垫热力图
+
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+// 最近的错误保留的条数
+const errorLogSize = 50
+
+// errorLogger 最近的发布、加密和重连错误
+type errorLogger struct {
+	mu   sync.Mutex
+	errs []errorView
+	n    int64 // 写入的总条数
+}
+
+// 最近的错误，仪表盘显示
+var errorLog errorLogger
+
+type errorView struct {
+	Time  time.Time `json:"time"`
+	Mac   string    `json:"mac"`
+	Type  string    `json:"type"`
+	Error string    `json:"error"`
+}
+
+func (l *errorLogger) add(mac, name string, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.errs == nil {
+		l.errs = make([]errorView, errorLogSize)
+	}
+	l.errs[l.n%errorLogSize] = errorView{Time: time.Now(), Mac: mac, Type: name, Error: err.Error()}
+	l.n++
+}
+
+// 从新到旧
+func (l *errorLogger) list() []errorView {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	views := make([]errorView, 0, min(l.n, errorLogSize))
+	for i := l.n - 1; i >= 0 && i >= l.n-errorLogSize; i-- {
+		views = append(views, l.errs[i%errorLogSize])
+	}
+	return views
+}
+
+// fleetView 仪表盘每秒推送的整体状态
+type fleetView struct {
+	Time      time.Time          `json:"time"`
+	Uptime    string             `json:"uptime"`
+	Beds      []bedStatus        `json:"beds"`
+	Rates     map[string]float64 `json:"rates"` // 消息类型 -> 条/秒
+	Rate      float64            `json:"rate"`  // 条/秒
+	ByteRate  float64            `json:"byteRate"`
+	Published int64              `json:"published"`
+	Errors    int64              `json:"errors"`
+	Dropped   int64              `json:"dropped"`
+	Recent    []errorView        `json:"recentErrors"`
+}
+
+// bedStatus 一张床的连接状态：online、offline，或 reconnecting（在线但客户端正在自动重连）
+type bedStatus struct {
+	Mac    string `json:"mac"`
+	Status string `json:"status"`
+}
+
+// bedStateView 一张床当前的模拟状态，由最近发布的帧得出
+type bedStateView struct {
+	Mac     string    `json:"mac"`
+	Model   string    `json:"model"`
+	Profile string    `json:"profile"`
+	Status  string    `json:"status"`
+	Paused  []string  `json:"paused,omitempty"`
+	Left    sideState `json:"left"`
+	Right   sideState `json:"right"`
+}
+
+// sideState 一侧的状态，还没有收到对应的帧时为空
+type sideState struct {
+	Occupied bool  `json:"occupied"`
+	Absent   bool  `json:"absent"` // 有人但已离床
+	Posture  *int  `json:"posture,omitempty"`
+	HR       *int  `json:"hr,omitempty"`
+	HRV      *int  `json:"hrv,omitempty"`
+	BR       *int  `json:"br,omitempty"`
+	Pressure []int `json:"pressure,omitempty"` // 32x32，按行排列
+}
+
+func (b *bed) status() string {
+	switch {
+	case !b.online.Load():
+		return "offline"
+	case !b.client.IsConnected():
+		return "reconnecting"
+	}
+	return "online"
+}
+
+func (s *controlServer) dashboard(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(dashboardHTML)
+}
+
+// 开始 SSE 响应，不支持时返回 nil
+func startEvents(w http.ResponseWriter) http.Flusher {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return nil
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	return flusher
+}
+
+func writeEvent(w http.ResponseWriter, flusher http.Flusher, v any) {
+	data, _ := json.Marshal(v)
+	fmt.Fprintf(w, "data: %s\n\n", data)
+	flusher.Flush()
+}
+
+func (s *controlServer) fleetEvents(w http.ResponseWriter, r *http.Request) {
+	flusher := startEvents(w)
+	if flusher == nil {
+		return
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	last := make(map[string]int64, len(runStats.published))
+	var lastBytes int64
+	lastAt := time.Now()
+	// 第一次推送没有上一次的值，速率按 0
+	for first := true; ; first = false {
+		now := time.Now()
+		elapsed := now.Sub(lastAt).Seconds()
+		v := fleetView{
+			Time:    now,
+			Uptime:  now.Sub(runStats.start).Round(time.Second).String(),
+			Rates:   make(map[string]float64, len(runStats.published)),
+			Errors:  runStats.errors.Load(),
+			Dropped: runStats.dropped.Load(),
+			Recent:  errorLog.list(),
+		}
+		for name, n := range runStats.published {
+			count := n.Load()
+			v.Published += count
+			if !first && elapsed > 0 {
+				v.Rates[name] = float64(count-last[name]) / elapsed
+				v.Rate += v.Rates[name]
+			}
+			last[name] = count
+		}
+		bytes := runStats.bytes.Load()
+		if !first && elapsed > 0 {
+			v.ByteRate = float64(bytes-lastBytes) / elapsed
+		}
+		lastBytes, lastAt = bytes, now
+		beds := s.fleet.list()
+		v.Beds = make([]bedStatus, 0, len(beds))
+		for _, b := range beds {
+			v.Beds = append(v.Beds, bedStatus{Mac: b.Mac, Status: b.status()})
+		}
+		sort.Slice(v.Beds, func(i, j int) bool { return v.Beds[i].Mac < v.Beds[j].Mac })
+		writeEvent(w, flusher, v)
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// 订阅这张床发布的完整帧，解析出当前状态，每 500ms 推送一次
+func (s *controlServer) bedEvents(w http.ResponseWriter, r *http.Request) {
+	b := s.bed(w, r)
+	if b == nil {
+		return
+	}
+	flusher := startEvents(w)
+	if flusher == nil {
+		return
+	}
+	sub := traffic.subscribe([]string{b.Mac}, []string{kindPublish}, true)
+	defer traffic.unsubscribe(sub)
+	var state [2]sideState
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev := <-sub.ch:
+			applyFrame(&state, ev.raw)
+			continue
+		case <-ticker.C:
+		}
+		if s.fleet.get(b.Mac) == nil {
+			// 已被移除
+			return
+		}
+		dev := b.device()
+		v := bedStateView{Mac: b.Mac, Model: b.Model, Profile: b.Profile, Status: b.status(), Paused: b.pausedTypes(), Left: state[0], Right: state[1]}
+		v.Left.Occupied = dev.Occupied(identity.Left)
+		v.Left.Absent = b.Occupied(identity.Left) && !v.Left.Occupied
+		v.Right.Occupied = dev.Occupied(identity.Right)
+		v.Right.Absent = b.Occupied(identity.Right) && !v.Right.Occupied
+		writeEvent(w, flusher, v)
+	}
+}
+
+// 按命令字解析一帧，更新对应一侧的状态；opt 为 1（左）或 2（右）
+func applyFrame(state *[2]sideState, data []byte) {
+	if len(data) < 2 || (data[1] != byte(identity.Left) && data[1] != byte(identity.Right)) {
+		return
+	}
+	side := &state[data[1]-1]
+	switch data[0] {
+	case 0x71:
+		// 压力垫，1024 个点
+		if side.Pressure == nil {
+			side.Pressure = make([]int, 1024)
+		}
+		for i, v := range data[2:min(len(data), 2+1024)] {
+			side.Pressure[i] = int(v)
+		}
+	case 0x93, 0x9a, 0x9b, 0x9c:
+		var values map[string]int
+		if err := json.Unmarshal(data[2:], &values); err != nil {
+			return
+		}
+		for key, v := range values {
+			switch key {
+			case "posture":
+				side.Posture = &v
+			case "HR":
+				side.HR = &v
+			case "HRV":
+				side.HRV = &v
+			case "BR":
+				side.BR = &v
+			}
+		}
+	}
+}
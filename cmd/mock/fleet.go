@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"mock-bed/pkg/identity"
+	"mock-bed/pkg/mqttclient"
+)
+
+// fleet 运行中的所有床，控制接口可以在运行时增删
+type fleet struct {
+	mu      sync.RWMutex
+	beds    []*bed
+	byMac   map[string]*bed
+	conns   []mqttclient.Client // 当前的床使用的连接，不重复
+	created int                 // 创建过的连接数，重连次数要扣除每个连接的第一次连接
+}
+
+func newFleet(beds []*bed) *fleet {
+	f := &fleet{byMac: make(map[string]*bed, len(beds))}
+	f.add(beds)
+	return f
+}
+
+// 当前所有床的快照
+func (f *fleet) list() []*bed {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return append([]*bed(nil), f.beds...)
+}
+
+func (f *fleet) get(mac string) *bed {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.byMac[mac]
+}
+
+// 当前所有连接的快照
+func (f *fleet) clients() []mqttclient.Client {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return append([]mqttclient.Client(nil), f.conns...)
+}
+
+// 创建过的连接数
+func (f *fleet) connections() int {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.created
+}
+
+func (f *fleet) add(beds []*bed) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	before := len(f.conns)
+	for _, b := range beds {
+		f.beds = append(f.beds, b)
+		f.byMac[b.Mac] = b
+	}
+	f.conns = uniqueConns(f.beds)
+	f.created += len(f.conns) - before
+}
+
+// 移除一张床，不存在时返回 nil
+func (f *fleet) remove(mac string) *bed {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	b, ok := f.byMac[mac]
+	if !ok {
+		return nil
+	}
+	delete(f.byMac, mac)
+	for i, o := range f.beds {
+		if o == b {
+			f.beds = append(f.beds[:i:i], f.beds[i+1:]...)
+			break
+		}
+	}
+	f.conns = uniqueConns(f.beds)
+	return b
+}
+
+// 床在线且这种消息没有被暂停
+func (b *bed) publishing(g generator) bool {
+	if !b.online.Load() || g.ctl.paused.Load() || b.pauseAll.Load() {
+		return false
+	}
+	_, paused := b.paused.Load(g.name)
+	return !paused
+}
+
+// 暂停的消息类型，全部暂停时为 ["*"]
+func (b *bed) pausedTypes() []string {
+	if b.pauseAll.Load() {
+		return []string{"*"}
+	}
+	var names []string
+	for _, g := range generators {
+		if _, ok := b.paused.Load(g.name); ok {
+			names = append(names, g.name)
+		}
+	}
+	return names
+}
+
+// 生成数据使用的设备信息，离床的一侧按没有人处理
+func (b *bed) device() identity.Device {
+	absent := b.absent.Load()
+	if absent == 0 {
+		return b.Device
+	}
+	dev := b.Device
+	left := dev.Occupied(identity.Left) && absent&(1<<identity.Left) == 0
+	right := dev.Occupied(identity.Right) && absent&(1<<identity.Right) == 0
+	switch {
+	case left && right:
+		dev.Profile = identity.ProfileCouple
+	case left:
+		dev.Profile = identity.ProfileSingle
+	case right:
+		dev.Profile = identity.ProfileSingleRight
+	default:
+		dev.Profile = identity.ProfileUnbound
+	}
+	return dev
+}
+
+// 每张床记录的最近消息条数，0 表示不记录
+var recentSize = 16
+
+// 最近消息中保留的明文帧长度，压力垫等长帧只保留开头
+const recentDataLen = 64
+
+// recentLog 一张床最近发布的消息，第一次写入时分配
+type recentLog struct {
+	mu   sync.Mutex
+	msgs []recentMsg
+	n    int // 写入的总条数
+}
+
+type recentMsg struct {
+	at    time.Time
+	name  string
+	topic string
+	head  []byte // 明文帧的开头，最多 recentDataLen 字节
+	size  int    // 明文帧的长度
+	err   error
+}
+
+// messageView 控制接口返回的一条消息
+type messageView struct {
+	Time      time.Time `json:"time"`
+	Type      string    `json:"type"`
+	Topic     string    `json:"topic"`
+	Cmd       string    `json:"cmd"`
+	Size      int       `json:"size"`
+	Data      string    `json:"data"`
+	Truncated bool      `json:"truncated,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+func (l *recentLog) add(m recentMsg) {
+	if recentSize <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.msgs == nil {
+		l.msgs = make([]recentMsg, recentSize)
+	}
+	l.msgs[l.n%len(l.msgs)] = m
+	l.n++
+}
+
+// 从新到旧
+func (l *recentLog) list() []messageView {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	views := make([]messageView, 0, min(l.n, len(l.msgs)))
+	for i := l.n - 1; i >= 0 && i >= l.n-len(l.msgs); i-- {
+		views = append(views, l.msgs[i%len(l.msgs)].view())
+	}
+	return views
+}
+
+// 明文只保留开头 recentDataLen 字节
+func (m recentMsg) view() messageView {
+	head := m.head[:min(len(m.head), recentDataLen)]
+	v := messageView{
+		Time:      m.at,
+		Type:      m.name,
+		Topic:     m.topic,
+		Size:      m.size,
+		Data:      hex.EncodeToString(head),
+		Truncated: len(head) < m.size,
+	}
+	if len(head) > 0 {
+		v.Cmd = fmt.Sprintf("%02X", head[0])
+	}
+	if m.err != nil {
+		v.Error = m.err.Error()
+	}
+	return v
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"mock-bed/pkg/encryption"
+	"mock-bed/pkg/identity"
+)
+
+// frame 一条待发布的消息，data 为未加密的原始帧
+type frame struct {
+	topic string
+	data  []byte
+	enc   []byte  // 不变的帧预先加密好的数据，所有床共用，不能修改
+	buf   *[]byte // data 从 framePool 取得时，加密后归还
+}
+
+// 加密后的负载。data 来自 framePool 时加密后归还，之后不能再使用 data
+func (f frame) payload() ([]byte, error) {
+	if f.enc != nil {
+		return f.enc, nil
+	}
+	enc, err := encryption.Encrypt(f.data)
+	if f.buf != nil {
+		framePool.Put(f.buf)
+	}
+	return enc, err
+}
+
+// 压力垫等大帧的原始数据缓冲区
+var framePool = sync.Pool{New: func() any {
+	buf := make([]byte, 0, 1026)
+	return &buf
+}}
+
+// staticFrame 不随时间和设备变化的帧，启动时加密一次
+type staticFrame struct {
+	data []byte
+	enc  []byte
+}
+
+func newStaticFrame(data []byte) staticFrame {
+	enc, _ := encryption.Encrypt(data)
+	return staticFrame{data: data, enc: enc}
+}
+
+func (s staticFrame) frame(topic string) frame {
+	return frame{topic: topic, data: s.data, enc: s.enc}
+}
+
+// 左右两侧各一帧，按 opt 取
+func sideFrames(cmd byte, v any) [3]staticFrame {
+	var frames [3]staticFrame
+	for _, side := range []identity.Side{identity.Left, identity.Right} {
+		frames[side] = newStaticFrame(jsonFrame(cmd, byte(side), v))
+	}
+	return frames
+}
+
+var (
+	heartBeatFrame         = newStaticFrame([]byte{0x55, 4})
+	adaptiveActiveFrames   = sideFrames(0x97, adaptiveActiveJSON)
+	bodyshapeFrames        = sideFrames(0x95, bodyshapeJSON)
+	frames8E               = sideFrames(0x8E, json8E)
+	hardwareAllStatusFrame = newStaticFrame(hardwareAllStatus())
+	versionFrame           = newStaticFrame(hexFrame("a004ff204d3030312d56312e332e30312d323032352d30312d31362031373a32383a3333030100010301000106010202010001"))
+	algorAllStatusFrames   sync.Map // 床型 -> staticFrame
+	solenoidValveCurrent   = []staticFrame{newStaticFrame(hexFrame("7401000000000000")), newStaticFrame(hexFrame("7402000000000000"))}
+	motherboardTemperature = []staticFrame{newStaticFrame(hexFrame("7601018a01790121026b03ff")), newStaticFrame(hexFrame("76020241022b017c01f30267"))}
+	mprFrames              = []staticFrame{
+		newStaticFrame(hexFrame("700a0100199c230019a725001993a30024612900245273002460d8002451f400245b150024558d002462e40022bc9600245f1a00244a9a00245f6e001c69aa")),
+		newStaticFrame(hexFrame("7009010019c3cc001e1a05001da12700263da7002619b000263c5e001d6bda001da1b80024752f00244b64002444330024b9a3001a18ae0019cb6d0019d4b7")),
+	}
+)
+
+// 同一主题的一组不变帧
+func staticFrames(topic string, frames []staticFrame) []frame {
+	out := make([]frame, len(frames))
+	for i, s := range frames {
+		out[i] = s.frame(topic)
+	}
+	return out
+}
+
+// generator 一种周期性上报的消息类型，实时模式和离线模式共用
+type generator struct {
+	name     string
+	interval time.Duration // 默认周期
+	build    func(dev identity.Device, now time.Time) []frame
+	ctl      *generatorControl
+}
+
+// generatorControl 运行时由控制接口修改的参数，generator 复制后仍然共用
+type generatorControl struct {
+	interval atomic.Int64 // 当前周期
+	paused   atomic.Bool
+}
+
+func init() {
+	for i := range generators {
+		generators[i].ctl = new(generatorControl)
+		generators[i].ctl.interval.Store(int64(generators[i].interval))
+	}
+}
+
+// 当前周期
+func (g generator) period() time.Duration {
+	return time.Duration(g.ctl.interval.Load())
+}
+
+func findGenerator(name string) (generator, bool) {
+	for _, g := range generators {
+		if g.name == name {
+			return g, true
+		}
+	}
+	return generator{}, false
+}
+
+var generators = []generator{
+	{name: "heartbeat", interval: 10 * time.Second, build: buildHeartBeat},
+	{name: "motherboard_temperature", interval: 3 * time.Second, build: buildHardWareMotherboardTemperature},
+	{name: "solenoid_valve_temperature", interval: 1 * time.Second, build: buildHardWareSolenoidValveTemperature},
+	{name: "air_pump_current", interval: 1 * time.Second, build: buildHardWareAirPumpCurrent},
+	{name: "pressure_pad", interval: 72 * time.Millisecond, build: buildHardWarePressurePad},
+	{name: "solenoid_valve_current", interval: 1 * time.Second, build: buildHardWareSolenoidValveCurrent},
+	{name: "error_code", interval: 10 * time.Second, build: buildErrorCode},
+	{name: "mpr", interval: 90 * time.Millisecond, build: buildMPR},
+	{name: "hardware_all_status", interval: 15 * time.Second, build: buildGET_HARDWARE_ALL_STATUS},
+	{name: "algor_all_status", interval: 15 * time.Second, build: buildGET_ALGOR_ALL_STATUS},
+	{name: "8e", interval: 30 * time.Second, build: build8E},
+	{name: "movement", interval: 5 * time.Second, build: buildMovement},
+	{name: "posture", interval: 30 * time.Second, build: buildPosture},
+	{name: "bodyshape", interval: 1 * time.Second, build: buildBodyshape},
+	{name: "adaptive_active", interval: 7 * time.Second, build: buildAdaptiveActive},
+	{name: "hr_hrv_br_left", interval: 1 * time.Second, build: func(dev identity.Device, now time.Time) []frame { return buildHrHRVBR(dev, identity.Left) }},
+	{name: "hr_hrv_br_right", interval: 1 * time.Second, build: func(dev identity.Device, now time.Time) []frame { return buildHrHRVBR(dev, identity.Right) }},
+}
+
+// 拼接 cmd、opt 和 json 数据
+func jsonFrame(cmd, opt byte, v any) []byte {
+	buffer := bytes.NewBuffer(make([]byte, 0))
+	buffer.WriteByte(cmd)
+	buffer.WriteByte(opt)
+	switch data := v.(type) {
+	case string:
+		buffer.WriteString(data)
+	default:
+		bytedata, _ := json.Marshal(data)
+		buffer.Write(bytedata)
+	}
+	return buffer.Bytes()
+}
+
+// 只有一个整数字段的 json 帧，结果和 jsonFrame 相同，避免 map 和反射的开销
+func intFrame(cmd, opt byte, key string, v int) []byte {
+	data := make([]byte, 0, len(key)+16)
+	data = append(data, cmd, opt, '{', '"')
+	data = append(data, key...)
+	data = append(data, '"', ':')
+	data = strconv.AppendInt(data, int64(v), 10)
+	return append(data, '}')
+}
+
+// 对有人的每一侧生成一帧 body_info，空的一侧不上报
+func perSide(dev identity.Device, fn func(opt byte) frame) []frame {
+	frames := make([]frame, 0, 2)
+	for _, side := range []identity.Side{identity.Left, identity.Right} {
+		if dev.Occupied(side) {
+			frames = append(frames, fn(byte(side)))
+		}
+	}
+	return frames
+}
+
+func hexFrame(s string) []byte {
+	bs, _ := hex.DecodeString(s)
+	return bs
+}
+
+// 发布心跳数据包
+func buildHeartBeat(dev identity.Device, now time.Time) []frame {
+	return []frame{heartBeatFrame.frame(fmt.Sprintf(runStatusPubTopic, dev.Mac))}
+}
+
+func buildHrHRVBR(dev identity.Device, side identity.Side) []frame {
+	if !dev.Occupied(side) {
+		return nil
+	}
+	topic := fmt.Sprintf(bodyInfoPubTopic, dev.Mac)
+	opt := byte(side)
+	return []frame{
+		{topic: topic, data: intFrame(0x9a, opt, "HR", randInt(60, 110))},
+		{topic: topic, data: intFrame(0x9b, opt, "HRV", randInt(0, 10))},
+		{topic: topic, data: intFrame(0x9c, opt, "BR", randInt(10, 30))},
+	}
+}
+
+const adaptiveActiveJSON = `{"head": {"val": 20, "airbag": [0]}, "shoulder": {"val": 5, "airbag": [1]}, "back": {"val": 5, "airbag": [2, 3]}, "upper_waist": {"val": 40, "airbag": [4, 5]}, "lower_waist": {"val": 40, "airbag": [6]}, "hip": {"val": 5, "airbag": [7, 8, 9]}, "leg": {"val": 40, "airbag": [10, 11]}}`
+
+func buildAdaptiveActive(dev identity.Device, now time.Time) []frame {
+	topic := fmt.Sprintf(bodyInfoPubTopic, dev.Mac)
+	return perSide(dev, func(opt byte) frame {
+		return adaptiveActiveFrames[opt].frame(topic)
+	})
+}
+
+const bodyshapeJSON = `{"number": 59, "spine_x": [0, 2.0, 4.0, 5.99, 7.99, 9.99, 11.99, 13.98, 15.98, 17.98, 19.98, 21.98, 23.97, 25.97, 27.96, 29.96, 31.95, 33.94, 35.94, 37.93, 39.93, 41.93, 43.92, 45.92, 47.9, 49.9, 51.87, 53.86, 55.86, 57.85, 59.85, 61.85, 63.85, 65.85, 67.83, 69.8, 71.76, 73.7, 75.64, 77.58, 79.55, 81.51, 83.5, 85.49, 87.49, 89.49, 91.49, 93.49, 95.49, 97.49, 99.49, 101.49, 103.49, 105.48, 107.48, 109.48, 111.48, 113.48, 115.48], "spine_y": [0, 0.01, 0.0, -0.16, -0.33, -0.37, -0.41, -0.47, -0.42, -0.43, -0.32, -0.31, -0.12, -0.0, 0.18, 0.31, 0.5, 0.67, 0.79, 0.97, 1.0, 1.09, 1.01, 0.92, 0.65, 0.48, 0.15, -0.01, -0.17, -0.28, -0.34, -0.4, -0.32, -0.17, 0.09, 0.44, 0.84, 1.31, 1.79, 2.28, 2.65, 3.02, 3.22, 3.39, 3.5, 3.59, 3.68, 3.75, 3.73, 3.74, 3.72, 3.69, 3.64, 3.58, 3.5, 3.46, 3.38, 3.33, 3.26], "peak_chest": 0.0, "peak_waist": 0.0, "peak_hip": 0.0}`
+
+func buildBodyshape(dev identity.Device, now time.Time) []frame {
+	topic := fmt.Sprintf(bodyInfoPubTopic, dev.Mac)
+	return perSide(dev, func(opt byte) frame {
+		return bodyshapeFrames[opt].frame(topic)
+	})
+}
+
+func buildPosture(dev identity.Device, now time.Time) []frame {
+	topic := fmt.Sprintf(bodyInfoPubTopic, dev.Mac)
+	return perSide(dev, func(opt byte) frame {
+		return frame{topic: topic, data: intFrame(0x93, opt, "posture", randInt(0, 7))}
+	})
+}
+
+func buildMovement(dev identity.Device, now time.Time) []frame {
+	topic := fmt.Sprintf(bodyInfoPubTopic, dev.Mac)
+	return perSide(dev, func(opt byte) frame {
+		return frame{topic: topic, data: intFrame(0x91, opt, "movement", randInt(0, 2))}
+	})
+}
+
+const json8E = `{
+	"supine": {
+		"head": {
+			"hit": [
+				[3, 1],
+				[4, -1]
+			],
+			"val": [20, -1]
+		},
+		"shoulder": {
+			"hit": [
+				[1, 1],
+				[2, -1],
+				[5, 1]
+			],
+			"val": [40, 1]
+		},
+		"back": {
+			"hit": [],
+			"val": [30, 0]
+		},
+		"upper_waist": {
+			"hit": [
+				[1, 1],
+				[2, -1],
+				[5, 1]
+			],
+			"val": [40, 1]
+		},
+		"lower_waist": {
+			"hit": [
+				[1, 1],
+				[2, -1],
+				[5, 1]
+			],
+			"val": [40, 1]
+		},
+		"hip": {
+			"hit": [
+				[1, 1],
+				[2, -1],
+				[5, 1]
+			],
+			"val": [40, 1]
+		},
+		"leg": {
+			"hit": [
+				[1, 1],
+				[2, -1],
+				[5, 1]
+			],
+			"val": [40, 1]
+		}
+	},
+	"lateral": {
+		"head": {
+			"hit": [
+				[3, 1],
+				[4, -1]
+			],
+			"val": [20, -1]
+		},
+		"shoulder": {
+			"hit": [
+				[1, 1],
+				[2, -1],
+				[5, 1]
+			],
+			"val": [40, 1]
+		},
+		"back": {
+			"hit": [],
+			"val": [30, 0]
+		},
+		"upper_waist": {
+			"hit": [
+				[1, 1],
+				[2, -1],
+				[5, 1]
+			],
+			"val": [40, 1]
+		},
+		"lower_waist": {
+			"hit": [
+				[1, 1],
+				[2, -1],
+				[5, 1]
+			],
+			"val": [40, 1]
+		},
+		"hip": {
+			"hit": [
+				[1, 1],
+				[2, -1],
+				[5, 1]
+			],
+			"val": [40, 1]
+		},
+		"leg": {
+			"hit": [
+				[1, 1],
+				[2, -1],
+				[5, 1]
+			],
+			"val": [40, 1]
+		}
+	}
+}`
+
+func build8E(dev identity.Device, now time.Time) []frame {
+	topic := fmt.Sprintf(bodyInfoPubTopic, dev.Mac)
+	if dev.Profile == "" && dev.LeftUser == "" && dev.RightUser == "" {
+		// 没有绑定信息时和原来一样发两帧 opt 0x01
+		return []frame{frames8E[0x01].frame(topic), frames8E[0x01].frame(topic)}
+	}
+	return perSide(dev, func(opt byte) frame {
+		return frames8E[opt].frame(topic)
+	})
+}
+
+func buildGET_ALGOR_ALL_STATUS(dev identity.Device, now time.Time) []frame {
+	s, ok := algorAllStatusFrames.Load(dev.Model)
+	if !ok {
+		s, _ = algorAllStatusFrames.LoadOrStore(dev.Model, newStaticFrame(algorAllStatus(dev.Model)))
+	}
+	return []frame{s.(staticFrame).frame(fmt.Sprintf(serverAckPubTopic, dev.Mac))}
+}
+
+func algorAllStatus(model string) []byte {
+	dataMap := make(map[string]any)
+	dataMap["pillowFlag"] = 1
+	dataMap["adaptiveMode"] = 1
+	dataMap["shieldAdaptive"] = 1
+	dataMap["floatingMode"] = 1
+	dataMap["welcomeMode"] = 1
+	dataMap["runStatus"] = 1
+	dataMap["posture"] = 1
+	dataMap["bedExitStatus"] = 1
+	dataMap["bedModel"] = model
+	dataMap["firmwareVersion"] = "M001-V1.3.01-2025-01-16 17:28:33"
+	dataMap["storage"] = "1024 MB"
+	return jsonFrame(0xb1, 0x00, dataMap)
+}
+
+func buildGET_HARDWARE_ALL_STATUS(dev identity.Device, now time.Time) []frame {
+	return []frame{hardwareAllStatusFrame.frame(fmt.Sprintf(serverAckPubTopic, dev.Mac))}
+}
+
+func hardwareAllStatus() []byte {
+	buffer := bytes.NewBuffer(make([]byte, 0))
+	buffer.WriteByte(0xb3)
+	buffer.WriteByte(0x00)
+	buffer.WriteByte(0x01)
+	buffer.WriteByte(0x05)
+	buffer.WriteString("qrem_guestqrem_guestqrem_guest0")
+	buffer.WriteByte(0x00)
+	buffer.WriteByte(0x01)
+	return buffer.Bytes()
+}
+
+func buildMPR(dev identity.Device, now time.Time) []frame {
+	return staticFrames(fmt.Sprintf(hardwarePubTopic, dev.Mac), mprFrames)
+}
+
+func buildErrorCode(dev identity.Device, now time.Time) []frame {
+	return []frame{errorCodeFrame(dev.Mac, now, byte(randInt(0x01, 0x0f)))}
+}
+
+// 故障码帧，控制接口触发故障时指定 code
+func errorCodeFrame(mac string, now time.Time, code byte) frame {
+	yearStr := strconv.Itoa(now.Year())
+	yearLastTwo, _ := strconv.Atoi(yearStr[len(yearStr)-2:])
+	bs := []byte{0xec, 4, byte(randInt(0x01, 0x04)), 1, code, byte(yearLastTwo), byte(now.Month()), byte(now.Day()), byte(now.Hour()), byte(now.Minute()), byte(now.Second())}
+	return frame{topic: fmt.Sprintf(productionTestPubTopic, mac), data: bs}
+}
+
+func buildHardWarePressurePad(dev identity.Device, now time.Time) []frame {
+	topic := fmt.Sprintf(pressurePubTopic, dev.Mac)
+	return []frame{
+		pressureFrame(topic, identity.Left, dev.Occupied(identity.Left), 126),
+		pressureFrame(topic, identity.Right, dev.Occupied(identity.Right), 80),
+	}
+}
+
+// 一侧 32x32 的压力垫数据，空的一侧只有很小的底噪；缓冲区从 framePool 取，加密后归还
+func pressureFrame(topic string, side identity.Side, occupied bool, max int) frame {
+	if !occupied {
+		max = 4
+	}
+	buf := framePool.Get().(*[]byte)
+	data := append((*buf)[:0], 0x71, byte(side))
+	// 每个随机数取 4 个 16 位的值，减少随机数的调用
+	for range 1024 / 4 {
+		r := rand.Uint64()
+		for range 4 {
+			data = append(data, byte(int(r&0xffff)%max))
+			r >>= 16
+		}
+	}
+	*buf = data
+	return frame{topic: topic, data: data, buf: buf}
+}
+
+func buildHardWareAirPumpCurrent(dev identity.Device, now time.Time) []frame {
+	bs := []byte{0x73, 4, byte(randInt(0, 1000)), byte(randInt(0, 1000)), 0, 0, byte(randInt(0, 1000)), byte(randInt(0, 1000))}
+	return []frame{{topic: fmt.Sprintf(hardwarePubTopic, dev.Mac), data: bs}}
+}
+
+func buildHardWareSolenoidValveTemperature(dev identity.Device, now time.Time) []frame {
+	topic := fmt.Sprintf(hardwarePubTopic, dev.Mac)
+	return []frame{
+		{topic: topic, data: []byte{0x75, 1, byte(randInt(10, 60)), byte(randInt(10, 60)), byte(randInt(10, 60))}},
+		{topic: topic, data: []byte{0x75, 2, byte(randInt(10, 80)), byte(randInt(10, 80)), byte(randInt(10, 80))}},
+	}
+}
+
+func buildHardWareSolenoidValveCurrent(dev identity.Device, now time.Time) []frame {
+	return staticFrames(fmt.Sprintf(hardwarePubTopic, dev.Mac), solenoidValveCurrent)
+}
+
+func buildHardWareMotherboardTemperature(dev identity.Device, now time.Time) []frame {
+	return staticFrames(fmt.Sprintf(hardwarePubTopic, dev.Mac), motherboardTemperature)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"mock-bed/pkg/encryption"
+	"mock-bed/pkg/identity"
+)
+
+var benchDevice = identity.Device{Mac: "AABBCCDDEEFF", Model: identity.DefaultModel, Profile: identity.ProfileCouple}
+
+// 预先加密的帧和每次加密的结果一致
+func TestStaticFrames(t *testing.T) {
+	now := time.Now()
+	for _, g := range generators {
+		for _, f := range g.build(benchDevice, now) {
+			if f.enc == nil {
+				continue
+			}
+			enc, _ := encryption.Encrypt(f.data)
+			if !bytes.Equal(enc, f.enc) {
+				t.Fatalf("%s: cached payload differs from a fresh encryption", g.name)
+			}
+		}
+	}
+}
+
+func TestIntFrame(t *testing.T) {
+	for _, v := range []int{0, 7, 109} {
+		want := jsonFrame(0x9a, 1, map[string]any{"HR": v})
+		if got := intFrame(0x9a, 1, "HR", v); !bytes.Equal(got, want) {
+			t.Fatalf("intFrame(%d) = %q, want %q", v, got, want)
+		}
+	}
+}
+
+// 每种消息生成并加密一张床一轮数据的开销，msgs/s 为单核每秒能生成的消息数：
+// go test -run ^$ -bench Generators -benchmem -cpu 1 ./cmd/mock
+func BenchmarkGenerators(b *testing.B) {
+	for _, g := range generators {
+		b.Run(g.name, func(b *testing.B) {
+			b.ReportAllocs()
+			msgs := 0
+			now := time.Now()
+			for b.Loop() {
+				for _, f := range g.build(benchDevice, now) {
+					if _, err := f.payload(); err != nil {
+						b.Fatal(err)
+					}
+					msgs++
+				}
+			}
+			b.ReportMetric(float64(msgs)/float64(b.N), "msgs/op")
+			b.ReportMetric(float64(msgs)/b.Elapsed().Seconds(), "msgs/s")
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+
+	"mock-bed/pkg/mqttclient"
+	"mock-bed/pkg/netem"
+)
+
+// impairOptions 网络损伤参数：-netem 作用于按 MAC 哈希选出的 -netemFraction 比例的床，
+// 同一台设备每次运行都在同一组；-netemDevice 单独指定某台设备，优先于 -netem
+type impairOptions struct {
+	spec     string
+	fraction float64
+	devices  mqttclient.Properties // mac -> 损伤参数
+
+	group     netem.Profile
+	perDevice map[string]netem.Profile
+}
+
+func (o *impairOptions) parse() error {
+	if o.fraction < 0 || o.fraction > 1 {
+		return fmt.Errorf("netemFraction must be in [0, 1]")
+	}
+	var err error
+	if o.group, err = netem.ParseProfile(o.spec); err != nil {
+		return err
+	}
+	o.perDevice = make(map[string]netem.Profile, len(o.devices))
+	for mac, spec := range o.devices {
+		p, err := netem.ParseProfile(spec)
+		if err != nil {
+			return fmt.Errorf("device %s: %w", mac, err)
+		}
+		o.perDevice[mac] = p
+	}
+	return nil
+}
+
+// 设备 mac 的损伤参数
+func (o *impairOptions) profile(mac string) netem.Profile {
+	if p, ok := o.perDevice[mac]; ok {
+		return p
+	}
+	h := fnv.New32a()
+	h.Write([]byte(mac))
+	if float64(h.Sum32()%10000) < o.fraction*10000 {
+		return o.group
+	}
+	return netem.Profile{}
+}
+
+// 设备 mac 的连接包装函数，不需要损伤时返回 nil
+func (o *impairOptions) wrapper(mac string) func(net.Conn) net.Conn {
+	p := o.profile(mac)
+	if !p.Enabled() {
+		return nil
+	}
+	return func(c net.Conn) net.Conn {
+		return netem.Wrap(c, p)
+	}
+}
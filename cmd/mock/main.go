@@ -6,25 +6,30 @@ package main
 import (
 	"bytes"
 	_ "bytes"
-	"encoding/hex"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"math/rand"
 	"os"
-	"strconv"
+	"os/signal"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/panjf2000/ants/v2"
 
 	"github.com/madflojo/tasks"
 
+	"mock-bed/pkg/brokerauth"
 	"mock-bed/pkg/encryption"
-
-	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"mock-bed/pkg/identity"
+	"mock-bed/pkg/mqttclient"
+	"mock-bed/pkg/tlsconf"
 )
 
 const (
@@ -42,6 +47,20 @@ const (
 	runStatusPubTopic      = "qrem/%s/run_status"
 )
 
+// bed 一张模拟床，client 负责业务主题，otaClient 负责 ota 主题，只在 separate 拓扑下使用
+type bed struct {
+	identity.Device
+	client    mqttclient.Client
+	otaClient mqttclient.Client
+	online    atomic.Bool // 离线期间不发布数据
+	removed   atomic.Bool // 已被控制接口移除
+
+	pauseAll atomic.Bool   // 暂停所有消息
+	paused   sync.Map      // 暂停的消息类型 -> struct{}
+	absent   atomic.Uint32 // 离床的一侧，按 1<<Side 置位
+	recent   recentLog
+}
+
 // 定义消息接收处理器函数，这里没有具体实现
 // var msgRecHandler MQTT.MessageHandler = ...
 func main() {
@@ -54,8 +73,84 @@ func main() {
 	endNum := flag.Int("endNum", -1, "number of beds")
 	// bedNumMax := flag.Int("bedNumMax", 1, "number of beds")
 	// bedNumMin := flag.Int("bedNumMin", 1, "number of beds")
+	flag.StringVar(&broker.url, "broker", brokerHost, "MQTT broker URL: tcp://, ssl:// (with the -tls* flags), ws:// or wss://; a comma-separated list shards beds across brokers")
+	flag.StringVar(&broker.shard.strategy, "brokerStrategy", shardRoundRobin, "how beds are assigned to brokers: roundrobin, hash (of MAC) or weighted")
+	flag.StringVar(&broker.shard.weights, "brokerWeights", "", "comma-separated weights for the weighted strategy, one per broker")
+	flag.StringVar(&broker.username, "username", username, "MQTT username shared by all beds")
+	flag.StringVar(&broker.password, "password", pwd, "MQTT password shared by all beds")
+	flag.BoolVar(&broker.deviceAuth, "deviceAuth", false, "use per-device credentials (username = MAC, password derived from -authSecret)")
+	flag.StringVar(&broker.authSecret, "authSecret", brokerauth.DefaultSecret, "secret used to derive per-device passwords")
+	broker.protocol.RegisterFlags(flag.CommandLine)
+	var tlsOpts tlsconf.Options
+	tlsOpts.RegisterFlags(flag.CommandLine)
+	var idOpts identity.Options
+	idOpts.RegisterFlags(flag.CommandLine)
+	flag.IntVar(&broker.qos.defaultQos, "qos", 0, "default QoS for publish and subscribe")
+	flag.Var(&broker.qos.topics, "topicQos", "per-topic QoS and retain as name=qos[,retain], e.g. run_status=1,retain or control=2; name is the last topic level, repeatable")
+	flag.BoolVar(&broker.will.enabled, "will", false, "set a Last Will message on each bed's client")
+	flag.StringVar(&broker.will.topic, "willTopic", runStatusPubTopic, "Last Will topic, %s is replaced with the MAC")
+	flag.StringVar(&broker.will.payload, "willPayload", "5500", "Last Will frame as hex, encrypted like other frames")
+	flag.IntVar(&broker.will.qos, "willQos", 0, "Last Will QoS")
+	flag.BoolVar(&broker.will.retain, "willRetain", false, "retain the Last Will message")
+	flag.StringVar(&broker.impair.spec, "netem", "", "simulated bad network for impaired beds, e.g. latency=200ms,jitter=50ms,bandwidth=32k,stall=0.02,stallTime=3s,reset=5m")
+	flag.Float64Var(&broker.impair.fraction, "netemFraction", 1, "fraction of beds (chosen by MAC hash) that get the -netem profile")
+	flag.Var(&broker.impair.devices, "netemDevice", "per-device network profile as mac=profile, overrides -netem, repeatable")
+	var topology topologyOptions
+	flag.StringVar(&topology.mode, "topology", topologySeparate, "connections per bed: separate (bed + ota client, legacy firmware), shared (one client per bed) or mux (one client serves -muxBeds beds)")
+	flag.IntVar(&topology.muxBeds, "muxBeds", 100, "beds served by each connection in the mux topology")
+	var schedule scheduleOptions
+	flag.StringVar(&schedule.mode, "schedule", scheduleSpread, "publish scheduling: spread (each bed has its own phase, load is even) or burst (all beds publish each message type at the same instant)")
+	flag.Float64Var(&schedule.jitter, "jitter", 0.1, "random offset of each publish as a fraction of its interval, in the spread schedule")
+	reportPath := flag.String("report", "", "write a JSON and a Markdown report to <path>.json and <path>.md at the end of a live run")
+	metricsAddr := flag.String("metricsAddr", "", "serve Prometheus metrics on this address (e.g. :9100), empty disables")
+	controlAddr := flag.String("controlAddr", "", "serve the HTTP control API and the live dashboard on this address (e.g. 127.0.0.1:8080): list, add and remove devices, pause generators, change intervals and trigger events; empty disables")
+	flag.IntVar(&recentSize, "recentMessages", 16, "recent messages kept per device for the control API, 0 disables")
+	flag.BoolVar(&metrics.perDevice, "metricsPerDevice", false, "also export per-device publish counters (one series per bed)")
+	backpressure := flag.String("backpressure", policyBlock, "what to do when the publish pool is saturated: block (slows the scheduler), dropNewest, dropOldest or coalesce (keep only the latest publish per bed and message type)")
+	queueSize := flag.Int("queueSize", 0, "publishes queued in front of the pool for the non-block backpressure policies, 0 means the pool size")
+	var rate rateOptions
+	flag.StringVar(&rate.rate, "rate", "", "target publish rate for the whole fleet, in messages/sec (5000) or bytes/sec (2MB, 512KB); beds skip or repeat publishes to follow it, needs -schedule spread")
+	flag.StringVar(&rate.profile, "rateProfile", "", "load profile as comma-separated segments: ramp:1000-5000:5m, step:1000-5000x5:10m, spike:20000:30s, soak:5000:1h; the run ends with the profile unless -duration is set")
+	var churn churnOptions
+	flag.DurationVar(&churn.mtbf, "churnMTBF", 0, "mean time between failures per bed for the online/offline churn simulator, 0 disables")
+	flag.DurationVar(&churn.mttr, "churnMTTR", time.Minute, "mean time to recovery per bed for the churn simulator")
+	flag.StringVar(&churn.mode, "disconnectMode", disconnectAbrupt, "how churned beds go offline: clean (DISCONNECT) or abrupt (drop the connection, triggers the Last Will)")
+	var outage stormOptions
+	flag.DurationVar(&outage.at, "outageAt", 0, "simulate a mass power outage this long after start, 0 disables")
+	flag.Float64Var(&outage.fraction, "outageFraction", 0.5, "fraction of online beds that lose power in the outage")
+	flag.DurationVar(&outage.boot, "bootTime", 45*time.Second, "mean boot time before a bed reconnects after the outage")
+	flag.DurationVar(&outage.bootJitter, "bootJitter", 15*time.Second, "standard deviation of the boot time")
+	flag.DurationVar(&outage.wait, "outageWait", 2*time.Minute, "how long to wait for backend version/status queries after all beds are back")
+	offline := flag.Bool("offline", false, "generate telemetry to files instead of connecting to the broker")
+	from := flag.String("from", "", "offline mode start time, RFC3339 (default now)")
+	duration := flag.Duration("duration", 0, "run length: live mode stops after this long (0 runs until interrupted), offline mode time range (default 1h)")
+	outDir := flag.String("outDir", "dataset", "offline mode output directory")
+	outFormat := flag.String("outFormat", "both", "offline mode output: frames, payloads or both")
+	var dist coordinatorOptions
+	flag.StringVar(&dist.addr, "coordinator", "", "run as coordinator on this address (e.g. 127.0.0.1:7070): split the beds across -workers mock processes, start them together and merge their metrics and reports")
+	flag.IntVar(&dist.workers, "workers", 2, "number of worker processes the coordinator waits for")
+	flag.DurationVar(&dist.delay, "startDelay", 3*time.Second, "time between the last worker connecting its beds and the synchronized start")
+	flag.DurationVar(&dist.ready, "readyTimeout", 10*time.Minute, "coordinator gives up when the workers haven't all connected their beds this long after joining")
+	flag.StringVar(&dist.url, "worker", "", "run as a worker of the coordinator at this address; the bed range and the flags set on the coordinator come from it")
 	// 解析命令行参数
 	flag.Parse()
+	if err := dist.validate(); err != nil {
+		fmt.Println("coordinator config error:", err)
+		os.Exit(1)
+	}
+	if *offline && (dist.addr != "" || dist.url != "") {
+		fmt.Println("coordinator config error: -offline runs in a single process")
+		os.Exit(1)
+	}
+	// 工作进程从协调者取得床的范围和参数
+	var worker *workerClient
+	if dist.url != "" {
+		var err error
+		if worker, err = joinCoordinator(dist.url); err != nil {
+			fmt.Println("worker error:", err)
+			os.Exit(1)
+		}
+	}
 	fmt.Println("bedNum:", *bedNum)
 
 	file, err := os.OpenFile("info.log", os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
@@ -79,744 +174,271 @@ func main() {
 		end = *bedNum
 	}
 
-	mqttClientMap := make(map[string]MQTT.Client)
-	otaMqttClientMap := make(map[string]MQTT.Client)
-
-	for i := start; i < end; i++ {
-		mac := fmt.Sprintf("25MM111111110038100000-%d", i)
-		mqttClientMap[mac] = getMqttClient(mac)
-		otaMqttClientMap[mac] = getOtaMqttClient("ota-" + mac)
+	devices, err := idOpts.Devices(start, end)
+	if err != nil {
+		fmt.Println("device list error:", err)
+		os.Exit(1)
 	}
-
-	size := len(mqttClientMap)
-	fmt.Printf("start %d beds", size)
-	fmt.Println()
-
-	p, _ := ants.NewPool(size*10, ants.WithPreAlloc(true), ants.WithNonblocking(false))
-	defer p.Release()
-
-	// Start the Scheduler
-	scheduler := tasks.New()
-	defer scheduler.Stop()
-
-	scheduler.Add(&tasks.Task{
-		Interval: 10 * time.Second,
-		TaskFunc: func() error {
-			sendHeartBeat(mqttClientMap, p)
-			return nil
-		},
-	})
-	scheduler.Add(&tasks.Task{
-		Interval: 3 * time.Second,
-		TaskFunc: func() error {
-			sendHardWareMotherboardTemperature(mqttClientMap, p)
-			return nil
-		},
-	})
-	scheduler.Add(&tasks.Task{
-		Interval: 1 * time.Second,
-		TaskFunc: func() error {
-			sendHardWareSolenoidValveTemperature(mqttClientMap, p)
-			return nil
-		},
-	})
-
-	scheduler.Add(&tasks.Task{
-		Interval: 1 * time.Second,
-		TaskFunc: func() error {
-			sendHardWareAirPumpCurrent(mqttClientMap, p)
-			return nil
-		},
-	})
-
-	scheduler.Add(&tasks.Task{
-		Interval: 72 * time.Millisecond,
-		TaskFunc: func() error {
-			sendHardWarePressurePad(mqttClientMap, p)
-			return nil
-		},
-	})
-
-	scheduler.Add(&tasks.Task{
-		Interval: 1 * time.Second,
-		TaskFunc: func() error {
-			sendHardWareSolenoidValveCurrent(mqttClientMap, p)
-			return nil
-		},
-	})
-
-	scheduler.Add(&tasks.Task{
-		Interval: 10 * time.Second,
-		TaskFunc: func() error {
-			sendErrorCode(mqttClientMap, p)
-			return nil
-		},
-	})
-
-	scheduler.Add(&tasks.Task{
-		Interval: 90 * time.Millisecond,
-		TaskFunc: func() error {
-			sendMPR(mqttClientMap, p)
-			return nil
-		},
-	})
-
-	scheduler.Add(&tasks.Task{
-		Interval: 15 * time.Second,
-		TaskFunc: func() error {
-			sendGET_HARDWARE_ALL_STATUS(mqttClientMap, p)
-			return nil
-		},
-	})
-
-	scheduler.Add(&tasks.Task{
-		Interval: 15 * time.Second,
-		TaskFunc: func() error {
-			sendGET_ALGOR_ALL_STATUS(mqttClientMap, p)
-			return nil
-		},
-	})
-
-	scheduler.Add(&tasks.Task{
-		Interval: 30 * time.Second,
-		TaskFunc: func() error {
-			send8E(mqttClientMap, p)
-			return nil
-		},
-	})
-
-	scheduler.Add(&tasks.Task{
-		Interval: 5 * time.Second,
-		TaskFunc: func() error {
-			sendMovement(mqttClientMap, p)
-			return nil
-		},
-	})
-
-	scheduler.Add(&tasks.Task{
-		Interval: 30 * time.Second,
-		TaskFunc: func() error {
-			sendPosture(mqttClientMap, p)
-			return nil
-		},
-	})
-	scheduler.Add(&tasks.Task{
-		Interval: 1 * time.Second,
-		TaskFunc: func() error {
-			sendBodyshape(mqttClientMap, p)
-			return nil
-		},
-	})
-	scheduler.Add(&tasks.Task{
-		Interval: 7 * time.Second,
-		TaskFunc: func() error {
-			sendAdaptiveActive(mqttClientMap, p)
-			return nil
-		},
-	})
-	scheduler.Add(&tasks.Task{
-		Interval: 1 * time.Second,
-		TaskFunc: func() error {
-			sendHrHRVBR(mqttClientMap, 0x01, p)
-			return nil
-		},
-	})
-	scheduler.Add(&tasks.Task{
-		Interval: 1 * time.Second,
-		TaskFunc: func() error {
-			sendHrHRVBR(mqttClientMap, 0x02, p)
-			return nil
-		},
-	})
-
-	scheduler.Add(&tasks.Task{
-		Interval: 1 * time.Second,
-		TaskFunc: func() error {
-			fmt.Println(fmt.Sprintf("cap=%d,free=%d,waiting=%d,running=%d,", p.Cap(), p.Free(), p.Waiting(), p.Running()))
-			return nil
-		},
-	})
-
-	var wg sync.WaitGroup
-	wg.Add(1)
-	wg.Wait()
-}
-
-func sendHrHRVBR(mqttClientMap map[string]MQTT.Client, opt byte, p *ants.Pool) {
-	for mac, client := range mqttClientMap {
-		log.Println(fmt.Sprintf("public send8E,mac=%s,cmd=%X", mac, 0x9a))
-		buffer := bytes.NewBuffer(make([]byte, 0))
-		buffer.WriteByte(0x9a)
-		buffer.WriteByte(opt)
-		dataMap := make(map[string]any)
-		dataMap["HR"] = randInt(60, 110)
-		bytedata, _ := json.Marshal(dataMap)
-		buffer.Write(bytedata)
-		bs := buffer.Bytes()
-
-		encryptedData, _ := encryption.Encrypt(bs)
-		p.Submit(func() {
-			token := client.Publish(fmt.Sprintf(bodyInfoPubTopic, mac), 0, false, encryptedData)
-			token.Wait()
-		})
-
-		buffer2 := bytes.NewBuffer(make([]byte, 0))
-		buffer2.WriteByte(0x9b)
-		buffer2.WriteByte(opt)
-		dataMap2 := make(map[string]any)
-		dataMap2["HRV"] = randInt(0, 10)
-		bytedata2, _ := json.Marshal(dataMap2)
-		buffer2.Write(bytedata2)
-		bs2 := buffer2.Bytes()
-		encryptedData2, _ := encryption.Encrypt(bs2)
-		p.Submit(func() {
-			token2 := client.Publish(fmt.Sprintf(bodyInfoPubTopic, mac), 0, false, encryptedData2)
-			token2.Wait()
-		})
-
-		buffer3 := bytes.NewBuffer(make([]byte, 0))
-		buffer3.WriteByte(0x9c)
-		buffer3.WriteByte(opt)
-		dataMap3 := make(map[string]any)
-		dataMap3["BR"] = randInt(10, 30)
-		bytedata3, _ := json.Marshal(dataMap3)
-		buffer3.Write(bytedata3)
-		bs3 := buffer3.Bytes()
-		encryptedData3, _ := encryption.Encrypt(bs3)
-		p.Submit(func() {
-			token3 := client.Publish(fmt.Sprintf(bodyInfoPubTopic, mac), 0, false, encryptedData3)
-			token3.Wait()
-		})
-
+	if worker != nil {
+		if worker.a.Total != len(devices) {
+			fmt.Println(fmt.Sprintf("worker error: coordinator has %d beds, this worker's device list has %d", worker.a.Total, len(devices)))
+			os.Exit(1)
+		}
+		devices = devices[worker.a.Offset : worker.a.Offset+worker.a.Count]
+		topology.offset = worker.a.Offset
 	}
-}
 
-func sendAdaptiveActive(mqttClientMap map[string]MQTT.Client, p *ants.Pool) {
-	for mac, client := range mqttClientMap {
-		log.Println(fmt.Sprintf("public send8E,mac=%s,cmd=%X", mac, 0x97))
-		buffer := bytes.NewBuffer(make([]byte, 0))
-		buffer.WriteByte(0x97)
-		buffer.WriteByte(0x01)
-		jsonStr := `{"head": {"val": 20, "airbag": [0]}, "shoulder": {"val": 5, "airbag": [1]}, "back": {"val": 5, "airbag": [2, 3]}, "upper_waist": {"val": 40, "airbag": [4, 5]}, "lower_waist": {"val": 40, "airbag": [6]}, "hip": {"val": 5, "airbag": [7, 8, 9]}, "leg": {"val": 40, "airbag": [10, 11]}}`
-		buffer.WriteString(jsonStr)
-		bs := buffer.Bytes()
-		encryptedData, _ := encryption.Encrypt(bs)
-		p.Submit(func() {
-			token := client.Publish(fmt.Sprintf(bodyInfoPubTopic, mac), 0, false, encryptedData)
-			token.Wait()
-		})
-
-		buffer2 := bytes.NewBuffer(make([]byte, 0))
-		buffer2.WriteByte(0x97)
-		buffer2.WriteByte(0x02)
-		jsonStr2 := `{"head": {"val": 20, "airbag": [0]}, "shoulder": {"val": 5, "airbag": [1]}, "back": {"val": 5, "airbag": [2, 3]}, "upper_waist": {"val": 40, "airbag": [4, 5]}, "lower_waist": {"val": 40, "airbag": [6]}, "hip": {"val": 5, "airbag": [7, 8, 9]}, "leg": {"val": 40, "airbag": [10, 11]}}`
-		buffer2.WriteString(jsonStr2)
-		bs2 := buffer2.Bytes()
-		encryptedData2, _ := encryption.Encrypt(bs2)
-		p.Submit(func() {
-			token2 := client.Publish(fmt.Sprintf(bodyInfoPubTopic, mac), 0, false, encryptedData2)
-			token2.Wait()
-		})
+	if *offline {
+		begin := time.Now()
+		if *from != "" {
+			begin, err = time.Parse(time.RFC3339, *from)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		if *duration <= 0 {
+			*duration = time.Hour
+		}
+		if err := runOffline(devices, begin, begin.Add(*duration), *outDir, *outFormat); err != nil {
+			fmt.Println("offline error:", err)
+			os.Exit(1)
+		}
+		return
 	}
-}
 
-func sendBodyshape(mqttClientMap map[string]MQTT.Client, p *ants.Pool) {
-	for mac, client := range mqttClientMap {
-		log.Println(fmt.Sprintf("public send8E,mac=%s,cmd=%X", mac, 0x8E))
-		buffer := bytes.NewBuffer(make([]byte, 0))
-		buffer.WriteByte(0x95)
-		buffer.WriteByte(0x01)
-		jsonStr := `{"number": 59, "spine_x": [0, 2.0, 4.0, 5.99, 7.99, 9.99, 11.99, 13.98, 15.98, 17.98, 19.98, 21.98, 23.97, 25.97, 27.96, 29.96, 31.95, 33.94, 35.94, 37.93, 39.93, 41.93, 43.92, 45.92, 47.9, 49.9, 51.87, 53.86, 55.86, 57.85, 59.85, 61.85, 63.85, 65.85, 67.83, 69.8, 71.76, 73.7, 75.64, 77.58, 79.55, 81.51, 83.5, 85.49, 87.49, 89.49, 91.49, 93.49, 95.49, 97.49, 99.49, 101.49, 103.49, 105.48, 107.48, 109.48, 111.48, 113.48, 115.48], "spine_y": [0, 0.01, 0.0, -0.16, -0.33, -0.37, -0.41, -0.47, -0.42, -0.43, -0.32, -0.31, -0.12, -0.0, 0.18, 0.31, 0.5, 0.67, 0.79, 0.97, 1.0, 1.09, 1.01, 0.92, 0.65, 0.48, 0.15, -0.01, -0.17, -0.28, -0.34, -0.4, -0.32, -0.17, 0.09, 0.44, 0.84, 1.31, 1.79, 2.28, 2.65, 3.02, 3.22, 3.39, 3.5, 3.59, 3.68, 3.75, 3.73, 3.74, 3.72, 3.69, 3.64, 3.58, 3.5, 3.46, 3.38, 3.33, 3.26], "peak_chest": 0.0, "peak_waist": 0.0, "peak_hip": 0.0}`
-		buffer.WriteString(jsonStr)
-		bs := buffer.Bytes()
-		encryptedData, _ := encryption.Encrypt(bs)
-		p.Submit(func() {
-			token := client.Publish(fmt.Sprintf(bodyInfoPubTopic, mac), 0, false, encryptedData)
-			token.Wait()
-		})
-
-		buffer2 := bytes.NewBuffer(make([]byte, 0))
-		buffer2.WriteByte(0x95)
-		buffer2.WriteByte(0x02)
-		jsonStr2 := `{"number": 59, "spine_x": [0, 2.0, 4.0, 5.99, 7.99, 9.99, 11.99, 13.98, 15.98, 17.98, 19.98, 21.98, 23.97, 25.97, 27.96, 29.96, 31.95, 33.94, 35.94, 37.93, 39.93, 41.93, 43.92, 45.92, 47.9, 49.9, 51.87, 53.86, 55.86, 57.85, 59.85, 61.85, 63.85, 65.85, 67.83, 69.8, 71.76, 73.7, 75.64, 77.58, 79.55, 81.51, 83.5, 85.49, 87.49, 89.49, 91.49, 93.49, 95.49, 97.49, 99.49, 101.49, 103.49, 105.48, 107.48, 109.48, 111.48, 113.48, 115.48], "spine_y": [0, 0.01, 0.0, -0.16, -0.33, -0.37, -0.41, -0.47, -0.42, -0.43, -0.32, -0.31, -0.12, -0.0, 0.18, 0.31, 0.5, 0.67, 0.79, 0.97, 1.0, 1.09, 1.01, 0.92, 0.65, 0.48, 0.15, -0.01, -0.17, -0.28, -0.34, -0.4, -0.32, -0.17, 0.09, 0.44, 0.84, 1.31, 1.79, 2.28, 2.65, 3.02, 3.22, 3.39, 3.5, 3.59, 3.68, 3.75, 3.73, 3.74, 3.72, 3.69, 3.64, 3.58, 3.5, 3.46, 3.38, 3.33, 3.26], "peak_chest": 0.0, "peak_waist": 0.0, "peak_hip": 0.0}`
-		buffer2.WriteString(jsonStr2)
-		bs2 := buffer2.Bytes()
-		encryptedData2, _ := encryption.Encrypt(bs2)
-		p.Submit(func() {
-			token2 := client.Publish(fmt.Sprintf(bodyInfoPubTopic, mac), 0, false, encryptedData2)
-			token2.Wait()
-		})
+	broker.tls, err = tlsOpts.Load()
+	if err != nil {
+		fmt.Println("tls config error:", err)
+		os.Exit(1)
 	}
-}
-
-func sendPosture(mqttClientMap map[string]MQTT.Client, p *ants.Pool) {
-	for mac, client := range mqttClientMap {
-		log.Println(fmt.Sprintf("public sendPosture,mac=%s,cmd=%X", mac, 0x91))
-		buffer := bytes.NewBuffer(make([]byte, 0))
-		buffer.WriteByte(0x93)
-		buffer.WriteByte(0x01)
-		dataMap := make(map[string]any)
-		dataMap["posture"] = randInt(0, 7)
-		bytedata, _ := json.Marshal(dataMap)
-		buffer.Write(bytedata)
-		bs := buffer.Bytes()
-		encryptedData, _ := encryption.Encrypt(bs)
-		p.Submit(func() {
-			token := client.Publish(fmt.Sprintf(bodyInfoPubTopic, mac), 0, false, encryptedData)
-			token.Wait()
-		})
-
-		buffer2 := bytes.NewBuffer(make([]byte, 0))
-		buffer2.WriteByte(0x93)
-		buffer2.WriteByte(0x02)
-		dataMap2 := make(map[string]any)
-		dataMap2["posture"] = randInt(0, 7)
-		bytedata2, _ := json.Marshal(dataMap2)
-		buffer2.Write(bytedata2)
-		bs2 := buffer2.Bytes()
-		encryptedData2, _ := encryption.Encrypt(bs2)
-		p.Submit(func() {
-			token2 := client.Publish(fmt.Sprintf(bodyInfoPubTopic, mac), 0, false, encryptedData2)
-			token2.Wait()
-		})
+	broker.shard.wsPath = broker.protocol.WSPath
+	if err := broker.shard.parse(broker.url); err != nil {
+		fmt.Println("broker config error:", err)
+		os.Exit(1)
 	}
-}
-
-func sendMovement(mqttClientMap map[string]MQTT.Client, p *ants.Pool) {
-	for mac, client := range mqttClientMap {
-		log.Println(fmt.Sprintf("public sendMovement,mac=%s,cmd=%X", mac, 0x91))
-		buffer := bytes.NewBuffer(make([]byte, 0))
-		buffer.WriteByte(0x91)
-		buffer.WriteByte(0x01)
-		dataMap := make(map[string]any)
-		dataMap["movement"] = randInt(0, 2)
-		bytedata, _ := json.Marshal(dataMap)
-		buffer.Write(bytedata)
-		bs := buffer.Bytes()
-		encryptedData, _ := encryption.Encrypt(bs)
-		p.Submit(func() {
-			token := client.Publish(fmt.Sprintf(bodyInfoPubTopic, mac), 0, false, encryptedData)
-			token.Wait()
-		})
-
-		buffer2 := bytes.NewBuffer(make([]byte, 0))
-		buffer2.WriteByte(0x91)
-		buffer2.WriteByte(0x02)
-		dataMap2 := make(map[string]any)
-		dataMap2["movement"] = randInt(0, 2)
-		bytedata2, _ := json.Marshal(dataMap2)
-		buffer2.Write(bytedata2)
-		bs2 := buffer2.Bytes()
-		encryptedData2, _ := encryption.Encrypt(bs2)
-		p.Submit(func() {
-			token2 := client.Publish(fmt.Sprintf(bodyInfoPubTopic, mac), 0, false, encryptedData2)
-			token2.Wait()
-		})
+	if broker.tls != nil && !slices.ContainsFunc(broker.shard.urls, mqttclient.UsesTLS) {
+		fmt.Println("tls config error: -tls* flags need an ssl://, mqtts:// or wss:// broker url")
+		os.Exit(1)
 	}
-}
-
-func send8E(mqttClientMap map[string]MQTT.Client, p *ants.Pool) {
-	for mac, client := range mqttClientMap {
-		log.Println(fmt.Sprintf("public send8E,mac=%s,cmd=%X", mac, 0x8E))
-		buffer := bytes.NewBuffer(make([]byte, 0))
-		buffer.WriteByte(0x8E)
-		buffer.WriteByte(0x01)
-		jsonStr := `{
-	"supine": {
-		"head": {
-			"hit": [
-				[3, 1],
-				[4, -1]
-			],
-			"val": [20, -1]
-		},
-		"shoulder": {
-			"hit": [
-				[1, 1],
-				[2, -1],
-				[5, 1]
-			],
-			"val": [40, 1]
-		},
-		"back": {
-			"hit": [],
-			"val": [30, 0]
-		},
-		"upper_waist": {
-			"hit": [
-				[1, 1],
-				[2, -1],
-				[5, 1]
-			],
-			"val": [40, 1]
-		},
-		"lower_waist": {
-			"hit": [
-				[1, 1],
-				[2, -1],
-				[5, 1]
-			],
-			"val": [40, 1]
-		},
-		"hip": {
-			"hit": [
-				[1, 1],
-				[2, -1],
-				[5, 1]
-			],
-			"val": [40, 1]
-		},
-		"leg": {
-			"hit": [
-				[1, 1],
-				[2, -1],
-				[5, 1]
-			],
-			"val": [40, 1]
+	if err := broker.shard.assign(devices); err != nil {
+		fmt.Println("broker config error:", err)
+		os.Exit(1)
+	}
+	if err := broker.impair.parse(); err != nil {
+		fmt.Println("netem config error:", err)
+		os.Exit(1)
+	}
+	if err := broker.qos.parse(); err != nil {
+		fmt.Println("qos config error:", err)
+		os.Exit(1)
+	}
+	if recentSize < 0 {
+		fmt.Println("control config error: recentMessages can't be negative")
+		os.Exit(1)
+	}
+	if err := topology.validate(); err != nil {
+		fmt.Println("topology config error:", err)
+		os.Exit(1)
+	}
+	if err := schedule.validate(); err != nil {
+		fmt.Println("schedule config error:", err)
+		os.Exit(1)
+	}
+	if err := validatePolicy(*backpressure); err != nil {
+		fmt.Println("backpressure config error:", err)
+		os.Exit(1)
+	}
+	if err := rate.parse(); err != nil {
+		fmt.Println("rate config error:", err)
+		os.Exit(1)
+	}
+	if worker != nil {
+		rate.scale = float64(worker.a.Count) / float64(worker.a.Total)
+	}
+	if rate.enabled() && schedule.mode != scheduleSpread {
+		fmt.Println("rate config error: -rate and -rateProfile need -schedule spread")
+		os.Exit(1)
+	}
+	if *duration == 0 {
+		*duration = rate.length()
+	}
+	if err := churn.validate(); err != nil {
+		fmt.Println("churn config error:", err)
+		os.Exit(1)
+	}
+	if topology.mode == topologyMux && (churn.mtbf > 0 || outage.at > 0) {
+		fmt.Println("topology config error: mux connections are shared between beds, churn and outage scenarios need separate or shared")
+		os.Exit(1)
+	}
+	if outage.at > 0 {
+		if err := outage.validate(); err != nil {
+			fmt.Println("outage config error:", err)
+			os.Exit(1)
 		}
-	},
-	"lateral": {
-		"head": {
-			"hit": [
-				[3, 1],
-				[4, -1]
-			],
-			"val": [20, -1]
-		},
-		"shoulder": {
-			"hit": [
-				[1, 1],
-				[2, -1],
-				[5, 1]
-			],
-			"val": [40, 1]
-		},
-		"back": {
-			"hit": [],
-			"val": [30, 0]
-		},
-		"upper_waist": {
-			"hit": [
-				[1, 1],
-				[2, -1],
-				[5, 1]
-			],
-			"val": [40, 1]
-		},
-		"lower_waist": {
-			"hit": [
-				[1, 1],
-				[2, -1],
-				[5, 1]
-			],
-			"val": [40, 1]
-		},
-		"hip": {
-			"hit": [
-				[1, 1],
-				[2, -1],
-				[5, 1]
-			],
-			"val": [40, 1]
-		},
-		"leg": {
-			"hit": [
-				[1, 1],
-				[2, -1],
-				[5, 1]
-			],
-			"val": [40, 1]
+		if churn.mtbf > 0 {
+			fmt.Println("outage config error: -outageAt can't be combined with -churnMTBF")
+			os.Exit(1)
 		}
 	}
-}`
-		buffer.WriteString(jsonStr)
-		bs := buffer.Bytes()
-		encryptedData, _ := encryption.Encrypt(bs)
-
-		p.Submit(func() {
-			token := client.Publish(fmt.Sprintf(bodyInfoPubTopic, mac), 0, false, encryptedData)
-			token.Wait()
-		})
-
-		buffer2 := bytes.NewBuffer(make([]byte, 0))
-		buffer2.WriteByte(0x8E)
-		buffer2.WriteByte(0x01)
-		buffer2.WriteString(jsonStr)
-		bs2 := buffer2.Bytes()
-		encryptedData2, _ := encryption.Encrypt(bs2)
-		p.Submit(func() {
-			token2 := client.Publish(fmt.Sprintf(bodyInfoPubTopic, mac), 0, false, encryptedData2)
-			token2.Wait()
-		})
-	}
-}
-
-func sendGET_ALGOR_ALL_STATUS(mqttClientMap map[string]MQTT.Client, p *ants.Pool) {
-	for mac, client := range mqttClientMap {
-		p.Submit(func() {
-			log.Println(fmt.Sprintf("public GET_ALGOR_ALL_STATUS,mac=%s,cmd=%X", mac, 0xb1))
-			buffer := bytes.NewBuffer(make([]byte, 0))
-			buffer.WriteByte(0xb1)
-			buffer.WriteByte(0x00)
-
-			dataMap := make(map[string]any)
-			dataMap["pillowFlag"] = 1
-			dataMap["adaptiveMode"] = 1
-			dataMap["shieldAdaptive"] = 1
-			dataMap["floatingMode"] = 1
-			dataMap["welcomeMode"] = 1
-			dataMap["runStatus"] = 1
-			dataMap["posture"] = 1
-			dataMap["bedExitStatus"] = 1
-			dataMap["bedModel"] = "EK-E"
-			dataMap["firmwareVersion"] = "M001-V1.3.01-2025-01-16 17:28:33"
-			dataMap["storage"] = "1024 MB"
-			bytedata, _ := json.Marshal(dataMap)
 
-			buffer.Write(bytedata)
-
-			bs := buffer.Bytes()
-			encryptedData, _ := encryption.Encrypt(bs)
-			token := client.Publish(fmt.Sprintf(serverAckPubTopic, mac), 0, false, encryptedData)
-			token.Wait()
-		})
+	if dist.addr != "" {
+		if dist.workers > len(devices) {
+			fmt.Println("coordinator config error: more workers than beds")
+			os.Exit(1)
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		runCoordinator(ctx, dist, len(devices), *reportPath, *metricsAddr)
+		stop()
+		return
 	}
-}
 
-func sendGET_HARDWARE_ALL_STATUS(mqttClientMap map[string]MQTT.Client, p *ants.Pool) {
-	for mac, client := range mqttClientMap {
-		p.Submit(func() {
-			log.Println(fmt.Sprintf("public GET_HARDWARE_ALL_STATUS,mac=%s,cmd=%X", mac, 0xb3))
-			buffer := bytes.NewBuffer(make([]byte, 0))
-			buffer.WriteByte(0xb3)
-			buffer.WriteByte(0x00)
-			buffer.WriteByte(0x01)
-			buffer.WriteByte(0x05)
-			buffer.WriteString("qrem_guestqrem_guestqrem_guest0")
-			buffer.WriteByte(0x00)
-			buffer.WriteByte(0x01)
-
-			bs := buffer.Bytes()
-			encryptedData, _ := encryption.Encrypt(bs)
-			token := client.Publish(fmt.Sprintf(serverAckPubTopic, mac), 0, false, encryptedData)
-			token.Wait()
-		})
-	}
-}
+	beds := topology.connect(devices)
+	fl := newFleet(beds)
 
-func sendMPR(mqttClientMap map[string]MQTT.Client, p *ants.Pool) {
-	for mac, client := range mqttClientMap {
-		p.Submit(func() {
-			log.Println(fmt.Sprintf("public sendMPR,mac=%s,cmd=%X", mac, 0x70))
-			bs, _ := hex.DecodeString("700a0100199c230019a725001993a30024612900245273002460d8002451f400245b150024558d002462e40022bc9600245f1a00244a9a00245f6e001c69aa")
-			encryptedData, _ := encryption.Encrypt(bs)
-			token := client.Publish(fmt.Sprintf(hardwarePubTopic, mac), 0, false, encryptedData)
-			token.Wait()
-		})
-
-		p.Submit(func() {
-			log.Println(fmt.Sprintf("public sendMPR,mac=%s,cmd=%X", mac, 0x70))
-			bs2, _ := hex.DecodeString("7009010019c3cc001e1a05001da12700263da7002619b000263c5e001d6bda001da1b80024752f00244b64002444330024b9a3001a18ae0019cb6d0019d4b7")
-			encryptedData2, _ := encryption.Encrypt(bs2)
-			token2 := client.Publish(fmt.Sprintf(hardwarePubTopic, mac), 0, false, encryptedData2)
-			token2.Wait()
-		})
+	size := len(beds)
+	fmt.Printf("start %d beds", size)
+	fmt.Println()
 
+	// 控制接口加入设备时要扩大协程池，预分配的协程池不能调整大小（Tune 不生效）
+	poolOpts := []ants.Option{ants.WithNonblocking(false)}
+	if *controlAddr == "" {
+		poolOpts = append(poolOpts, ants.WithPreAlloc(true))
 	}
-}
-
-func randInt(min, max int) int {
-	return min + rand.Intn(max-min)
-}
-
-func sendErrorCode(mqttClientMap map[string]MQTT.Client, p *ants.Pool) {
-	for mac, client := range mqttClientMap {
-		p.Submit(func() {
-			log.Println(fmt.Sprintf("send errorCode %s", mac))
-			now := time.Now()
-			yearStr := strconv.Itoa(now.Year())
-			yearLastTwo, _ := strconv.Atoi(yearStr[len(yearStr)-2:])
-			bs := []byte{0xec, 4, byte(randInt(0x01, 0x04)), 1, byte(randInt(0x01, 0x0f)), byte(yearLastTwo), byte(now.Month()), byte(now.Day()), byte(now.Hour()), byte(now.Minute()), byte(now.Second())}
-			encryptedData, err := encryption.Encrypt(bs)
-			if err != nil {
-				fmt.Println("Encrypt error:", err)
-			}
-			token := client.Publish(fmt.Sprintf(productionTestPubTopic, mac), 0, false, encryptedData)
-			token.Wait()
-		})
+	p, _ := ants.NewPool(size*10, poolOpts...)
+	if *queueSize <= 0 {
+		*queueSize = p.Cap()
 	}
-}
-
-func sendHardWarePressurePad(mqttClientMap map[string]MQTT.Client, p *ants.Pool) {
-	for mac, client := range mqttClientMap {
-		p.Submit(func() {
-			log.Println(fmt.Sprintf("public topic=hardware,mac=%s,cmd=%X", mac, 0x71))
-			newBuffer := bytes.NewBuffer(make([]byte, 0))
-			newBuffer.WriteByte(0x71)
-			newBuffer.WriteByte(0x01)
-			for range 1024 {
-				newBuffer.WriteByte(byte(randInt(0, 126)))
-			}
-			dataArr := newBuffer.Bytes()
-			encryptedData, _ := encryption.Encrypt(dataArr)
-			token := client.Publish(fmt.Sprintf(pressurePubTopic, mac), 0, false, encryptedData)
-			token.Wait()
-		})
-		p.Submit(func() {
-			newBuffer2 := bytes.NewBuffer(make([]byte, 0))
-			newBuffer2.WriteByte(0x71)
-			newBuffer2.WriteByte(0x02)
-			for range 1024 {
-				newBuffer2.WriteByte(byte(randInt(0, 80)))
-			}
-			dataArr2 := newBuffer2.Bytes()
-			encryptedData2, _ := encryption.Encrypt(dataArr2)
-			token2 := client.Publish(fmt.Sprintf(pressurePubTopic, mac), 0, false, encryptedData2)
-			token2.Wait()
-		})
-
+	d := newDispatcher(*backpressure, p, *queueSize)
+	metrics.watch(fl.clients, p)
+	metrics.serve(*metricsAddr)
+
+	// 所有工作进程的床都连接后同时开始
+	if worker != nil {
+		if err := worker.waitStart(); err != nil {
+			fmt.Println("worker error:", err)
+			os.Exit(1)
+		}
+		runStats.start = time.Now()
 	}
-}
 
-func sendHardWareAirPumpCurrent(mqttClientMap map[string]MQTT.Client, p *ants.Pool) {
-	for mac, client := range mqttClientMap {
-		p.Submit(func() {
-			log.Println(fmt.Sprintf("public topic=hardware,mac=%s,cmd=%X", mac, 0x73))
-			bs := []byte{0x73, 4, byte(randInt(0, 1000)), byte(randInt(0, 1000)), 0, 0, byte(randInt(0, 1000)), byte(randInt(0, 1000))}
-			encryptedData, _ := encryption.Encrypt(bs)
-			token := client.Publish(fmt.Sprintf(hardwarePubTopic, mac), 0, false, encryptedData)
-			token.Wait()
-		})
+	// Ctrl-C、SIGTERM、到达 -duration 或协调者要求停止时退出
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if worker != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		worker.cancel = cancel
 	}
-}
-
-func sendHardWareSolenoidValveTemperature(mqttClientMap map[string]MQTT.Client, p *ants.Pool) {
-	for mac, client := range mqttClientMap {
-		p.Submit(func() {
-			log.Println(fmt.Sprintf("public topic=hardware,mac=%s,cmd=%X", mac, 0x75))
-			bs := []byte{0x75, 1, byte(randInt(10, 60)), byte(randInt(10, 60)), byte(randInt(10, 60))}
-			encryptedData, _ := encryption.Encrypt(bs)
-			token := client.Publish(fmt.Sprintf(hardwarePubTopic, mac), 0, false, encryptedData)
-			token.Wait()
-		})
-		p.Submit(func() {
-			log.Println(fmt.Sprintf("public topic=hardware,mac=%s,cmd=%X", mac, 0x75))
-			bs2 := []byte{0x75, 2, byte(randInt(10, 80)), byte(randInt(10, 80)), byte(randInt(10, 80))}
-			encryptedData2, _ := encryption.Encrypt(bs2)
-			token2 := client.Publish(fmt.Sprintf(hardwarePubTopic, mac), 0, false, encryptedData2)
-			token2.Wait()
-		})
+	if *duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
 	}
-}
 
-func sendHardWareSolenoidValveCurrent(mqttClientMap map[string]MQTT.Client, p *ants.Pool) {
-	for mac, client := range mqttClientMap {
-		p.Submit(func() {
-			log.Println(fmt.Sprintf("public topic=hardware,mac=%s,cmd=%X", mac, 0x74))
-			bs, _ := hex.DecodeString("7401000000000000")
-			encryptedData, _ := encryption.Encrypt(bs)
-			token := client.Publish(fmt.Sprintf(hardwarePubTopic, mac), 0, false, encryptedData)
-			token.Wait()
-		})
-
-		p.Submit(func() {
-			log.Println(fmt.Sprintf("public topic=hardware,mac=%s,cmd=%X", mac, 0x74))
-			bs2, _ := hex.DecodeString("7402000000000000")
-			encryptedData2, _ := encryption.Encrypt(bs2)
-			token2 := client.Publish(fmt.Sprintf(hardwarePubTopic, mac), 0, false, encryptedData2)
-			token2.Wait()
-		})
+	// Start the Scheduler
+	scheduler := tasks.New()
 
+	if rate.enabled() {
+		schedule.rate = newRateController(&rate, nominalRate(beds, rate.bytes))
 	}
-}
+	publishing := schedule.start(fl, scheduler, d)
+	control := &controlServer{fleet: fl, plan: publishing, pool: p, topology: topology, ids: &idOpts, next: end}
+	control.serve(*controlAddr)
 
-func sendHardWareMotherboardTemperature(mqttClientMap map[string]MQTT.Client, p *ants.Pool) {
-	for mac, client := range mqttClientMap {
-		p.Submit(func() {
-			log.Println(fmt.Sprintf("public topic=hardware,mac=%s,cmd=%X", mac, 0x76))
-			bs, _ := hex.DecodeString("7601018a01790121026b03ff")
-			encryptedData, _ := encryption.Encrypt(bs)
-			token := client.Publish(fmt.Sprintf(hardwarePubTopic, mac), 0, false, encryptedData)
-			token.Wait()
-		})
-
-		p.Submit(func() {
-			log.Println(fmt.Sprintf("public topic=hardware,mac=%s,cmd=%X", mac, 0x76))
-			bs2, _ := hex.DecodeString("76020241022b017c01f30267")
-			encryptedData2, _ := encryption.Encrypt(bs2)
-			t2 := client.Publish(fmt.Sprintf(hardwarePubTopic, mac), 0, false, encryptedData2)
-			_ = t2.Wait() // Can also use '<-t.Done()' in releases > 1.2.0
-			if t2.Error() != nil {
-				log.Println(t2.Error()) // Use your preferred logging technique (or just fmt.Printf)
+	scheduler.Add(&tasks.Task{
+		Interval: 1 * time.Second,
+		TaskFunc: func() error {
+			fmt.Println(fmt.Sprintf("cap=%d,free=%d,waiting=%d,running=%d,queued=%d,dropped=%d,late=%d,", p.Cap(), p.Free(), p.Waiting(), p.Running(), d.queued(), runStats.dropped.Load(), runStats.late.Load()))
+			conns := fl.clients()
+			runTimeline.sample(conns, p)
+			if worker != nil {
+				go worker.push()
+			}
+			if len(broker.shard.urls) > 1 {
+				for _, line := range broker.shard.report(conns) {
+					fmt.Println(line)
+				}
+			}
+			if schedule.rate != nil {
+				fmt.Println(schedule.rate.update())
 			}
-		})
+			if churn.mtbf > 0 {
+				fmt.Println(fmt.Sprintf("online=%d,offlineEvents=%d,onlineEvents=%d,reconnectErrors=%d", onlineBeds(fl.list()), churnStats.offline.Load(), churnStats.online.Load(), churnStats.reconnectErrs.Load()))
+			}
+			return nil
+		},
+	})
 
+	if churn.mtbf > 0 {
+		runChurn(ctx, beds, churn)
+	}
+	// 断电风暴在退出前结束，避免正在重连的床和 shutdown 同时操作连接
+	var storming sync.WaitGroup
+	if outage.at > 0 {
+		storming.Add(1)
+		go func() {
+			defer storming.Done()
+			runStorm(ctx, beds, outage)
+		}()
 	}
-}
 
-func getMqttClient(mac string) MQTT.Client {
-	opts := MQTT.NewClientOptions().AddBroker(brokerHost) // 创建 MQTT 客户端选项
-	opts.SetUsername(username)                            // 设置用户名
-	opts.SetPassword(pwd)                                 // 设置密码
-	opts.SetClientID(mac)                                 // 设置客户端ID
-	opts.OnConnect = onConnnect                           // 设置连接处理器
-
-	client := MQTT.NewClient(opts)                                       // 创建 MQTT 客户端实例
-	if token := client.Connect(); token.Wait() && token.Error() != nil { // 连接到 MQTT 代理
-		log.Println("can't connect to broker.")
-		panic(token.Error())
-	}
-	if client.IsConnected() {
-		log.Println("Connect to broker successed. ")
-		if t := client.Subscribe(fmt.Sprintf(controlSubTopic, mac), 0, controlMsgRecHandler); t.Wait() && t.Error() != nil {
-			log.Println("Can't not subscribe " + fmt.Sprintf(controlSubTopic, mac) + " topic.")
-			panic(t.Error())
+	<-ctx.Done()
+	storming.Wait()
+	shutdown(fl, scheduler, publishing, d, p)
+	if schedule.rate != nil {
+		schedule.rate.print()
+	}
+	if *reportPath != "" || worker != nil {
+		r, err := buildReport(fl, topology.mode, schedule, churn.mtbf > 0)
+		if err == nil && *reportPath != "" {
+			err = r.write(*reportPath)
 		}
-		if t := client.Subscribe(fmt.Sprintf(getBedStatusSubTopic, mac), 0, controlMsgRecHandler); t.Wait() && t.Error() != nil {
-			log.Println("Can't not subscribe " + fmt.Sprintf(getBedStatusSubTopic, mac) + " topic.")
-			panic(t.Error())
+		if err == nil && worker != nil {
+			err = worker.finish(r)
+		}
+		if err != nil {
+			fmt.Println("report error:", err)
 		}
-		log.Println("Start subscribe  topic.")
 	}
-	return client
 }
 
-func getOtaMqttClient(mac string) MQTT.Client {
-	opts := MQTT.NewClientOptions().AddBroker(brokerHost) // 创建 MQTT 客户端选项
-	opts.SetUsername(username)                            // 设置用户名
-	opts.SetPassword(pwd)                                 // 设置密码
-	opts.SetClientID(mac)                                 // 设置客户端ID
-	opts.OnConnect = onConnnect2                          // 设置连接处理器
-
-	client := MQTT.NewClient(opts)                                       // 创建 MQTT 客户端实例
-	if token := client.Connect(); token.Wait() && token.Error() != nil { // 连接到 MQTT 代理
-		log.Println("can't connect to broker.")
-		panic(token.Error())
-	}
-	if client.IsConnected() {
-		log.Println("Connect to broker successed. ")
-		if t := client.Subscribe(fmt.Sprintf(otaSubTopic, mac), 0, controlMsgRecHandler); t.Wait() && t.Error() != nil {
-			log.Println("Can't not subscribe " + fmt.Sprintf(otaSubTopic, mac) + " topic.")
-			panic(t.Error())
-		}
-		log.Println("Start subscribe  topic.")
+// 停止生成数据，等待已提交的发布完成，断开所有客户端并输出运行总结
+func shutdown(fl *fleet, scheduler *tasks.Scheduler, publishing *plan, d *dispatcher, p *ants.Pool) {
+	fmt.Println("shutting down...")
+	publishing.stop()
+	scheduler.Stop()
+	d.close()
+	if err := p.ReleaseTimeout(10 * time.Second); err != nil {
+		fmt.Println("drain publish pool:", err)
 	}
-	return client
-}
 
-// 连接处理器函数
-func onConnnect(client MQTT.Client) {
+	for _, b := range fl.list() {
+		b.online.Store(false)
+	}
+	var wg sync.WaitGroup
+	for _, c := range fl.clients() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Disconnect(250 * time.Millisecond)
+		}()
+	}
+	wg.Wait()
+	runStats.print(fl.connections())
+	broker.shard.print(nil)
 }
 
-// 连接处理器函数
-func onConnnect2(client MQTT.Client) {
+func randInt(min, max int) int {
+	return min + rand.Intn(max-min)
 }
 
 // 消息接收处理器函数
-func controlMsgRecHandler(client MQTT.Client, msg MQTT.Message) {
-	payload := msg.Payload()
+func controlMsgRecHandler(client mqttclient.Client, msg mqttclient.Message) {
+	received := time.Now()
+	payload := msg.Payload
 	// log.Printf("Recv msg : %s\n", payload) // 打印接收到的消息
-	topic := msg.Topic()
+	topic := msg.Topic
 	topicItem := strings.Split(topic, "/")
 	mac := topicItem[1]
 	name := topicItem[2]
@@ -830,22 +452,26 @@ func controlMsgRecHandler(client MQTT.Client, msg MQTT.Message) {
 	cmd, _ := buffer.ReadByte()
 	opt, _ := buffer.ReadByte()
 	log.Println(fmt.Sprintf("recv topic=%s,mac=%s,cmd=%X,opt=%X", name, mac, cmd, opt))
+	traffic.emit(kindCommand, mac, newRecentMsg(received, name, topic, decryptedData, nil))
+	if s := activeStorm.Load(); s != nil {
+		s.observe(mac, cmd)
+	}
 
 	if strings.EqualFold("control", name) {
 		// 版本号查询
 		if cmd == 0xA0 {
-			versionData, _ := hex.DecodeString("a004ff204d3030312d56312e332e30312d323032352d30312d31362031373a32383a3333030100010301000106010202010001")
-			encryptedData, err := encryption.Encrypt(versionData)
-			if err != nil {
-				fmt.Println("Encrypt error:", err)
-			}
-			// 发布响应消息
-			t := client.Publish(fmt.Sprintf(serverAckPubTopic, mac), 0, false, encryptedData)
+			// 版本号不变，使用启动时加密好的数据
+			encryptedData := versionFrame.enc
+			// 发布响应消息，不能在接收协程中等待确认
 			go func() {
-				_ = t.Wait() // Can also use '<-t.Done()' in releases > 1.2.0
-				if t.Error() != nil {
-					log.Println(t.Error()) // Use your preferred logging technique (or just fmt.Printf)
+				ackTopic := fmt.Sprintf(serverAckPubTopic, mac)
+				err := publish(client, statServerAck, mac, ackTopic, encryptedData)
+				if err != nil {
+					log.Println(err)
+				} else {
+					metrics.command(cmd, time.Since(received))
 				}
+				traffic.emit(kindAck, mac, newRecentMsg(time.Now(), statServerAck, ackTopic, versionFrame.data, err))
 				log.Println(fmt.Sprintf("public topic=server_ack,mac=%s,cmd=%X", mac, 0xA0))
 			}()
 		}
@@ -870,36 +496,19 @@ func controlMsgRecHandler(client MQTT.Client, msg MQTT.Message) {
 			if err != nil {
 				fmt.Println("Encrypt error:", err)
 			}
-			t := client.Publish(fmt.Sprintf(serverAckPubTopic, mac), 0, false, encryptedData) // 发布响应消息
 			go func() {
-				_ = t.Wait() // Can also use '<-t.Done()' in releases > 1.2.0
-				if t.Error() != nil {
-					log.Println(t.Error()) // Use your preferred logging technique (or just fmt.Printf)
+				// 发布响应消息
+				ackTopic := fmt.Sprintf(serverAckPubTopic, mac)
+				err := publish(client, statServerAck, mac, ackTopic, encryptedData)
+				if err != nil {
+					log.Println(err)
+				} else {
+					metrics.command(cmd, time.Since(received))
 				}
+				traffic.emit(kindAck, mac, newRecentMsg(time.Now(), statServerAck, ackTopic, dataArr, err))
 				log.Println(fmt.Sprintf("public topic=server_ack,mac=%s,cmd=%X", mac, 0xB4)) // 打印响应命令
 			}()
 
 		}
 	}
 }
-
-// 发布心跳数据包
-func sendHeartBeat(mqttClientMap map[string]MQTT.Client, p *ants.Pool) {
-	for mac, client := range mqttClientMap {
-		p.Submit(func() {
-			log.Println(fmt.Sprintf("send heartbeat %s", mac))
-
-			bs := []byte{0x55, 4}
-			encryptedData, err := encryption.Encrypt(bs)
-			if err != nil {
-				fmt.Println("Encrypt error:", err)
-			}
-
-			t := client.Publish(fmt.Sprintf(runStatusPubTopic, mac), 0, false, encryptedData)
-			_ = t.Wait() // Can also use '<-t.Done()' in releases > 1.2.0
-			if t.Error() != nil {
-				log.Println(t.Error()) // Use your preferred logging technique (or just fmt.Printf)
-			}
-		})
-	}
-}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/panjf2000/ants/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"mock-bed/pkg/mqttclient"
+)
+
+// 发布失败的原因
+const (
+	reasonTimeout = "timeout" // 超时没有得到代理确认
+	reasonError   = "error"   // 代理拒绝或连接断开等
+	reasonEncrypt = "encrypt" // 加密失败，没有发布
+)
+
+// promMetrics Prometheus 指标，-metricsAddr 为空时仍然记录，只是不对外提供
+type promMetrics struct {
+	registry  *prometheus.Registry
+	perDevice bool // 是否按设备统计，设备多时序列数很大
+
+	published       *prometheus.CounterVec
+	bytes           *prometheus.CounterVec
+	errors          *prometheus.CounterVec
+	ackLatency      *prometheus.HistogramVec
+	devicePublished *prometheus.CounterVec
+	deviceBytes     *prometheus.CounterVec
+	deviceErrors    *prometheus.CounterVec
+	commandRTT      *prometheus.HistogramVec
+	connects        prometheus.Counter
+	dropped         *prometheus.CounterVec
+	late            *prometheus.CounterVec
+}
+
+var metrics = newMetrics()
+
+func newMetrics() *promMetrics {
+	m := &promMetrics{
+		registry: prometheus.NewRegistry(),
+		published: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mock_bed_published_total",
+			Help: "Messages published and accepted by the broker, by message type.",
+		}, []string{"type"}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mock_bed_published_bytes_total",
+			Help: "Encrypted payload bytes published, by message type.",
+		}, []string{"type"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mock_bed_publish_errors_total",
+			Help: "Failed publishes by message type and reason (timeout, error, encrypt).",
+		}, []string{"type", "reason"}),
+		ackLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "mock_bed_publish_ack_seconds",
+			Help:    "Time from publish to PUBACK/PUBCOMP for QoS 1 and 2 messages.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 15),
+		}, []string{"type", "qos"}),
+		devicePublished: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mock_bed_device_published_total",
+			Help: "Messages published per device, only with -metricsPerDevice.",
+		}, []string{"mac"}),
+		deviceBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mock_bed_device_bytes_total",
+			Help: "Encrypted payload bytes published per device, only with -metricsPerDevice.",
+		}, []string{"mac"}),
+		deviceErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mock_bed_device_publish_errors_total",
+			Help: "Failed publishes per device, only with -metricsPerDevice.",
+		}, []string{"mac"}),
+		commandRTT: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "mock_bed_command_seconds",
+			Help:    "Time from receiving a command to the broker accepting the bed's reply, by command.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 15),
+		}, []string{"cmd"}),
+		connects: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "mock_bed_connects_total",
+			Help: "Successful connections, including automatic reconnects.",
+		}),
+		dropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mock_bed_dropped_total",
+			Help: "Publishes dropped because the publish pool was saturated or closed, by message type and reason.",
+		}, []string{"type", "reason"}),
+		late: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mock_bed_late_total",
+			Help: "Publishes that started more than one interval after they were due, by message type.",
+		}, []string{"type"}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.published, m.bytes, m.errors, m.ackLatency,
+		m.devicePublished, m.deviceBytes, m.deviceErrors, m.commandRTT, m.connects,
+		m.dropped, m.late,
+	)
+	return m
+}
+
+// 记录一次发布的结果，size 为负载字节数，elapsed 为等待代理确认的时间
+func (m *promMetrics) publish(name, mac string, qos byte, size int, elapsed time.Duration, err error) {
+	if err != nil {
+		reason := reasonError
+		if errors.Is(err, mqttclient.ErrTimeout) {
+			reason = reasonTimeout
+		}
+		m.errors.WithLabelValues(name, reason).Inc()
+		if m.perDevice {
+			m.deviceErrors.WithLabelValues(mac).Inc()
+		}
+		return
+	}
+	m.published.WithLabelValues(name).Inc()
+	m.bytes.WithLabelValues(name).Add(float64(size))
+	if qos > 0 {
+		m.ackLatency.WithLabelValues(name, fmt.Sprint(qos)).Observe(elapsed.Seconds())
+	}
+	if m.perDevice {
+		m.devicePublished.WithLabelValues(mac).Inc()
+		m.deviceBytes.WithLabelValues(mac).Add(float64(size))
+	}
+}
+
+// 记录加密失败
+func (m *promMetrics) encryptError(name string) {
+	m.errors.WithLabelValues(name, reasonEncrypt).Inc()
+}
+
+// 记录一条命令从收到到应答被代理确认的时间
+func (m *promMetrics) command(cmd byte, elapsed time.Duration) {
+	m.commandRTT.WithLabelValues(fmt.Sprintf("%02X", cmd)).Observe(elapsed.Seconds())
+}
+
+// 运行时才有的指标：连接数和协程池状态，conns 返回当前的所有连接
+func (m *promMetrics) watch(conns func() []mqttclient.Client, p *ants.Pool) {
+	m.registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "mock_bed_connected",
+			Help: "Clients currently connected to a broker.",
+		}, func() float64 {
+			n := 0
+			for _, c := range conns() {
+				if c.IsConnected() {
+					n++
+				}
+			}
+			return float64(n)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "mock_bed_pool_running",
+			Help: "Publish pool workers currently running.",
+		}, func() float64 { return float64(p.Running()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "mock_bed_pool_waiting",
+			Help: "Publishes waiting for a free pool worker.",
+		}, func() float64 { return float64(p.Waiting()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "mock_bed_pool_capacity",
+			Help: "Publish pool capacity.",
+		}, func() float64 { return float64(p.Cap()) }),
+	)
+}
+
+// 在 addr 上提供 /metrics，addr 为空时不启动
+func (m *promMetrics) serve(addr string) {
+	if addr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			fmt.Println("metrics server error:", err)
+			log.Println(err)
+		}
+	}()
+	fmt.Println("metrics on http://" + addr + "/metrics")
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"mock-bed/pkg/identity"
+)
+
+// 离线模式下解码后的帧，一行一条
+type frameRecord struct {
+	Ts    int64  `json:"ts"`
+	Mac   string `json:"mac"`
+	Topic string `json:"topic"`
+	Type  string `json:"type"`
+	Cmd   string `json:"cmd"`
+	Opt   string `json:"opt,omitempty"`
+	Data  string `json:"data"`
+}
+
+// 离线模式下加密后的报文，payload 为 base64
+type payloadRecord struct {
+	Ts      int64  `json:"ts"`
+	Topic   string `json:"topic"`
+	Payload string `json:"payload"`
+}
+
+// runOffline 不连接代理，按时间顺序生成 [from, to) 区间内所有床的上报数据并写入 outDir
+func runOffline(devices []identity.Device, from, to time.Time, outDir, outFormat string) error {
+	writeFrames := outFormat == "frames" || outFormat == "both"
+	writePayloads := outFormat == "payloads" || outFormat == "both"
+	if !writeFrames && !writePayloads {
+		return fmt.Errorf("unknown outFormat %q", outFormat)
+	}
+	if !to.After(from) {
+		return fmt.Errorf("empty time range %s - %s", from.Format(time.RFC3339), to.Format(time.RFC3339))
+	}
+	if err := os.MkdirAll(outDir, 0o755); err != nil {
+		return err
+	}
+
+	var frameOut, payloadOut *json.Encoder
+	// 提前返回时关闭还没有关闭的文件，正常结束时逐个关闭并检查错误
+	var closers []func() error
+	defer func() {
+		for _, closeFn := range closers {
+			closeFn()
+		}
+	}()
+	if writeFrames {
+		w, closeFn, err := createOutput(filepath.Join(outDir, "frames.jsonl"))
+		if err != nil {
+			return err
+		}
+		closers = append(closers, closeFn)
+		frameOut = json.NewEncoder(w)
+	}
+	if writePayloads {
+		w, closeFn, err := createOutput(filepath.Join(outDir, "payloads.jsonl"))
+		if err != nil {
+			return err
+		}
+		closers = append(closers, closeFn)
+		payloadOut = json.NewEncoder(w)
+	}
+
+	// 每种消息下一次触发的时间，每次取最早的一个，保证输出按时间排序
+	next := make([]time.Time, len(generators))
+	for i := range next {
+		next[i] = from.Add(generators[i].interval)
+	}
+	count := 0
+	for {
+		idx := 0
+		for i := range next {
+			if next[i].Before(next[idx]) {
+				idx = i
+			}
+		}
+		now := next[idx]
+		if !now.Before(to) {
+			break
+		}
+		g := generators[idx]
+		for _, dev := range devices {
+			for _, f := range g.build(dev, now) {
+				if frameOut != nil {
+					rec := frameRecord{
+						Ts:    now.UnixMilli(),
+						Mac:   dev.Mac,
+						Topic: f.topic,
+						Type:  g.name,
+						Cmd:   fmt.Sprintf("%02X", f.data[0]),
+						Data:  hex.EncodeToString(f.data),
+					}
+					if len(f.data) > 1 {
+						rec.Opt = fmt.Sprintf("%02X", f.data[1])
+					}
+					if err := frameOut.Encode(rec); err != nil {
+						return err
+					}
+				}
+				if payloadOut != nil {
+					encryptedData, err := f.payload()
+					if err != nil {
+						return err
+					}
+					rec := payloadRecord{
+						Ts:      now.UnixMilli(),
+						Topic:   f.topic,
+						Payload: base64.StdEncoding.EncodeToString(encryptedData),
+					}
+					if err := payloadOut.Encode(rec); err != nil {
+						return err
+					}
+				}
+				count++
+			}
+		}
+		next[idx] = now.Add(g.interval)
+	}
+	// 磁盘满时数据留在缓冲区，刷盘或关闭失败说明输出不完整
+	for len(closers) > 0 {
+		closeFn := closers[0]
+		closers = closers[1:]
+		if err := closeFn(); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("offline: %d beds, %d messages, %s - %s, written to %s\n", len(devices), count, from.Format(time.RFC3339), to.Format(time.RFC3339), outDir)
+	return nil
+}
+
+// 创建带缓冲的输出文件，closeFn 负责刷盘和关闭，返回其中第一个错误
+func createOutput(name string) (*bufio.Writer, func() error, error) {
+	file, err := os.Create(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	w := bufio.NewWriterSize(file, 1<<20)
+	return w, func() error {
+		err := w.Flush()
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	}, nil
+}
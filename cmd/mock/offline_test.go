@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"mock-bed/pkg/identity"
+)
+
+// 读取 jsonl 文件，返回每条记录的 ts
+func readTimestamps(t *testing.T, name string, each func(line []byte)) []int64 {
+	file, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var ts []int64
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var rec struct {
+			Ts int64 `json:"ts"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatal(err)
+		}
+		ts = append(ts, rec.Ts)
+		if each != nil {
+			each(scanner.Bytes())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return ts
+}
+
+func TestRunOffline(t *testing.T) {
+	dir := t.TempDir()
+	devices := []identity.Device{
+		{Mac: "BED-1", Model: identity.DefaultModel, Profile: identity.ProfileCouple},
+		{Mac: "BED-2", Model: identity.DefaultModel, Profile: identity.ProfileSingle},
+	}
+	from := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := runOffline(devices, from, from.Add(3*time.Second), dir, "both"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 每张床每个时刻的压力垫帧，72ms 一次，3 秒内触发 41 次
+	pressure := make(map[string]map[int64]bool)
+	frames := readTimestamps(t, filepath.Join(dir, "frames.jsonl"), func(line []byte) {
+		var rec frameRecord
+		json.Unmarshal(line, &rec)
+		if rec.Type == "pressure_pad" {
+			if pressure[rec.Mac] == nil {
+				pressure[rec.Mac] = make(map[int64]bool)
+			}
+			pressure[rec.Mac][rec.Ts] = true
+		}
+	})
+	payloads := readTimestamps(t, filepath.Join(dir, "payloads.jsonl"), nil)
+	if len(frames) == 0 || len(frames) != len(payloads) {
+		t.Fatalf("got %d frames and %d payloads", len(frames), len(payloads))
+	}
+	for i := range frames {
+		if frames[i] != payloads[i] {
+			t.Fatalf("record %d: frame ts %d, payload ts %d", i, frames[i], payloads[i])
+		}
+		if i > 0 && frames[i] < frames[i-1] {
+			t.Fatalf("record %d is out of order: %d after %d", i, frames[i], frames[i-1])
+		}
+	}
+	if frames[0] <= from.UnixMilli() || frames[len(frames)-1] >= from.Add(3*time.Second).UnixMilli() {
+		t.Fatalf("records outside the window: %d - %d", frames[0], frames[len(frames)-1])
+	}
+	for _, dev := range devices {
+		if n := len(pressure[dev.Mac]); n != 41 {
+			t.Errorf("%s: %d pressure pad rounds, want 41", dev.Mac, n)
+		}
+	}
+}
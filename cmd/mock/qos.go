@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"mock-bed/pkg/mqttclient"
+)
+
+// topicPolicy 一个主题的 QoS 和 retain 设置
+type topicPolicy struct {
+	qos    byte
+	retain bool
+}
+
+// qosOptions 按主题名（qrem/<mac>/ 之后的部分，如 run_status、control）设置 QoS 和 retain，
+// 发布和订阅共用，未设置的主题使用 -qos 的值且不保留
+type qosOptions struct {
+	defaultQos int
+	topics     mqttclient.Properties // 主题名 -> "qos" 或 "qos,retain"
+	policies   map[string]topicPolicy
+}
+
+func parseQos(s string) (byte, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 || n > 2 {
+		return 0, fmt.Errorf("invalid QoS %q, expected 0, 1 or 2", s)
+	}
+	return byte(n), nil
+}
+
+// 解析 -topicQos，在创建客户端之前调用
+func (o *qosOptions) parse() error {
+	if o.defaultQos < 0 || o.defaultQos > 2 {
+		return fmt.Errorf("invalid QoS %d, expected 0, 1 or 2", o.defaultQos)
+	}
+	o.policies = make(map[string]topicPolicy, len(o.topics))
+	for name, v := range o.topics {
+		q, flag, _ := strings.Cut(v, ",")
+		qos, err := parseQos(q)
+		if err != nil {
+			return fmt.Errorf("topic %s: %w", name, err)
+		}
+		if flag != "" && flag != "retain" {
+			return fmt.Errorf("topic %s: unknown option %q, expected retain", name, flag)
+		}
+		o.policies[name] = topicPolicy{qos: qos, retain: flag == "retain"}
+	}
+	return nil
+}
+
+// 主题 topic 的设置
+func (o *qosOptions) policy(topic string) topicPolicy {
+	name := topic
+	if i := strings.LastIndexByte(topic, '/'); i >= 0 {
+		name = topic[i+1:]
+	}
+	if p, ok := o.policies[name]; ok {
+		return p
+	}
+	return topicPolicy{qos: byte(o.defaultQos)}
+}
+
+// 按主题的 QoS 和 retain 发布设备 mac 的一条 name 类型消息，计入运行统计、指标和代理的统计
+func publish(client mqttclient.Client, name, mac, topic string, payload []byte) error {
+	p := broker.qos.policy(topic)
+	start := time.Now()
+	err := client.Publish(topic, p.qos, p.retain, payload)
+	runStats.publish(name, len(payload), err)
+	if err != nil {
+		errorLog.add(mac, name, err)
+	}
+	metrics.publish(name, mac, p.qos, len(payload), time.Since(start), err)
+	if st := broker.shard.stat(client); st != nil {
+		if err != nil {
+			st.errors.Add(1)
+		} else {
+			st.published.Add(1)
+		}
+	}
+	return err
+}
+
+// 按主题的 QoS 订阅
+func subscribe(client mqttclient.Client, topic string, h mqttclient.Handler) error {
+	return client.Subscribe(topic, broker.qos.policy(topic).qos, h)
+}
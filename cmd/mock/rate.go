@@ -0,0 +1,342 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 负载曲线的段类型
+const (
+	segmentRamp  = "ramp"  // ramp:1000-5000:5m 线性增长
+	segmentStep  = "step"  // step:1000-5000x5:10m 分 5 级阶梯增长
+	segmentSpike = "spike" // spike:20000:30s 短时间尖峰
+	segmentSoak  = "soak"  // soak:5000:1h 长时间恒定
+)
+
+// 每次触发最多发布的轮数，超出后目标速率无法达到
+const maxFactor = 20
+
+// rateSegment 负载曲线的一段
+type rateSegment struct {
+	kind     string
+	from, to float64
+	steps    int
+	length   time.Duration
+}
+
+// 段内 elapsed 时刻的目标速率
+func (s rateSegment) at(elapsed time.Duration) float64 {
+	frac := float64(elapsed) / float64(s.length)
+	switch s.kind {
+	case segmentRamp:
+		return s.from + (s.to-s.from)*frac
+	case segmentStep:
+		if s.steps < 2 {
+			return s.to
+		}
+		i := min(int(frac*float64(s.steps)), s.steps-1)
+		return s.from + (s.to-s.from)*float64(i)/float64(s.steps-1)
+	}
+	return s.to
+}
+
+// rateOptions 全局发布速率目标：-rate 为恒定速率，-rateProfile 为随时间变化的负载曲线，
+// 单位为条/秒，或带 B、KB、MB 后缀的字节/秒
+type rateOptions struct {
+	rate    string
+	profile string
+
+	bytes    bool    // 按字节数而不是条数控制
+	scale    float64 // 工作进程承担的床数比例，0 表示整个车队
+	segments []rateSegment
+}
+
+func (o *rateOptions) enabled() bool {
+	return len(o.segments) > 0
+}
+
+func (o *rateOptions) parse() error {
+	o.segments = nil
+	if o.rate != "" && o.profile != "" {
+		return fmt.Errorf("-rate and -rateProfile can't be combined")
+	}
+	units := map[bool]bool{}
+	value := func(s string) (float64, error) {
+		v, isBytes, err := parseRate(s)
+		if v != 0 || isBytes {
+			// 0 不带单位，和任何单位都兼容
+			units[isBytes] = true
+		}
+		return v, err
+	}
+	if o.rate != "" {
+		v, err := value(o.rate)
+		if err != nil {
+			return err
+		}
+		o.segments = []rateSegment{{kind: segmentSoak, from: v, to: v}}
+	}
+	if o.profile != "" {
+		for _, item := range strings.Split(o.profile, ",") {
+			parts := strings.Split(strings.TrimSpace(item), ":")
+			if len(parts) != 3 {
+				return fmt.Errorf("invalid rate segment %q, expected kind:rate:duration", item)
+			}
+			seg := rateSegment{kind: parts[0], steps: 1}
+			var err error
+			if seg.length, err = time.ParseDuration(parts[2]); err != nil || seg.length <= 0 {
+				return fmt.Errorf("invalid rate segment duration %q", parts[2])
+			}
+			switch seg.kind {
+			case segmentRamp, segmentStep:
+				spec := parts[1]
+				if seg.kind == segmentStep {
+					var n string
+					spec, n, _ = strings.Cut(spec, "x")
+					if seg.steps, err = strconv.Atoi(n); err != nil || seg.steps < 1 {
+						return fmt.Errorf("invalid step count in %q, expected from-toxN", parts[1])
+					}
+				}
+				a, b, ok := strings.Cut(spec, "-")
+				if !ok {
+					return fmt.Errorf("invalid rate range %q, expected from-to", spec)
+				}
+				if seg.from, err = value(a); err != nil {
+					return err
+				}
+				if seg.to, err = value(b); err != nil {
+					return err
+				}
+			case segmentSpike, segmentSoak:
+				if seg.to, err = value(parts[1]); err != nil {
+					return err
+				}
+				seg.from = seg.to
+			default:
+				return fmt.Errorf("unknown rate segment %q, expected ramp, step, spike or soak", seg.kind)
+			}
+			o.segments = append(o.segments, seg)
+		}
+	}
+	if len(units) > 1 {
+		return fmt.Errorf("rate profile mixes messages/sec and bytes/sec")
+	}
+	o.bytes = units[true]
+	return nil
+}
+
+// 解析 "5000"（条/秒）或 "2MB"、"512KB"、"100B"（字节/秒）
+func parseRate(s string) (float64, bool, error) {
+	s = strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "/S")
+	mult, isBytes := 1.0, false
+	for _, u := range []struct {
+		suffix string
+		mult   float64
+	}{{"MB", 1024 * 1024}, {"KB", 1024}, {"B", 1}} {
+		if strings.HasSuffix(s, u.suffix) {
+			s, mult, isBytes = strings.TrimSuffix(s, u.suffix), u.mult, true
+			break
+		}
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v < 0 {
+		return 0, false, fmt.Errorf("invalid rate %q", s)
+	}
+	return v * mult, isBytes, nil
+}
+
+// 负载曲线的总时长，只有 -rate 时为 0
+func (o *rateOptions) length() time.Duration {
+	var d time.Duration
+	for _, seg := range o.segments {
+		d += seg.length
+	}
+	return d
+}
+
+// 开始后 elapsed 时刻本进程的目标速率，工作进程按比例承担整个车队的目标
+func (o *rateOptions) target(elapsed time.Duration) float64 {
+	if o.scale > 0 {
+		return o.fleetTarget(elapsed) * o.scale
+	}
+	return o.fleetTarget(elapsed)
+}
+
+// 整个车队的目标速率，曲线结束后保持最后一段的终值
+func (o *rateOptions) fleetTarget(elapsed time.Duration) float64 {
+	for _, seg := range o.segments {
+		if seg.length == 0 || elapsed < seg.length {
+			return seg.at(elapsed)
+		}
+		elapsed -= seg.length
+	}
+	return o.segments[len(o.segments)-1].to
+}
+
+func (o *rateOptions) format(v float64) string {
+	if !o.bytes {
+		return fmt.Sprintf("%.0f/s", v)
+	}
+	switch {
+	case v >= 1024*1024:
+		return fmt.Sprintf("%.2fMB/s", v/1024/1024)
+	case v >= 1024:
+		return fmt.Sprintf("%.1fKB/s", v/1024)
+	}
+	return fmt.Sprintf("%.0fB/s", v)
+}
+
+// rateController 每秒比较实际速率和目标速率，调整每次触发发布的轮数。
+// 调度的周期和相位不变，负载仍然均匀；系数小于 1 时按概率跳过，大于 1 时多出的轮数均匀分布在周期内
+type rateController struct {
+	o       *rateOptions
+	start   time.Time
+	nominal float64       // 系数为 1 时的估计速率
+	factor  atomic.Uint64 // 每次触发平均发布的轮数（float64）
+
+	mu       sync.Mutex
+	last     int64   // 上一次统计时的累计条数或字节数
+	current  float64 // 当前这一秒的目标
+	seconds  int
+	onTarget int // 实际速率在目标 ±10% 以内的秒数
+	sumT     float64
+	sumA     float64
+}
+
+func newRateController(o *rateOptions, nominal float64) *rateController {
+	c := &rateController{o: o, start: time.Now(), nominal: nominal}
+	c.setFactor(1)
+	c.retarget(o.target(0))
+	c.last = c.counter()
+	return c
+}
+
+// 没有实际速率可以参考时，按估计速率设置系数
+func (c *rateController) retarget(target float64) {
+	c.current = target
+	if c.nominal > 0 {
+		c.setFactor(target / c.nominal)
+	}
+}
+
+func (c *rateController) counter() int64 {
+	msgs, bytes := runStats.totals()
+	if c.o.bytes {
+		return bytes
+	}
+	return msgs
+}
+
+func (c *rateController) setFactor(v float64) {
+	c.factor.Store(math.Float64bits(max(0, min(maxFactor, v))))
+}
+
+// 本次触发发布的轮数，小数部分按概率取整
+func (c *rateController) rounds() int {
+	f := math.Float64frombits(c.factor.Load())
+	n := int(f)
+	if rand.Float64() < f-float64(n) {
+		n++
+	}
+	return n
+}
+
+// 每秒调用一次，根据上一秒的实际速率调整系数，返回状态行
+func (c *rateController) update() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := c.counter()
+	achieved := float64(n - c.last)
+	c.last = n
+	target := c.current
+	next := c.o.target(time.Since(c.start))
+
+	factor := math.Float64frombits(c.factor.Load())
+	if target > 0 {
+		// 取平方根并限制单次调整幅度，避免发布队列的滞后引起振荡
+		ratio := 2.0
+		if achieved > 0 {
+			ratio = max(0.5, min(2, math.Sqrt(target/achieved)))
+		}
+		factor *= ratio
+		c.seconds++
+		c.sumT += target
+		c.sumA += achieved
+		if math.Abs(achieved-target) <= target*0.1 {
+			c.onTarget++
+		}
+	}
+	if target == 0 || factor == 0 {
+		c.retarget(next)
+	} else {
+		// 目标变化时直接按比例调整
+		c.setFactor(factor * next / target)
+		c.current = next
+	}
+	return fmt.Sprintf("rate: target=%s,achieved=%s,factor=%.2f", c.o.format(target), c.o.format(achieved), math.Float64frombits(c.factor.Load()))
+}
+
+// rateSummary 整个运行期间的平均目标和实际速率
+type rateSummary struct {
+	Unit     string  `json:"unit"` // msg/s 或 B/s
+	Target   float64 `json:"target"`
+	Achieved float64 `json:"achieved"`
+	OnTarget int     `json:"onTargetSeconds"` // 实际速率在目标 ±10% 以内的秒数
+	Seconds  int     `json:"seconds"`
+}
+
+func (c *rateController) summary() rateSummary {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := rateSummary{Unit: "msg/s", OnTarget: c.onTarget, Seconds: c.seconds}
+	if c.o.bytes {
+		s.Unit = "B/s"
+	}
+	if c.seconds > 0 {
+		s.Target = c.sumT / float64(c.seconds)
+		s.Achieved = c.sumA / float64(c.seconds)
+	}
+	return s
+}
+
+// 输出整个运行期间的目标和实际速率
+func (c *rateController) print() {
+	s := c.summary()
+	if s.Seconds == 0 {
+		return
+	}
+	line := fmt.Sprintf("rate summary: target=%s,achieved=%s,onTarget=%d/%ds",
+		c.o.format(s.Target), c.o.format(s.Achieved), s.OnTarget, s.Seconds)
+	fmt.Println(line)
+	log.Println(line)
+}
+
+// 估计系数为 1 时所有床的发布速率，最多抽样 100 张床
+func nominalRate(beds []*bed, bytes bool) float64 {
+	sample := beds[:min(len(beds), 100)]
+	if len(sample) == 0 {
+		return 0
+	}
+	now := time.Now()
+	var rate float64
+	for _, g := range generators {
+		for _, b := range sample {
+			for _, f := range g.build(b.Device, now) {
+				if bytes {
+					// 加密后按 16 字节分组做 PKCS7 填充
+					rate += float64((len(f.data)/16+1)*16) / g.period().Seconds()
+				} else {
+					rate += 1 / g.period().Seconds()
+				}
+			}
+		}
+	}
+	return rate * float64(len(beds)) / float64(len(sample))
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateProfile(t *testing.T) {
+	cases := []struct {
+		rate, profile string
+		bytes         bool
+		// 开始后各时刻的目标速率
+		at   []time.Duration
+		want []float64
+	}{
+		{rate: "5000", at: []time.Duration{0, time.Hour}, want: []float64{5000, 5000}},
+		{profile: "ramp:1000-5000:4m", at: []time.Duration{0, time.Minute, 2 * time.Minute}, want: []float64{1000, 2000, 3000}},
+		// 5 级：1000、2000、3000、4000、5000，每级 2 分钟
+		{profile: "step:1000-5000x5:10m", at: []time.Duration{0, 3 * time.Minute, 9*time.Minute + 59*time.Second}, want: []float64{1000, 2000, 5000}},
+		// 只有一级时整段都是终值
+		{profile: "step:1000-5000x1:10m", at: []time.Duration{0, 5 * time.Minute}, want: []float64{5000, 5000}},
+		{profile: "soak:100:1m,spike:20000:30s,soak:100:1m", at: []time.Duration{30 * time.Second, 75 * time.Second, 2 * time.Minute}, want: []float64{100, 20000, 100}},
+		// 曲线结束后保持最后一段的终值
+		{profile: "ramp:0-1000:1m", at: []time.Duration{time.Hour}, want: []float64{1000}},
+		{rate: "2MB", bytes: true, at: []time.Duration{0}, want: []float64{2 * 1024 * 1024}},
+		{profile: "ramp:0-512KB/s:1m,soak:100B:1m", bytes: true, at: []time.Duration{30 * time.Second, 90 * time.Second}, want: []float64{256 * 1024, 100}},
+	}
+	for _, c := range cases {
+		o := rateOptions{rate: c.rate, profile: c.profile}
+		if err := o.parse(); err != nil {
+			t.Errorf("%s%s: %v", c.rate, c.profile, err)
+			continue
+		}
+		if o.bytes != c.bytes {
+			t.Errorf("%s%s: bytes = %v", c.rate, c.profile, o.bytes)
+		}
+		for i, at := range c.at {
+			if got := o.target(at); got != c.want[i] {
+				t.Errorf("%s%s: target(%s) = %v, want %v", c.rate, c.profile, at, got, c.want[i])
+			}
+		}
+	}
+
+	for _, c := range []struct{ rate, profile string }{
+		{rate: "100", profile: "soak:100:1m"},
+		{profile: "ramp:100-2MB:1m"}, // 条/秒和字节/秒混用
+		{profile: "soak:100"},
+		{profile: "step:1000-5000:10m"},
+		{profile: "step:1000-5000x0:10m"},
+		{profile: "ramp:1000:1m"},
+		{profile: "wave:100:1m"},
+		{profile: "soak:100:0s"},
+		{rate: "-5"},
+		{rate: "fastKB"},
+	} {
+		o := rateOptions{rate: c.rate, profile: c.profile}
+		if err := o.parse(); err == nil {
+			t.Errorf("expected error for rate %q profile %q", c.rate, c.profile)
+		}
+	}
+}
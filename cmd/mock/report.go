@@ -0,0 +1,493 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/panjf2000/ants/v2"
+	dto "github.com/prometheus/client_model/go"
+
+	"mock-bed/pkg/mqttclient"
+)
+
+// sample 每秒一次的采样，数量为这一秒内的增量
+type sample struct {
+	Second    int   `json:"t"` // 开始后的秒数
+	Published int64 `json:"published"`
+	Bytes     int64 `json:"bytes"`
+	Errors    int64 `json:"errors"`
+	Connected int   `json:"connected"`
+	Waiting   int   `json:"poolWaiting"`
+}
+
+// timeline 吞吐随时间的变化，写入报告
+type timeline struct {
+	mu      sync.Mutex
+	samples []sample
+	last    [3]int64 // 上一次采样时的累计条数、字节数、错误数
+}
+
+var runTimeline timeline
+
+// 每秒调用一次
+func (t *timeline) sample(conns []mqttclient.Client, p *ants.Pool) {
+	msgs, bytes := runStats.totals()
+	errs := runStats.errors.Load()
+	connected := 0
+	for _, c := range conns {
+		if c.IsConnected() {
+			connected++
+		}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.samples = append(t.samples, sample{
+		Second:    int(time.Since(runStats.start).Round(time.Second).Seconds()),
+		Published: msgs - t.last[0],
+		Bytes:     bytes - t.last[1],
+		Errors:    errs - t.last[2],
+		Connected: connected,
+		Waiting:   p.Waiting(),
+	})
+	t.last = [3]int64{msgs, bytes, errs}
+}
+
+// runReport 运行结束后写出的报告，JSON 用于程序比较多次运行，Markdown 给人看
+type runReport struct {
+	Start    time.Time         `json:"start"`
+	End      time.Time         `json:"end"`
+	Duration float64           `json:"durationSeconds"`
+	Config   map[string]string `json:"config"`
+	Changed  []string          `json:"changedFlags"` // 和默认值不同的参数
+	Fleet    fleetReport       `json:"fleet"`
+	Totals   totalsReport      `json:"totals"`
+	Types    []typeReport      `json:"types"`
+	Commands []latencyReport   `json:"commands"`
+	Brokers  []brokerReport    `json:"brokers,omitempty"`
+	Churn    *churnReport      `json:"churn,omitempty"`
+	Rate     *rateSummary      `json:"rate,omitempty"`
+	Workers  []workerReport    `json:"workers,omitempty"` // 分布式运行时每个工作进程的结果
+	Timeline []sample          `json:"timeline"`
+}
+
+type fleetReport struct {
+	Beds        int      `json:"beds"`
+	Connections int      `json:"connections"`
+	Topology    string   `json:"topology"`
+	Protocol    int      `json:"mqttVersion"`
+	Schedule    string   `json:"schedule"`
+	Brokers     []string `json:"brokers"`
+}
+
+type totalsReport struct {
+	Published  int64   `json:"published"`
+	Bytes      int64   `json:"bytes"`
+	Errors     int64   `json:"errors"`
+	Dropped    int64   `json:"dropped"`
+	Coalesced  int64   `json:"coalesced"`
+	Late       int64   `json:"late"`
+	Reconnects int64   `json:"reconnects"`
+	MsgRate    float64 `json:"msgPerSec"`
+	ByteRate   float64 `json:"bytesPerSec"`
+}
+
+type typeReport struct {
+	Type      string           `json:"type"`
+	Published int64            `json:"published"`
+	Bytes     int64            `json:"bytes"`
+	Errors    map[string]int64 `json:"errors,omitempty"` // 按原因
+	Ack       *latencyReport   `json:"ack,omitempty"`    // QoS 1/2 的确认耗时
+}
+
+// latencyReport 耗时分位数，单位毫秒，由直方图插值估计
+type latencyReport struct {
+	Name  string  `json:"name,omitempty"`
+	Count uint64  `json:"count"`
+	P50   float64 `json:"p50Ms"`
+	P95   float64 `json:"p95Ms"`
+	P99   float64 `json:"p99Ms"`
+}
+
+type brokerReport struct {
+	URL       string `json:"url"`
+	Connects  int64  `json:"connects"`
+	Published int64  `json:"published"`
+	Errors    int64  `json:"errors"`
+}
+
+type workerReport struct {
+	ID        int     `json:"id"`
+	Host      string  `json:"host"`
+	Beds      int     `json:"beds"`
+	Published int64   `json:"published"`
+	Errors    int64   `json:"errors"`
+	MsgRate   float64 `json:"msgPerSec"`
+	Reported  bool    `json:"reported"` // 是否收到了工作进程的报告，没有时只有指标中的数据
+}
+
+type churnReport struct {
+	Offline         int64 `json:"offlineEvents"`
+	Online          int64 `json:"onlineEvents"`
+	ReconnectErrors int64 `json:"reconnectErrors"`
+}
+
+// 生成报告，在 shutdown 之后调用
+func buildReport(fl *fleet, topology string, schedule scheduleOptions, churn bool) (*runReport, error) {
+	end := time.Now()
+	msgs, bytes := runStats.totals()
+	elapsed := end.Sub(runStats.start).Seconds()
+	r := &runReport{
+		Start:    runStats.start,
+		End:      end,
+		Duration: elapsed,
+		Fleet: fleetReport{
+			Beds:        len(fl.list()),
+			Connections: len(fl.clients()),
+			Topology:    topology,
+			Protocol:    broker.protocol.Version,
+			Schedule:    schedule.mode,
+			Brokers:     redactURLs(broker.shard.urls),
+		},
+		Totals: totalsReport{
+			Published:  msgs,
+			Bytes:      bytes,
+			Errors:     runStats.errors.Load(),
+			Dropped:    runStats.dropped.Load(),
+			Coalesced:  runStats.coalesced.Load(),
+			Late:       runStats.late.Load(),
+			Reconnects: runStats.reconnects(fl.connections()),
+			MsgRate:    float64(msgs) / elapsed,
+			ByteRate:   float64(bytes) / elapsed,
+		},
+	}
+
+	r.addConfig()
+	families, err := metrics.registry.Gather()
+	if err != nil {
+		return nil, err
+	}
+	r.addMetrics(families)
+	if len(broker.shard.urls) > 1 {
+		for _, u := range broker.shard.urls {
+			for _, st := range broker.shard.stats {
+				if st.url == u {
+					r.Brokers = append(r.Brokers, brokerReport{URL: redactURL(u), Connects: st.connects.Load(), Published: st.published.Load(), Errors: st.errors.Load()})
+				}
+			}
+		}
+	}
+	if churn {
+		r.Churn = &churnReport{Offline: churnStats.offline.Load(), Online: churnStats.online.Load(), ReconnectErrors: churnStats.reconnectErrs.Load()}
+	}
+	if schedule.rate != nil {
+		s := schedule.rate.summary()
+		r.Rate = &s
+	}
+	runTimeline.mu.Lock()
+	r.Timeline = append([]sample(nil), runTimeline.samples...)
+	runTimeline.mu.Unlock()
+	return r, nil
+}
+
+// 所有参数的值和修改过的参数
+func (r *runReport) addConfig() {
+	r.Config = make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		r.Config[f.Name] = configValue(f)
+	})
+	flag.Visit(func(f *flag.Flag) {
+		r.Changed = append(r.Changed, f.Name)
+	})
+}
+
+// 参数写入报告的值：密码、密钥、URL 中的账号和 websocket 请求头（可能是认证令牌）不写入报告
+func configValue(f *flag.Flag) string {
+	v := f.Value.String()
+	name := strings.ToLower(f.Name)
+	switch {
+	case v == "":
+	case strings.Contains(name, "password") || strings.Contains(name, "secret"):
+		v = "***"
+	case f.Name == "broker" || f.Name == "proxy":
+		v = strings.Join(redactURLs(strings.Split(v, ",")), ",")
+	case f.Name == "wsHeader":
+		if p, ok := f.Value.(*mqttclient.Properties); ok {
+			items := make([]string, 0, len(*p))
+			for k := range *p {
+				items = append(items, k+"=***")
+			}
+			sort.Strings(items)
+			v = strings.Join(items, ",")
+		}
+	}
+	return v
+}
+
+// 把 URL 中的用户名和密码替换为 ***，无法解析的原样返回
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	// url.User 会把 * 转义成 %2A，直接拼接
+	u.User = nil
+	return strings.Replace(u.String(), "//", "//***@", 1)
+}
+
+func redactURLs(urls []string) []string {
+	out := make([]string, len(urls))
+	for i, s := range urls {
+		out[i] = redactURL(s)
+	}
+	return out
+}
+
+// 从 Prometheus 指标中取出每种消息和命令的统计；families 可以来自多个工作进程，
+// 相同标签的计数器和直方图会合并
+func (r *runReport) addMetrics(families []*dto.MetricFamily) {
+	types := make(map[string]*typeReport)
+	acks := make(map[string]*dto.Histogram)     // 消息类型 -> 确认耗时
+	ackQos := make(map[string]string)           // 消息类型 -> qos
+	commands := make(map[string]*dto.Histogram) // 命令 -> 耗时
+	get := func(name string) *typeReport {
+		if t, ok := types[name]; ok {
+			return t
+		}
+		t := &typeReport{Type: name}
+		types[name] = t
+		return t
+	}
+	label := func(m *dto.Metric, name string) string {
+		for _, l := range m.GetLabel() {
+			if l.GetName() == name {
+				return l.GetValue()
+			}
+		}
+		return ""
+	}
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			switch f.GetName() {
+			case "mock_bed_published_total":
+				get(label(m, "type")).Published += int64(m.GetCounter().GetValue())
+			case "mock_bed_published_bytes_total":
+				get(label(m, "type")).Bytes += int64(m.GetCounter().GetValue())
+			case "mock_bed_publish_errors_total":
+				t := get(label(m, "type"))
+				if t.Errors == nil {
+					t.Errors = make(map[string]int64)
+				}
+				t.Errors[label(m, "reason")] += int64(m.GetCounter().GetValue())
+			case "mock_bed_publish_ack_seconds":
+				name := label(m, "type")
+				get(name)
+				acks[name] = mergeHistogram(acks[name], m.GetHistogram())
+				ackQos[name] = label(m, "qos")
+			case "mock_bed_command_seconds":
+				name := label(m, "cmd")
+				commands[name] = mergeHistogram(commands[name], m.GetHistogram())
+			}
+		}
+	}
+	for name, h := range acks {
+		l := newLatencyReport("qos"+ackQos[name], h)
+		types[name].Ack = &l
+	}
+	for name, h := range commands {
+		r.Commands = append(r.Commands, newLatencyReport(name, h))
+	}
+	for _, t := range types {
+		r.Types = append(r.Types, *t)
+	}
+	sort.Slice(r.Types, func(i, j int) bool { return r.Types[i].Type < r.Types[j].Type })
+	sort.Slice(r.Commands, func(i, j int) bool { return r.Commands[i].Name < r.Commands[j].Name })
+}
+
+// 合并两个桶边界相同的直方图，dst 为 nil 时直接返回 src
+func mergeHistogram(dst, src *dto.Histogram) *dto.Histogram {
+	if dst == nil {
+		return src
+	}
+	count := dst.GetSampleCount() + src.GetSampleCount()
+	sum := dst.GetSampleSum() + src.GetSampleSum()
+	buckets := make([]*dto.Bucket, len(dst.GetBucket()))
+	for i, b := range dst.GetBucket() {
+		n := b.GetCumulativeCount()
+		if i < len(src.GetBucket()) {
+			n += src.GetBucket()[i].GetCumulativeCount()
+		}
+		buckets[i] = &dto.Bucket{UpperBound: b.UpperBound, CumulativeCount: &n}
+	}
+	return &dto.Histogram{SampleCount: &count, SampleSum: &sum, Bucket: buckets}
+}
+
+func newLatencyReport(name string, h *dto.Histogram) latencyReport {
+	ms := func(q float64) float64 { return quantile(h, q) * 1000 }
+	return latencyReport{Name: name, Count: h.GetSampleCount(), P50: ms(0.5), P95: ms(0.95), P99: ms(0.99)}
+}
+
+// 从直方图估计分位数，在桶内线性插值，和 PromQL 的 histogram_quantile 一致
+func quantile(h *dto.Histogram, q float64) float64 {
+	total := h.GetSampleCount()
+	if total == 0 {
+		return 0
+	}
+	rank := q * float64(total)
+	var prevCount uint64
+	prevBound := 0.0
+	for _, b := range h.GetBucket() {
+		if float64(b.GetCumulativeCount()) >= rank {
+			n := b.GetCumulativeCount() - prevCount
+			if n == 0 {
+				return b.GetUpperBound()
+			}
+			return prevBound + (b.GetUpperBound()-prevBound)*(rank-float64(prevCount))/float64(n)
+		}
+		prevCount, prevBound = b.GetCumulativeCount(), b.GetUpperBound()
+	}
+	// 落在 +Inf 桶里，只能给出最大的有限上界
+	return prevBound
+}
+
+// 写出 <path>.json 和 <path>.md
+func (r *runReport) write(path string) error {
+	path = strings.TrimSuffix(strings.TrimSuffix(path, ".json"), ".md")
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".json", data, 0o644); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".md", []byte(r.markdown()), 0o644); err != nil {
+		return err
+	}
+	fmt.Println("report written to", path+".json", "and", path+".md")
+	return nil
+}
+
+// Markdown 报告，吞吐曲线最多 60 行，超过时按时间段合并
+func (r *runReport) markdown() string {
+	var b strings.Builder
+	row := func(cells ...any) {
+		b.WriteString("|")
+		for _, c := range cells {
+			fmt.Fprintf(&b, " %v |", c)
+		}
+		b.WriteString("\n")
+	}
+	header := func(cells ...string) {
+		row(toAny(cells)...)
+		b.WriteString("|" + strings.Repeat(" --- |", len(cells)) + "\n")
+	}
+
+	b.WriteString("# mock-bed load test report\n\n")
+	fmt.Fprintf(&b, "- start: %s\n- end: %s\n- duration: %s\n\n", r.Start.Format(time.RFC3339), r.End.Format(time.RFC3339), time.Duration(r.Duration*float64(time.Second)).Round(time.Second))
+
+	b.WriteString("## Fleet\n\n")
+	header("beds", "connections", "topology", "MQTT", "schedule", "brokers")
+	row(r.Fleet.Beds, r.Fleet.Connections, r.Fleet.Topology, r.Fleet.Protocol, r.Fleet.Schedule, strings.Join(r.Fleet.Brokers, "<br>"))
+
+	b.WriteString("\n## Totals\n\n")
+	header("published", "bytes", "msg/s", "bytes/s", "errors", "dropped", "coalesced", "late", "reconnects")
+	t := r.Totals
+	row(t.Published, t.Bytes, fmt.Sprintf("%.0f", t.MsgRate), fmt.Sprintf("%.0f", t.ByteRate), t.Errors, t.Dropped, t.Coalesced, t.Late, t.Reconnects)
+
+	b.WriteString("\n## Message types\n\n")
+	header("type", "published", "bytes", "errors", "ack", "ack p50 ms", "ack p95 ms", "ack p99 ms")
+	for _, t := range r.Types {
+		var errs []string
+		for reason, n := range t.Errors {
+			errs = append(errs, fmt.Sprintf("%s=%d", reason, n))
+		}
+		sort.Strings(errs)
+		if t.Ack == nil {
+			row(t.Type, t.Published, t.Bytes, strings.Join(errs, " "), "-", "-", "-", "-")
+			continue
+		}
+		row(t.Type, t.Published, t.Bytes, strings.Join(errs, " "), t.Ack.Name, ms(t.Ack.P50), ms(t.Ack.P95), ms(t.Ack.P99))
+	}
+
+	if len(r.Commands) > 0 {
+		b.WriteString("\n## Command round trip\n\n")
+		header("cmd", "count", "p50 ms", "p95 ms", "p99 ms")
+		for _, c := range r.Commands {
+			row(c.Name, c.Count, ms(c.P50), ms(c.P95), ms(c.P99))
+		}
+	}
+	if len(r.Brokers) > 0 {
+		b.WriteString("\n## Brokers\n\n")
+		header("broker", "connects", "published", "errors")
+		for _, br := range r.Brokers {
+			row(br.URL, br.Connects, br.Published, br.Errors)
+		}
+	}
+	if r.Churn != nil {
+		b.WriteString("\n## Churn\n\n")
+		header("offline events", "online events", "reconnect errors")
+		row(r.Churn.Offline, r.Churn.Online, r.Churn.ReconnectErrors)
+	}
+	if r.Rate != nil {
+		b.WriteString("\n## Rate target\n\n")
+		header("unit", "target", "achieved", "on target")
+		row(r.Rate.Unit, fmt.Sprintf("%.0f", r.Rate.Target), fmt.Sprintf("%.0f", r.Rate.Achieved), fmt.Sprintf("%d/%ds", r.Rate.OnTarget, r.Rate.Seconds))
+	}
+
+	if len(r.Workers) > 0 {
+		b.WriteString("\n## Workers\n\n")
+		header("worker", "host", "beds", "published", "msg/s", "errors", "reported")
+		for _, w := range r.Workers {
+			row(w.ID, w.Host, w.Beds, w.Published, fmt.Sprintf("%.0f", w.MsgRate), w.Errors, w.Reported)
+		}
+	}
+
+	if len(r.Timeline) > 0 {
+		b.WriteString("\n## Throughput\n\n")
+		header("t", "msg/s", "KB/s", "errors", "connected", "pool waiting")
+		step := (len(r.Timeline) + 59) / 60
+		for i := 0; i < len(r.Timeline); i += step {
+			part := r.Timeline[i:min(i+step, len(r.Timeline))]
+			var msgs, bytes, errs int64
+			for _, s := range part {
+				msgs += s.Published
+				bytes += s.Bytes
+				errs += s.Errors
+			}
+			last := part[len(part)-1]
+			n := float64(len(part))
+			row(fmt.Sprintf("%ds", part[0].Second), fmt.Sprintf("%.0f", float64(msgs)/n), fmt.Sprintf("%.1f", float64(bytes)/n/1024), errs, last.Connected, last.Waiting)
+		}
+	}
+
+	b.WriteString("\n## Configuration\n\n")
+	header("flag", "value")
+	for _, name := range r.Changed {
+		row(name, "`"+r.Config[name]+"`")
+	}
+	return b.String()
+}
+
+func ms(v float64) string {
+	return fmt.Sprintf("%.1f", v)
+}
+
+func toAny(s []string) []any {
+	a := make([]any, len(s))
+	for i, v := range s {
+		a[i] = v
+	}
+	return a
+}
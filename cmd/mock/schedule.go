@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/madflojo/tasks"
+
+	"mock-bed/pkg/wheel"
+)
+
+// 调度方式
+const (
+	scheduleSpread = "spread" // 每张床各自的相位加随机抖动，负载均匀
+	scheduleBurst  = "burst"  // 所有床同一时刻发布同一种消息，旧的行为
+)
+
+// scheduleOptions 周期数据的发布调度
+type scheduleOptions struct {
+	mode   string
+	jitter float64         // 每次发布在周期的 ±jitter 比例内随机偏移
+	rate   *rateController // 设置了目标速率时按它调整发布的轮数
+}
+
+func (o scheduleOptions) validate() error {
+	switch o.mode {
+	case scheduleSpread, scheduleBurst:
+	default:
+		return fmt.Errorf("unknown schedule %q, expected spread or burst", o.mode)
+	}
+	if o.jitter < 0 || o.jitter >= 0.5 {
+		return fmt.Errorf("jitter must be in [0, 0.5)")
+	}
+	return nil
+}
+
+// plan 运行中的发布调度，控制接口通过它加入新的床和修改周期
+type plan struct {
+	o         scheduleOptions
+	f         *fleet
+	d         *dispatcher
+	scheduler *tasks.Scheduler
+	w         *wheel.Wheel // spread 调度
+	mu        sync.Mutex   // 修改 burst 调度的任务
+}
+
+// 开始为所有床发布周期数据
+func (o scheduleOptions) start(f *fleet, scheduler *tasks.Scheduler, d *dispatcher) *plan {
+	p := &plan{o: o, f: f, d: d, scheduler: scheduler}
+	if o.mode == scheduleBurst {
+		for _, g := range generators {
+			p.addTask(g)
+		}
+		return p
+	}
+
+	// 最短的周期是 72ms，10ms 的刻度足够；512 个槽约 5 秒一圈
+	p.w = wheel.New(10*time.Millisecond, 512)
+	start := time.Now()
+	beds := f.list()
+	for _, g := range generators {
+		for i, b := range beds {
+			// 第 i 张床的相位为周期的 i/n，同一种消息均匀分布在整个周期里
+			p.schedule(b, g, start.Add(g.period()*time.Duration(i)/time.Duration(len(beds))))
+		}
+	}
+	p.w.Start()
+	return p
+}
+
+// burst 调度每种消息一个任务，所有床同时发布
+func (p *plan) addTask(g generator) {
+	p.scheduler.AddWithID("publish/"+g.name, &tasks.Task{
+		Interval: g.period(),
+		TaskFunc: func() error {
+			publishFrames(p.f.list(), g, p.d)
+			return nil
+		},
+	})
+}
+
+// spread 调度一张床一种消息，从 next 开始按当前周期发布，床被移除后停止
+func (p *plan) schedule(b *bed, g generator, next time.Time) {
+	p.w.Schedule(p.o.jittered(next, g.period()), func(at time.Time) time.Time {
+		if b.removed.Load() {
+			return time.Time{}
+		}
+		rounds := 1
+		if p.o.rate != nil {
+			rounds = p.o.rate.rounds()
+		}
+		interval := g.period()
+		if rounds > 0 {
+			p.submit(b, g, at, interval)
+		}
+		// 多出的轮数均匀分布在本周期内，不在同一时刻连续发布
+		for k := 1; k < rounds; k++ {
+			p.w.Schedule(at.Add(interval*time.Duration(k)/time.Duration(rounds)), func(extra time.Time) time.Time {
+				if !b.removed.Load() {
+					p.submit(b, g, extra, interval)
+				}
+				return time.Time{}
+			})
+		}
+		// 按名义时间推进，抖动不会累积
+		next = next.Add(interval)
+		return p.o.jittered(next, interval)
+	})
+}
+
+// 提交一张床一种消息的一轮发布
+func (p *plan) submit(b *bed, g generator, at time.Time, interval time.Duration) {
+	if !b.publishing(g) {
+		return
+	}
+	p.d.submit(&job{key: b.Mac + "/" + g.name, name: g.name, due: at, interval: interval, fn: func() {
+		publishBed(b, g, at)
+	}})
+}
+
+// 运行时加入的床，spread 调度下使用随机相位
+func (p *plan) add(b *bed) {
+	if p.w == nil {
+		return
+	}
+	now := time.Now()
+	for _, g := range generators {
+		p.schedule(b, g, now.Add(time.Duration(rand.Int63n(int64(g.period())))))
+	}
+}
+
+// 修改一种消息的周期，spread 调度从每张床的下一次发布开始生效
+func (p *plan) setInterval(g generator, interval time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	g.ctl.interval.Store(int64(interval))
+	if p.w == nil {
+		p.scheduler.Del("publish/" + g.name)
+		p.addTask(g)
+	}
+}
+
+// 停止调度，不再提交新的发布
+func (p *plan) stop() {
+	if p.w != nil {
+		p.w.Stop()
+	}
+}
+
+// 名义时间 t 加上随机抖动
+func (o scheduleOptions) jittered(t time.Time, interval time.Duration) time.Time {
+	if o.jitter == 0 {
+		return t
+	}
+	j := time.Duration(float64(interval) * o.jitter)
+	return t.Add(time.Duration(rand.Int63n(int64(2*j)+1)) - j)
+}
+
+// 所有床同时提交一轮消息
+func publishFrames(beds []*bed, g generator, d *dispatcher) {
+	now := time.Now()
+	for _, b := range beds {
+		if !b.publishing(g) {
+			continue
+		}
+		d.submit(&job{key: b.Mac + "/" + g.name, name: g.name, due: now, interval: g.period(), fn: func() {
+			publishBed(b, g, now)
+		}})
+	}
+}
+
+// 生成并发布一张床的一轮消息，在协程池里执行
+func publishBed(b *bed, g generator, now time.Time) {
+	for _, f := range g.build(b.device(), now) {
+		publishFrame(b, g.name, f)
+	}
+}
+
+// 加密并发布一帧，记录到床的最近消息，返回记录的消息
+func publishFrame(b *bed, name string, f frame) recentMsg {
+	log.Println(fmt.Sprintf("public %s,mac=%s,cmd=%X", name, b.Mac, f.data[0]))
+	m := newRecentMsg(time.Now(), name, f.topic, f.data, nil)
+	switch {
+	case traffic.wantsFull(b.Mac):
+		// 仪表盘在看这张床，需要完整的帧
+		m.head = bytes.Clone(f.data)
+	case f.buf != nil:
+		// 缓冲区加密后会归还，订阅者可能在发布前加入，总是复制开头（最多 recentDataLen 字节）
+		m.head = bytes.Clone(m.head)
+	}
+	encryptedData, err := f.payload()
+	if err != nil {
+		fmt.Println("Encrypt error:", err)
+		runStats.errors.Add(1)
+		metrics.encryptError(name)
+		errorLog.add(b.Mac, name, err)
+		m.err = err
+	} else if m.err = publish(b.client, name, b.Mac, f.topic, encryptedData); m.err != nil {
+		log.Println(m.err)
+	}
+	traffic.emit(kindPublish, b.Mac, m)
+	m.head = m.head[:min(len(m.head), recentDataLen)]
+	b.recent.add(m)
+	return m
+}
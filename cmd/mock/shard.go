@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"mock-bed/pkg/identity"
+	"mock-bed/pkg/mqttclient"
+)
+
+// 分配策略
+const (
+	shardRoundRobin = "roundrobin" // 按设备顺序轮流分配
+	shardHash       = "hash"       // 按 MAC 的哈希分配，同一台设备每次都连到同一个代理
+	shardWeighted   = "weighted"   // 按 -brokerWeights 的比例分配
+)
+
+// shardOptions 多代理分片：按策略为每台设备分配代理，断线后依次切换到列表中的下一个代理
+type shardOptions struct {
+	strategy string
+	weights  string // weighted 策略的权重，逗号分隔，与代理地址一一对应
+	wsPath   string // ws:// 地址没有路径时客户端补上的路径
+
+	urls     []string
+	assigned map[string]int         // mac -> 代理序号
+	stats    map[string]*brokerStat // 代理地址 -> 统计，创建后只读
+}
+
+// brokerStat 一个代理的连接和发布统计
+type brokerStat struct {
+	url       string
+	connects  atomic.Int64
+	published atomic.Int64
+	errors    atomic.Int64
+}
+
+// 解析逗号分隔的代理地址
+func (o *shardOptions) parse(brokers string) error {
+	o.urls = nil
+	o.stats = make(map[string]*brokerStat)
+	for _, s := range strings.Split(brokers, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		u, err := url.Parse(s)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("invalid broker url %q", s)
+		}
+		// 按完整地址统计，同一个主机的 tcp 和 ws 端点分开
+		key := o.key(s)
+		if _, ok := o.stats[key]; ok {
+			return fmt.Errorf("duplicate broker url %q", s)
+		}
+		o.urls = append(o.urls, s)
+		o.stats[key] = &brokerStat{url: s}
+	}
+	if len(o.urls) == 0 {
+		return fmt.Errorf("no broker url")
+	}
+	switch o.strategy {
+	case shardRoundRobin, shardHash, shardWeighted:
+	default:
+		return fmt.Errorf("unknown broker strategy %q, expected roundrobin, hash or weighted", o.strategy)
+	}
+	return nil
+}
+
+// 统计使用的地址，和客户端 Server() 返回的一致：补上 ws 路径后解析再格式化
+func (o *shardOptions) key(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return s
+	}
+	if full, err := mqttclient.WithWSPath(s, o.wsPath); err == nil {
+		u, _ = url.Parse(full)
+	}
+	return u.String()
+}
+
+// 为每台设备分配代理
+func (o *shardOptions) assign(devices []identity.Device) error {
+	var weights []int
+	total := 0
+	if o.strategy == shardWeighted {
+		items := strings.Split(o.weights, ",")
+		if len(items) != len(o.urls) {
+			return fmt.Errorf("brokerWeights needs %d weights, got %q", len(o.urls), o.weights)
+		}
+		for _, item := range items {
+			w, err := strconv.Atoi(strings.TrimSpace(item))
+			if err != nil || w < 0 {
+				return fmt.Errorf("invalid broker weight %q", item)
+			}
+			weights = append(weights, w)
+			total += w
+		}
+		if total == 0 {
+			return fmt.Errorf("brokerWeights can't all be 0")
+		}
+	}
+
+	o.assigned = make(map[string]int, len(devices))
+	for i, dev := range devices {
+		switch o.strategy {
+		case shardRoundRobin:
+			o.assigned[dev.Mac] = i % len(o.urls)
+		case shardHash:
+			o.assigned[dev.Mac] = o.hash(dev.Mac)
+		case shardWeighted:
+			slot := i % total
+			for j, w := range weights {
+				if slot < w {
+					o.assigned[dev.Mac] = j
+					break
+				}
+				slot -= w
+			}
+		}
+	}
+	return nil
+}
+
+func (o *shardOptions) hash(mac string) int {
+	h := fnv.New32a()
+	h.Write([]byte(mac))
+	return int(h.Sum32() % uint32(len(o.urls)))
+}
+
+// 设备 mac 的代理地址和故障切换顺序，运行时加入的设备按 MAC 的哈希分配
+func (o *shardOptions) servers(mac string) (string, []string) {
+	i, ok := o.assigned[mac]
+	if !ok {
+		i = o.hash(mac)
+	}
+	failover := make([]string, 0, len(o.urls)-1)
+	for j := 1; j < len(o.urls); j++ {
+		failover = append(failover, o.urls[(i+j)%len(o.urls)])
+	}
+	return o.urls[i], failover
+}
+
+// 客户端当前连接的代理的统计，只有一个代理或未连接时返回 nil
+func (o *shardOptions) stat(client mqttclient.Client) *brokerStat {
+	if len(o.urls) < 2 {
+		return nil
+	}
+	return o.stats[client.Server()]
+}
+
+// 每个代理一行统计，conns 不为空时同时统计当前连接数
+func (o *shardOptions) report(conns []mqttclient.Client) []string {
+	current := make(map[*brokerStat]int)
+	for _, c := range conns {
+		if st := o.stat(c); st != nil {
+			current[st]++
+		}
+	}
+	lines := make([]string, 0, len(o.urls))
+	for _, s := range o.urls {
+		st := o.stats[o.key(s)]
+		line := fmt.Sprintf("broker=%s,connects=%d,published=%d,errors=%d", st.url, st.connects.Load(), st.published.Load(), st.errors.Load())
+		if conns != nil {
+			line += fmt.Sprintf(",conns=%d", current[st])
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// 输出到控制台和日志
+func (o *shardOptions) print(conns []mqttclient.Client) {
+	if len(o.urls) < 2 {
+		return
+	}
+	for _, line := range o.report(conns) {
+		fmt.Println(line)
+		log.Println(line)
+	}
+}
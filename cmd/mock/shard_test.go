@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"mock-bed/pkg/identity"
+	"mock-bed/pkg/mqttclient"
+)
+
+// 只用于统计的客户端，Server 返回固定地址
+type serverClient struct{ server string }
+
+func (c serverClient) Connect() error                                   { return nil }
+func (c serverClient) Publish(string, byte, bool, []byte) error         { return nil }
+func (c serverClient) Subscribe(string, byte, mqttclient.Handler) error { return nil }
+func (c serverClient) IsConnected() bool                                { return c.server != "" }
+func (c serverClient) Server() string                                   { return c.server }
+func (c serverClient) Disconnect(time.Duration)                         {}
+func (c serverClient) Drop()                                            {}
+
+func testDevices(n int) []identity.Device {
+	devices := make([]identity.Device, n)
+	for i := range devices {
+		devices[i] = identity.Device{Mac: fmt.Sprintf("AABBCCDDEE%02X", i)}
+	}
+	return devices
+}
+
+func TestShardHash(t *testing.T) {
+	o := shardOptions{strategy: shardHash}
+	if err := o.parse("tcp://a:1883,tcp://b:1883,tcp://c:1883"); err != nil {
+		t.Fatal(err)
+	}
+	devices := testDevices(300)
+	if err := o.assign(devices); err != nil {
+		t.Fatal(err)
+	}
+	counts := make([]int, 3)
+	for _, dev := range devices {
+		i := o.assigned[dev.Mac]
+		counts[i]++
+		// 同一个 MAC 总是分到同一个代理，运行时加入的设备也一样
+		if i != o.hash(dev.Mac) {
+			t.Fatalf("%s assigned %d, hash %d", dev.Mac, i, o.hash(dev.Mac))
+		}
+		server, failover := o.servers(dev.Mac)
+		if server != o.urls[i] || len(failover) != 2 || failover[0] != o.urls[(i+1)%3] || failover[1] != o.urls[(i+2)%3] {
+			t.Fatalf("%s: servers %s %v", dev.Mac, server, failover)
+		}
+	}
+	for i, n := range counts {
+		if n < 70 || n > 130 {
+			t.Errorf("broker %d got %d of 300 devices", i, n)
+		}
+	}
+	if s, _ := o.servers("NEW-BED"); s != o.urls[o.hash("NEW-BED")] {
+		t.Fatalf("runtime device assigned to %s", s)
+	}
+}
+
+func TestShardWeighted(t *testing.T) {
+	o := shardOptions{strategy: shardWeighted, weights: "3,0,1"}
+	if err := o.parse("tcp://a:1883,tcp://b:1883,tcp://c:1883"); err != nil {
+		t.Fatal(err)
+	}
+	devices := testDevices(8)
+	if err := o.assign(devices); err != nil {
+		t.Fatal(err)
+	}
+	counts := make([]int, 3)
+	for _, dev := range devices {
+		counts[o.assigned[dev.Mac]]++
+	}
+	if fmt.Sprint(counts) != "[6 0 2]" {
+		t.Fatalf("counts = %v, want [6 0 2]", counts)
+	}
+
+	for _, weights := range []string{"1,1", "0,0,0", "1,x,1", "1,-1,1"} {
+		o.weights = weights
+		if err := o.assign(devices); err == nil {
+			t.Errorf("expected error for weights %q", weights)
+		}
+	}
+}
+
+// 同一个主机的不同端点分开统计，没有路径的 ws 地址按客户端补上的路径匹配
+func TestShardStatsByURL(t *testing.T) {
+	o := shardOptions{strategy: shardRoundRobin, wsPath: "/mqtt"}
+	if err := o.parse("ws://h:1883,ws://h:1883/mqtt"); err == nil {
+		t.Fatal("expected duplicate broker error")
+	}
+	if err := o.parse("tcp://h:1883,ws://h:1883,ws://h:1883/mqtt2"); err != nil {
+		t.Fatal(err)
+	}
+	conns := []mqttclient.Client{serverClient{"ws://h:1883/mqtt"}, serverClient{"ws://h:1883/mqtt2"}, serverClient{"ws://h:1883/mqtt2"}, serverClient{}}
+	for _, c := range conns {
+		if st := o.stat(c); st != nil {
+			st.published.Add(1)
+		}
+	}
+	want := []string{
+		"broker=tcp://h:1883,connects=0,published=0,errors=0,conns=0",
+		"broker=ws://h:1883,connects=0,published=1,errors=0,conns=1",
+		"broker=ws://h:1883/mqtt2,connects=0,published=2,errors=0,conns=2",
+	}
+	if got := o.report(conns); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("report:\n%v\nwant\n%v", got, want)
+	}
+}
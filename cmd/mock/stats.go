@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// 运行统计，退出时输出
+var runStats = newStats()
+
+type stats struct {
+	start     time.Time
+	published map[string]*atomic.Int64 // 按消息类型统计发布成功的条数，创建后只读
+	bytes     atomic.Int64             // 发布成功的加密后负载字节数
+	errors    atomic.Int64             // 加密或发布失败
+	dropped   atomic.Int64             // 协程池饱和或已关闭，没有发布
+	coalesced atomic.Int64             // 被同一张床同一种消息的新一次发布替换
+	late      atomic.Int64             // 开始发布时已落后超过一个周期
+	connects  atomic.Int64             // 连接成功次数，包括自动重连
+}
+
+const (
+	statServerAck = "server_ack" // 控制命令的应答
+	statBoot      = "boot"       // 重新上线时的启动序列
+)
+
+func newStats() *stats {
+	s := &stats{start: time.Now(), published: make(map[string]*atomic.Int64)}
+	for _, g := range generators {
+		s.published[g.name] = new(atomic.Int64)
+	}
+	s.published[statServerAck] = new(atomic.Int64)
+	s.published[statBoot] = new(atomic.Int64)
+	return s
+}
+
+// 记录一次发布的结果，size 为负载字节数
+func (s *stats) publish(name string, size int, err error) {
+	if err != nil {
+		s.errors.Add(1)
+		return
+	}
+	s.published[name].Add(1)
+	s.bytes.Add(int64(size))
+}
+
+// 到目前为止发布成功的条数和字节数
+func (s *stats) totals() (int64, int64) {
+	var total int64
+	for _, n := range s.published {
+		total += n.Load()
+	}
+	return total, s.bytes.Load()
+}
+
+// 重连次数，clients 为启动时建立的连接数
+func (s *stats) reconnects(clients int) int64 {
+	return max(0, s.connects.Load()-int64(clients))
+}
+
+// 输出运行总结，clients 为启动时建立的连接数
+func (s *stats) summary(clients int) []string {
+	names := make([]string, 0, len(s.published))
+	var total int64
+	for name, n := range s.published {
+		if n.Load() > 0 {
+			names = append(names, name)
+			total += n.Load()
+		}
+	}
+	sort.Strings(names)
+	lines := []string{
+		fmt.Sprintf("summary: duration=%s,published=%d,bytes=%d,errors=%d,dropped=%d,coalesced=%d,late=%d,reconnects=%d", time.Since(s.start).Round(time.Millisecond), total, s.bytes.Load(), s.errors.Load(), s.dropped.Load(), s.coalesced.Load(), s.late.Load(), s.reconnects(clients)),
+	}
+	for _, name := range names {
+		lines = append(lines, fmt.Sprintf("  %s=%d", name, s.published[name].Load()))
+	}
+	return lines
+}
+
+// 输出到控制台和日志
+func (s *stats) print(clients int) {
+	for _, line := range s.summary(clients) {
+		fmt.Println(line)
+		log.Println(line)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// stormOptions 大面积断电场景参数：同时掉电一部分床，按启动时长分布陆续重连
+type stormOptions struct {
+	at         time.Duration // 启动后多久断电，0 表示不模拟
+	fraction   float64       // 断电的床的比例
+	boot       time.Duration // 平均启动时长
+	bootJitter time.Duration // 启动时长的标准差
+	wait       time.Duration // 全部上线后继续等待后台查询版本和状态的时长
+}
+
+func (o stormOptions) validate() error {
+	if o.fraction <= 0 || o.fraction > 1 {
+		return fmt.Errorf("outageFraction must be in (0, 1]")
+	}
+	if o.boot < 0 || o.bootJitter < 0 {
+		return fmt.Errorf("bootTime and bootJitter can't be negative")
+	}
+	return nil
+}
+
+// 随机的启动时长，正态分布，不小于 0
+func (o stormOptions) bootTime() time.Duration {
+	d := o.boot + time.Duration(rand.NormFloat64()*float64(o.bootJitter))
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// latencies 一组耗时，用于输出分位数
+type latencies struct {
+	mu sync.Mutex
+	d  []time.Duration
+}
+
+func (l *latencies) add(d time.Duration) {
+	l.mu.Lock()
+	l.d = append(l.d, d)
+	l.mu.Unlock()
+}
+
+func (l *latencies) String() string {
+	l.mu.Lock()
+	d := append([]time.Duration(nil), l.d...)
+	l.mu.Unlock()
+	if len(d) == 0 {
+		return "n=0"
+	}
+	sort.Slice(d, func(i, j int) bool { return d[i] < d[j] })
+	p := func(q float64) time.Duration { return d[int(q*float64(len(d)-1))] }
+	return fmt.Sprintf("n=%d,p50=%s,p95=%s,p99=%s,max=%s", len(d), p(0.5), p(0.95), p(0.99), d[len(d)-1])
+}
+
+// 一次断电风暴的统计
+type storm struct {
+	start     time.Time
+	retries   atomic.Int64
+	connect   latencies // CONNECT 到 CONNACK
+	version   latencies // 开始重连到收到后台 A0 版本查询
+	status    latencies // 开始重连到收到后台 B4 状态查询
+	recovered sync.Map  // mac -> *recovery
+}
+
+// 一张床开始重连的时间，以及是否已经收到后台查询
+type recovery struct {
+	at      time.Time
+	version atomic.Bool
+	status  atomic.Bool
+}
+
+// 当前正在进行的断电风暴，controlMsgRecHandler 用它记录后台响应耗时
+var activeStorm atomic.Pointer[storm]
+
+// 收到后台的查询，记录从开始重连到第一次查询的耗时
+func (s *storm) observe(mac string, cmd byte) {
+	v, ok := s.recovered.Load(mac)
+	if !ok {
+		return
+	}
+	r := v.(*recovery)
+	switch {
+	case cmd == 0xA0 && r.version.CompareAndSwap(false, true):
+		s.version.add(time.Since(r.at))
+	case cmd == 0xB4 && r.status.CompareAndSwap(false, true):
+		s.status.add(time.Since(r.at))
+	}
+}
+
+// 到时间后让一部分在线的床同时掉电，再按启动时长陆续上线，最后输出统计；ctx 结束时放弃
+func runStorm(ctx context.Context, beds []*bed, o stormOptions) {
+	if !sleepCtx(ctx, o.at) {
+		return
+	}
+	victims := make([]*bed, 0, len(beds))
+	for _, b := range beds {
+		if b.online.Load() {
+			victims = append(victims, b)
+		}
+	}
+	rand.Shuffle(len(victims), func(i, j int) { victims[i], victims[j] = victims[j], victims[i] })
+	victims = victims[:int(float64(len(victims))*o.fraction)]
+
+	s := &storm{start: time.Now()}
+	activeStorm.Store(s)
+	fmt.Println(fmt.Sprintf("outage: %d beds lose power", len(victims)))
+	log.Println(fmt.Sprintf("outage beds=%d", len(victims)))
+
+	var down sync.WaitGroup
+	for _, b := range victims {
+		down.Add(1)
+		go func() {
+			defer down.Done()
+			b.goOffline(disconnectAbrupt)
+		}()
+	}
+	down.Wait()
+
+	var up sync.WaitGroup
+	for _, b := range victims {
+		up.Add(1)
+		go func() {
+			defer up.Done()
+			if !sleepCtx(ctx, o.bootTime()) || b.removed.Load() {
+				return
+			}
+			for {
+				// 先登记再连接，连接后后台可能立即查询
+				r := &recovery{at: time.Now()}
+				s.recovered.Store(b.Mac, r)
+				d, err := b.goOnline()
+				if err == nil {
+					s.connect.add(d)
+					return
+				}
+				s.retries.Add(1)
+				log.Println(fmt.Sprintf("reconnect mac=%s,err=%v", b.Mac, err))
+				errorLog.add(b.Mac, "reconnect", err)
+				if !sleepCtx(ctx, time.Second+time.Duration(rand.Int63n(int64(4*time.Second)))) || b.removed.Load() {
+					return
+				}
+			}
+		}()
+	}
+	up.Wait()
+	recoveredIn := time.Since(s.start)
+	sleepCtx(ctx, o.wait)
+	activeStorm.Store(nil)
+
+	report := []string{
+		fmt.Sprintf("outage report: beds=%d,recovered=%s,retries=%d", len(victims), recoveredIn.Round(time.Millisecond), s.retries.Load()),
+		"  connect " + s.connect.String(),
+		"  version(A0) " + s.version.String(),
+		"  status(B4) " + s.status.String(),
+	}
+	for _, line := range report {
+		fmt.Println(line)
+		log.Println(line)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+
+	"mock-bed/pkg/identity"
+	"mock-bed/pkg/mqttclient"
+	"mock-bed/pkg/netem"
+)
+
+// 连接拓扑
+const (
+	topologySeparate = "separate" // 每张床两个连接：业务客户端和 "ota-"+mac 客户端（旧固件）
+	topologyShared   = "shared"   // 每张床一个连接，同时订阅业务和 ota 主题（新固件）
+	topologyMux      = "mux"      // 多张床共用一个连接，只用于吞吐量测试
+)
+
+// topologyOptions 连接拓扑参数
+type topologyOptions struct {
+	mode    string
+	muxBeds int // mux 拓扑下每个连接服务的床数
+	offset  int // 设备在完整设备列表中的起始位置，工作进程不为 0，mux 客户端ID按完整列表中的序号编号
+}
+
+func (o topologyOptions) validate() error {
+	switch o.mode {
+	case topologySeparate, topologyShared:
+		return nil
+	case topologyMux:
+		if o.muxBeds <= 0 {
+			return fmt.Errorf("muxBeds must be positive")
+		}
+		if broker.deviceAuth {
+			return fmt.Errorf("mux topology shares connections between beds and can't use -deviceAuth")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown topology %q, expected separate, shared or mux", o.mode)
+}
+
+// 按拓扑为每台设备创建客户端
+func (o topologyOptions) connect(devices []identity.Device) []*bed {
+	beds := make([]*bed, 0, len(devices))
+	switch o.mode {
+	case topologySeparate:
+		for _, dev := range devices {
+			beds = append(beds, &bed{
+				Device:    dev,
+				client:    getMqttClient(dev.Mac, bedTopics(dev.Mac, false)),
+				otaClient: getOtaMqttClient(dev.Mac),
+			})
+		}
+	case topologyShared:
+		for _, dev := range devices {
+			beds = append(beds, &bed{Device: dev, client: getMqttClient(dev.Mac, bedTopics(dev.Mac, true))})
+		}
+	case topologyMux:
+		for _, group := range o.muxGroups(devices) {
+			var topics []string
+			for _, i := range group {
+				topics = append(topics, bedTopics(devices[i].Mac, true)...)
+			}
+			client := getMuxMqttClient(o.offset+group[0], devices[group[0]].Mac, topics)
+			for _, i := range group {
+				beds = append(beds, &bed{Device: devices[i], client: client})
+			}
+		}
+	}
+	for _, b := range beds {
+		b.online.Store(true)
+	}
+	return beds
+}
+
+// muxKey 共用一个连接的床必须连接同一个代理、使用相同的网络损伤参数
+type muxKey struct {
+	server string
+	impair netem.Profile
+}
+
+// 按代理和网络损伤参数把设备分组，每组最多 muxBeds 张床，返回设备序号；
+// 组内每张床原来分配的代理和损伤参数都不变，账号和客户端证书按组里第一张床
+func (o topologyOptions) muxGroups(devices []identity.Device) [][]int {
+	var groups [][]int
+	open := make(map[muxKey]int) // 每个键还没满的组
+	for i, dev := range devices {
+		server, _ := broker.shard.servers(dev.Mac)
+		key := muxKey{server: server, impair: broker.impair.profile(dev.Mac)}
+		g, ok := open[key]
+		if !ok || len(groups[g]) >= o.muxBeds {
+			g = len(groups)
+			groups = append(groups, nil)
+			open[key] = g
+		}
+		groups[g] = append(groups[g], i)
+	}
+	return groups
+}
+
+// 床使用的连接，shared 和 mux 拓扑下没有单独的 ota 客户端
+func (b *bed) conns() []mqttclient.Client {
+	if b.otaClient == nil {
+		return []mqttclient.Client{b.client}
+	}
+	return []mqttclient.Client{b.client, b.otaClient}
+}
+
+// 所有床使用的连接，mux 拓扑下多张床共用的连接只返回一次
+func uniqueConns(beds []*bed) []mqttclient.Client {
+	seen := make(map[mqttclient.Client]bool)
+	var conns []mqttclient.Client
+	for _, b := range beds {
+		for _, c := range b.conns() {
+			if !seen[c] {
+				seen[c] = true
+				conns = append(conns, c)
+			}
+		}
+	}
+	return conns
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"mock-bed/pkg/identity"
+)
+
+// mux 拓扑的每个连接只包含分到同一个代理的床
+func TestMuxGroupsByBroker(t *testing.T) {
+	saved := broker.shard
+	defer func() { broker.shard = saved }()
+	broker.shard = shardOptions{strategy: shardRoundRobin}
+	if err := broker.shard.parse("tcp://a:1883,tcp://b:1883"); err != nil {
+		t.Fatal(err)
+	}
+	devices := make([]identity.Device, 7)
+	for i := range devices {
+		devices[i] = identity.Device{Mac: fmt.Sprintf("AABBCCDDEE%02X", i)}
+	}
+	if err := broker.shard.assign(devices); err != nil {
+		t.Fatal(err)
+	}
+
+	groups := topologyOptions{mode: topologyMux, muxBeds: 2}.muxGroups(devices)
+	want := [][]int{{0, 2}, {1, 3}, {4, 6}, {5}}
+	if fmt.Sprint(groups) != fmt.Sprint(want) {
+		t.Fatalf("got %v, want %v", groups, want)
+	}
+}
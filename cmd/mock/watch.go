@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 收发消息的种类
+const (
+	kindCommand = "command" // 收到的后台命令
+	kindAck     = "ack"     // 发出的命令应答
+	kindPublish = "publish" // 发出的周期数据和事件
+)
+
+// 每个订阅者缓冲的事件数，跟不上时丢弃
+const watchBuffer = 256
+
+// trafficHub 把收发的消息广播给控制接口 /watch 和仪表盘的订阅者，没有订阅者时不生成事件
+type trafficHub struct {
+	mu   sync.RWMutex
+	subs map[*watcher]struct{}
+	full map[string]int // mac -> 需要完整明文帧的订阅者数
+	n    atomic.Int32
+}
+
+// 收发消息的广播，控制接口和 controlMsgRecHandler 共用
+var traffic trafficHub
+
+// watcher 一个 /watch 订阅者
+type watcher struct {
+	macs    map[string]bool // 为空时所有设备
+	kinds   map[string]bool // 为空时所有种类
+	full    bool            // 事件带上完整的明文帧，只用于进程内的订阅者
+	ch      chan trafficEvent
+	dropped atomic.Int64
+}
+
+// trafficEvent 一条收发的消息
+type trafficEvent struct {
+	Kind string `json:"kind"`
+	Mac  string `json:"mac"`
+	messageView
+	raw []byte // 完整的明文帧，只有 full 订阅者的 publish 事件有
+}
+
+// 记录一条收发的明文帧，只保留开头
+func newRecentMsg(at time.Time, name, topic string, data []byte, err error) recentMsg {
+	return recentMsg{at: at, name: name, topic: topic, head: data[:min(len(data), recentDataLen)], size: len(data), err: err}
+}
+
+func (h *trafficHub) active() bool {
+	return h.n.Load() > 0
+}
+
+// 有需要这台设备完整明文帧的订阅者
+func (h *trafficHub) wantsFull(mac string) bool {
+	if !h.active() {
+		return false
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.full[mac] > 0
+}
+
+func (h *trafficHub) subscribe(macs, kinds []string, full bool) *watcher {
+	w := &watcher{full: full, ch: make(chan trafficEvent, watchBuffer)}
+	if len(macs) > 0 {
+		w.macs = make(map[string]bool, len(macs))
+		for _, mac := range macs {
+			w.macs[mac] = true
+		}
+	}
+	if len(kinds) > 0 {
+		w.kinds = make(map[string]bool, len(kinds))
+		for _, kind := range kinds {
+			w.kinds[kind] = true
+		}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs == nil {
+		h.subs = make(map[*watcher]struct{})
+		h.full = make(map[string]int)
+	}
+	h.subs[w] = struct{}{}
+	if full {
+		for mac := range w.macs {
+			h.full[mac]++
+		}
+	}
+	h.n.Add(1)
+	return w
+}
+
+func (h *trafficHub) unsubscribe(w *watcher) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subs, w)
+	if w.full {
+		for mac := range w.macs {
+			if h.full[mac]--; h.full[mac] <= 0 {
+				delete(h.full, mac)
+			}
+		}
+	}
+	h.n.Add(-1)
+}
+
+// 发给关注这台设备和这种消息的订阅者，不阻塞发布；wantsFull 时 m.head 是完整的明文帧
+func (h *trafficHub) emit(kind, mac string, m recentMsg) {
+	if !h.active() {
+		return
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	var ev *trafficEvent
+	for w := range h.subs {
+		if (w.macs != nil && !w.macs[mac]) || (w.kinds != nil && !w.kinds[kind]) {
+			continue
+		}
+		if ev == nil {
+			ev = &trafficEvent{Kind: kind, Mac: mac, messageView: m.view()}
+		}
+		e := *ev
+		if w.full {
+			e.raw = m.head
+		}
+		select {
+		case w.ch <- e:
+		default:
+			w.dropped.Add(1)
+		}
+	}
+}
+
+// 以 SSE 推送收发的消息，每条消息一个 data 事件；订阅者跟不上时推送 dropped 事件，数据为丢弃的条数
+func (s *controlServer) watch(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	for _, kind := range q["kind"] {
+		switch kind {
+		case kindCommand, kindAck, kindPublish:
+		default:
+			http.Error(w, fmt.Sprintf("unknown kind %q, expected command, ack or publish", kind), http.StatusBadRequest)
+			return
+		}
+	}
+	flusher := startEvents(w)
+	if flusher == nil {
+		return
+	}
+	sub := traffic.subscribe(q["mac"], q["kind"], false)
+	defer traffic.unsubscribe(sub)
+	// 定时发送注释，保持连接并及时报告丢弃的条数
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case ev := <-sub.ch:
+			// 一次写出缓冲的所有事件再刷新
+			for more := true; more; {
+				data, _ := json.Marshal(ev)
+				fmt.Fprintf(w, "data: %s\n\n", data)
+				select {
+				case ev = <-sub.ch:
+				default:
+					more = false
+				}
+			}
+		}
+		if n := sub.dropped.Swap(0); n > 0 {
+			fmt.Fprintf(w, "event: dropped\ndata: %d\n\n", n)
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+// workerClient 以工作进程运行时和协调者通信
+type workerClient struct {
+	url     string
+	a       assignment
+	cancel  context.CancelFunc // 协调者要求停止时调用
+	pushing atomic.Bool
+}
+
+// 向协调者注册，等所有工作进程到齐后取得分配的床和协调者的参数，参数覆盖本地的同名参数
+func joinCoordinator(url string) (*workerClient, error) {
+	if !strings.Contains(url, "://") {
+		url = "http://" + url
+	}
+	w := &workerClient{url: strings.TrimSuffix(url, "/")}
+	host, _ := os.Hostname()
+	body, _ := json.Marshal(registration{Host: fmt.Sprintf("%s/%d", host, os.Getpid())})
+	fmt.Println("joining coordinator", w.url)
+	if err := w.post(context.Background(), pathRegister, "application/json", bytes.NewReader(body), &w.a); err != nil {
+		return nil, err
+	}
+	for _, arg := range w.a.Args {
+		name, value, _ := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if err := flag.Set(name, value); err != nil {
+			return nil, fmt.Errorf("apply coordinator flag %s: %w", arg, err)
+		}
+	}
+	fmt.Println(fmt.Sprintf("worker %d: beds %d-%d of %d", w.a.ID, w.a.Offset, w.a.Offset+w.a.Count, w.a.Total))
+	return w, nil
+}
+
+// 床都已连接，等待所有工作进程就绪后协调者给出的开始时间。
+// 开始时间按协调者的时钟，工作进程和协调者在同一台机器上或时钟已同步
+func (w *workerClient) waitStart() error {
+	var reply startReply
+	if err := w.post(context.Background(), pathReady, "application/json", nil, &reply); err != nil {
+		return err
+	}
+	line := fmt.Sprintf("worker %d: start at %s", w.a.ID, reply.StartAt.Format(time.RFC3339Nano))
+	fmt.Println(line)
+	log.Println(line)
+	time.Sleep(time.Until(reply.StartAt))
+	return nil
+}
+
+// 每秒调用一次，上一次推送还没有完成时跳过
+func (w *workerClient) push() {
+	if !w.pushing.CompareAndSwap(false, true) {
+		return
+	}
+	defer w.pushing.Store(false)
+	if err := w.pushMetrics(); err != nil {
+		log.Println("push metrics:", err)
+	}
+}
+
+// 推送当前的指标，协调者要求停止时结束运行
+func (w *workerClient) pushMetrics() error {
+	families, err := metrics.registry.Gather()
+	if err != nil {
+		return err
+	}
+	format := expfmt.NewFormat(expfmt.TypeProtoDelim)
+	var buf bytes.Buffer
+	enc := expfmt.NewEncoder(&buf, format)
+	for _, f := range families {
+		if err := enc.Encode(f); err != nil {
+			return err
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var reply pushReply
+	if err := w.post(ctx, pathPush, string(format), &buf, &reply); err != nil {
+		return err
+	}
+	if reply.Stop && w.cancel != nil {
+		w.cancel()
+	}
+	return nil
+}
+
+// 运行结束后推送最后的指标并上传报告
+func (w *workerClient) finish(r *runReport) error {
+	if err := w.pushMetrics(); err != nil {
+		return err
+	}
+	body, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return w.post(ctx, pathReport, "application/json", bytes.NewReader(body), nil)
+}
+
+// 注册之后的请求带上 ?id=，reply 不为 nil 时解析 JSON 响应
+func (w *workerClient) post(ctx context.Context, path, contentType string, body io.Reader, reply any) error {
+	url := w.url + path
+	if path != pathRegister {
+		url += "?id=" + strconv.Itoa(w.a.ID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s: %s", path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if reply == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(reply)
+}
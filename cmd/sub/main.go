@@ -3,14 +3,15 @@ package main
 import (
 	"bytes"
 	"encoding/hex"
+	"flag"
 	"fmt"
 	"log"
 	"strings"
 	"sync"
 
 	"mock-bed/pkg/encryption"
-
-	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"mock-bed/pkg/mqttclient"
+	"mock-bed/pkg/tlsconf"
 )
 
 func main() {
@@ -21,24 +22,52 @@ func main() {
 	//defer file.Close() // 关闭文件
 	//log.SetOutput(file)
 
-	getMqttClient()
+	brokerURL := flag.String("broker", BROKER_HOST, "MQTT broker URL: tcp://, ssl:// (with the -tls* flags), ws:// or wss://")
+	user := flag.String("username", USERNAME, "MQTT username")
+	password := flag.String("password", PWD, "MQTT password")
+	clientID := flag.String("clientId", CLIENTID, "MQTT client id")
+	var protocol mqttclient.ProtocolOptions
+	protocol.RegisterFlags(flag.CommandLine)
+	var tlsOpts tlsconf.Options
+	tlsOpts.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
+	tlsSource, err := tlsOpts.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if tlsSource != nil && !mqttclient.UsesTLS(*brokerURL) {
+		log.Fatal("-tls* flags need an ssl://, mqtts:// or wss:// broker url")
+	}
+	opts := mqttclient.Options{
+		Broker:    *brokerURL, // MQTT 代理服务器地址
+		ClientID:  *clientID,  // 设置客户端ID
+		Username:  *user,      // 设置用户名
+		Password:  *password,  // 设置密码
+		OnConnect: onConnnect, // 设置连接处理器
+	}
+	protocol.Apply(&opts)
+	if tlsSource != nil {
+		opts.TLS, err = tlsSource.Config(*clientID)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	getMqttClient(opts)
 
 	var wg sync.WaitGroup
 	wg.Add(1)
 	wg.Wait()
 }
 
-func getMqttClient() MQTT.Client {
-	opts := MQTT.NewClientOptions().AddBroker(BROKER_HOST) // 创建 MQTT 客户端选项
-	opts.SetUsername(USERNAME)                             // 设置用户名
-	opts.SetPassword(PWD)                                  // 设置密码
-	opts.SetClientID(CLIENTID)                             // 设置客户端ID
-	opts.OnConnect = onConnnect                            // 设置连接处理器
-
-	client := MQTT.NewClient(opts)                                       // 创建 MQTT 客户端实例
-	if token := client.Connect(); token.Wait() && token.Error() != nil { // 连接到 MQTT 代理
+func getMqttClient(opts mqttclient.Options) mqttclient.Client {
+	client, err := mqttclient.New(opts) // 创建 MQTT 客户端实例
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := client.Connect(); err != nil { // 连接到 MQTT 代理
 		log.Println("can't connect to broker.")
-		panic(token.Error())
+		panic(err)
 	}
 	return client
 }
@@ -55,22 +84,22 @@ const (
 // var msgRecHandler MQTT.MessageHandler = ...
 
 // 连接处理器函数
-func onConnnect(client MQTT.Client) {
+func onConnnect(client mqttclient.Client) {
 	log.Println("Connect to broker successed. ")
 	// mac := "24C60018CSMX0028800000-00V1325"
 	mac := "24C60011CSMX0028800000-00V1325"
-	if t := client.Subscribe(fmt.Sprintf(HARDWARE_PUB_TOPIC, mac), 0, controlMsgRecHandler); t.Wait() && t.Error() != nil {
+	if err := client.Subscribe(fmt.Sprintf(HARDWARE_PUB_TOPIC, mac), 0, controlMsgRecHandler); err != nil {
 		log.Println("Can't not subscribe " + fmt.Sprintf(HARDWARE_PUB_TOPIC, mac) + " topic.")
-		panic(t.Error())
+		panic(err)
 	}
 	log.Println("Start subscribe  topic.")
 }
 
 // 消息接收处理器函数
-func controlMsgRecHandler(client MQTT.Client, msg MQTT.Message) {
-	payload := msg.Payload()
+func controlMsgRecHandler(client mqttclient.Client, msg mqttclient.Message) {
+	payload := msg.Payload
 	// log.Printf("Recv msg : %s\n", payload) // 打印接收到的消息
-	topic := msg.Topic()
+	topic := msg.Topic
 	topicItem := strings.Split(topic, "/")
 	mac := topicItem[1]
 	name := topicItem[2]
@@ -98,10 +127,13 @@ func controlMsgRecHandler(client MQTT.Client, msg MQTT.Message) {
 				fmt.Println("Encrypt error:", err)
 			}
 			// 发布响应消息
-			token := client.Publish(fmt.Sprintf("qrem/%s/server_ack", mac), 0, false, encryptedData)
-			token.Wait()
-			// 打印响应命令
-			log.Println(fmt.Sprintf("public topic=server_ack,mac=%s,cmd=%X", mac, 0xA0))
+			go func() {
+				if err := client.Publish(fmt.Sprintf("qrem/%s/server_ack", mac), 0, false, encryptedData); err != nil {
+					log.Println(err)
+				}
+				// 打印响应命令
+				log.Println(fmt.Sprintf("public topic=server_ack,mac=%s,cmd=%X", mac, 0xA0))
+			}()
 		}
 	}
 	if strings.EqualFold("get_bed_status", name) {
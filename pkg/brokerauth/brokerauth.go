@@ -0,0 +1,90 @@
+// Package brokerauth 为模拟设备生成独立的 MQTT 账号，以及 mosquitto / EMQX 使用的密码哈希。
+// 设备密码由共享密钥和 MAC 推导，cmd/mock 和 cmd/gen-broker-auth 不需要交换文件。
+package brokerauth
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+const (
+	DefaultSecret = "mock-bed" // 默认推导密钥
+
+	mosquittoIterations = 101 // 与 mosquitto_passwd 默认值一致
+	mosquittoSaltLen    = 12
+)
+
+// Password 由密钥和 MAC 推导设备密码
+func Password(secret, mac string) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(mac))
+	return hex.EncodeToString(h.Sum(nil))[:24]
+}
+
+// MosquittoHash 生成 mosquitto 2.x 密码文件使用的 $7$ (PBKDF2-SHA512) 哈希
+func MosquittoHash(password string) (string, error) {
+	salt := make([]byte, mosquittoSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	return mosquittoHash(password, salt)
+}
+
+// $7$迭代次数$base64(salt)$base64(key)
+func mosquittoHash(password string, salt []byte) (string, error) {
+	key, err := pbkdf2.Key(sha512.New, password, salt, mosquittoIterations, sha512.Size)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("$7$%d$%s$%s", mosquittoIterations,
+		base64.StdEncoding.EncodeToString(salt), base64.StdEncoding.EncodeToString(key)), nil
+}
+
+// EMQXHash 生成 EMQX 内置数据库认证使用的 sha256 哈希（salt_position = suffix）
+func EMQXHash(password string) (hash, salt string, err error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	salt = hex.EncodeToString(buf)
+	return emqxHash(password, salt), salt, nil
+}
+
+// hex(sha256(password + salt))
+func emqxHash(password, salt string) string {
+	sum := sha256.Sum256([]byte(password + salt))
+	return hex.EncodeToString(sum[:])
+}
+
+// MosquittoACL mosquitto acl_file 中一个用户的配置，以空行结尾
+func MosquittoACL(user string, readwrite, read []string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "user %s\n", user)
+	for _, topic := range readwrite {
+		fmt.Fprintf(&b, "topic readwrite %s\n", topic)
+	}
+	for _, topic := range read {
+		fmt.Fprintf(&b, "topic read %s\n", topic)
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+// EMQXACL EMQX acl.conf 中一个用户的规则，文件最后还需要 {deny, all}.
+func EMQXACL(user string, readwrite, read []string) string {
+	var b strings.Builder
+	for _, topic := range readwrite {
+		fmt.Fprintf(&b, "{allow, {username, %q}, all, [%q]}.\n", user, topic)
+	}
+	for _, topic := range read {
+		fmt.Fprintf(&b, "{allow, {username, %q}, subscribe, [%q]}.\n", user, topic)
+	}
+	return b.String()
+}
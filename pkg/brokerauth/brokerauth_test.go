@@ -0,0 +1,50 @@
+package brokerauth
+
+import (
+	"strings"
+	"testing"
+)
+
+// 固定盐的结果与 mosquitto_passwd 的算法（PBKDF2-SHA512，101 次，12 字节盐）一致
+func TestMosquittoHash(t *testing.T) {
+	salt := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+	got, err := mosquittoHash("secret-pw", salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "$7$101$AQIDBAUGBwgJCgsM$W8p6/IOYt1BvhoaZqWdUplIcpTveMBdouTI34ix70MkusnGb29AuKC9evrc/IPsqMFhC4h0JgOtZLoG4uxvhgQ=="
+	if got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+	// 随机盐每次不同，格式不变
+	a, _ := MosquittoHash("secret-pw")
+	b, _ := MosquittoHash("secret-pw")
+	if a == b || !strings.HasPrefix(a, "$7$101$") || len(a) != len(want) {
+		t.Fatalf("unexpected hashes %s %s", a, b)
+	}
+}
+
+func TestEMQXHash(t *testing.T) {
+	if got := emqxHash("secret-pw", "0102030405060708"); got != "43b463d6f2b89d29fefb94cd6960dc5d613076ab4c3237118c58acb61707fb77" {
+		t.Fatalf("got %s", got)
+	}
+	hash, salt, err := EMQXHash("secret-pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(salt) != 16 || hash != emqxHash("secret-pw", salt) {
+		t.Fatalf("hash %s does not match salt %s", hash, salt)
+	}
+}
+
+func TestACL(t *testing.T) {
+	rw, r := []string{"qrem/BED-1/#"}, []string{"qrem/ota-BED-1/ota"}
+	if got := MosquittoACL("BED-1", rw, r); got != "user BED-1\ntopic readwrite qrem/BED-1/#\ntopic read qrem/ota-BED-1/ota\n\n" {
+		t.Fatalf("mosquitto acl %q", got)
+	}
+	want := `{allow, {username, "BED-1"}, all, ["qrem/BED-1/#"]}.` + "\n" +
+		`{allow, {username, "BED-1"}, subscribe, ["qrem/ota-BED-1/ota"]}.` + "\n"
+	if got := EMQXACL("BED-1", rw, r); got != want {
+		t.Fatalf("emqx acl %q", got)
+	}
+}
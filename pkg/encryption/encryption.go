@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"errors"
+	"slices"
 )
 
 const (
@@ -22,6 +24,17 @@ var (
 	}
 )
 
+// 默认密钥的 AES 分组只创建一次，cipher.Block 没有内部状态，可以并发使用
+var defaultBlock = mustCipher(defaultKey)
+
+func mustCipher(key []byte) cipher.Block {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	return block
+}
+
 // PKCS7Padding 填充
 func pKCS7Padding(data []byte, blockSize int) []byte {
 	padding := blockSize - len(data)%blockSize
@@ -29,15 +42,47 @@ func pKCS7Padding(data []byte, blockSize int) []byte {
 	return append(data, padText...)
 }
 
-// PKCS7UnPadding 去除填充
-func pKCS7UnPadding(data []byte) []byte {
+var errPadding = errors.New("encryption: invalid padding")
+
+// PKCS7UnPadding 去除填充，填充长度必须在 [1, 16] 内、不超过数据长度，且每个填充字节都相同；
+// 收到的命令来自代理上的任意客户端，不合法时返回错误
+func pKCS7UnPadding(data []byte) ([]byte, error) {
 	length := len(data)
+	if length == 0 {
+		return nil, errPadding
+	}
 	unPadding := int(data[length-1])
-	return data[:(length - unPadding)]
+	if unPadding < 1 || unPadding > aes.BlockSize || unPadding > length {
+		return nil, errPadding
+	}
+	for _, b := range data[length-unPadding:] {
+		if int(b) != unPadding {
+			return nil, errPadding
+		}
+	}
+	return data[:(length - unPadding)], nil
 }
 
 func Encrypt(content []byte) ([]byte, error) {
-	return encrypt2(aesCBC5P, content, defaultKey, defaultIV)
+	if content == nil {
+		return nil, nil
+	}
+	return AppendEncrypt(nil, content), nil
+}
+
+// AppendEncrypt 用默认密钥加密 content 并追加到 dst 后返回，dst 容量足够时不分配内存；
+// 填充和加密都在 dst 中进行，不修改 content
+func AppendEncrypt(dst, content []byte) []byte {
+	n := (len(content)/aes.BlockSize + 1) * aes.BlockSize
+	dst = slices.Grow(dst, n)
+	out := dst[len(dst) : len(dst)+n]
+	copy(out, content)
+	padding := byte(n - len(content))
+	for i := len(content); i < n; i++ {
+		out[i] = padding
+	}
+	cipher.NewCBCEncrypter(defaultBlock, defaultIV).CryptBlocks(out, out)
+	return dst[:len(dst)+n]
 }
 
 // Encrypt AES加密
@@ -71,7 +116,15 @@ func encrypt2(mode string, content, key, iv []byte) ([]byte, error) {
 }
 
 func Decrypt(content []byte) ([]byte, error) {
-	return decrypt2(aesCBC5P, content, defaultKey, defaultIV)
+	if content == nil {
+		return nil, nil
+	}
+	if len(content) == 0 || len(content)%aes.BlockSize != 0 {
+		return nil, errors.New("encryption: ciphertext is not a multiple of the block size")
+	}
+	origData := make([]byte, len(content))
+	cipher.NewCBCDecrypter(defaultBlock, defaultIV).CryptBlocks(origData, content)
+	return pKCS7UnPadding(origData)
 }
 
 // Decrypt AES解密
@@ -98,5 +151,5 @@ func decrypt2(mode string, content, key, iv []byte) ([]byte, error) {
 	}
 
 	// 去除填充
-	return pKCS7UnPadding(origData), nil
+	return pKCS7UnPadding(origData)
 }
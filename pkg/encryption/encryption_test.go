@@ -0,0 +1,69 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"testing"
+)
+
+func TestEncrypt(t *testing.T) {
+	for _, n := range []int{0, 1, 15, 16, 17, 1026} {
+		content := bytes.Repeat([]byte{0x71}, n)
+		got, err := Encrypt(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 和通用实现的结果一致
+		want, _ := encrypt2(aesCBC5P, bytes.Clone(content), defaultKey, defaultIV)
+		if !bytes.Equal(got, want) {
+			t.Fatalf("len %d: ciphertext differs from encrypt2", n)
+		}
+		plain, err := Decrypt(got)
+		if err != nil || !bytes.Equal(plain, content) {
+			t.Fatalf("len %d: round trip failed: %v", n, err)
+		}
+	}
+
+	// 追加到已有数据之后，不修改输入
+	content := []byte{0x55, 4}
+	buf := make([]byte, 3, 64)
+	out := AppendEncrypt(buf, content)
+	if len(out) != 3+16 || &out[0] != &buf[0] || !bytes.Equal(content, []byte{0x55, 4}) {
+		t.Fatalf("unexpected append result len=%d", len(out))
+	}
+
+	if _, err := Decrypt([]byte{1, 2, 3}); err == nil {
+		t.Fatal("expected error for truncated ciphertext")
+	}
+
+	// 最后一个字节为 0、大于 16 或填充字节不一致时返回错误，不能 panic
+	for _, last := range [][]byte{{0}, {17}, {0xff}, {9, 2}} {
+		plain := bytes.Repeat([]byte{1}, 16)
+		copy(plain[16-len(last):], last)
+		enc := make([]byte, 16)
+		cipher.NewCBCEncrypter(defaultBlock, defaultIV).CryptBlocks(enc, plain)
+		if _, err := Decrypt(enc); err == nil {
+			t.Fatalf("expected padding error for plaintext ending in %v", last)
+		}
+	}
+}
+
+// 加密一帧 1026 字节的压力垫数据：go test -bench . -benchmem ./pkg/encryption
+func BenchmarkEncrypt(b *testing.B) {
+	content := make([]byte, 1026)
+	b.SetBytes(int64(len(content)))
+	b.ReportAllocs()
+	for b.Loop() {
+		Encrypt(content)
+	}
+}
+
+func BenchmarkAppendEncrypt(b *testing.B) {
+	content := make([]byte, 1026)
+	buf := make([]byte, 0, 2048)
+	b.SetBytes(int64(len(content)))
+	b.ReportAllocs()
+	for b.Loop() {
+		buf = AppendEncrypt(buf[:0], content)
+	}
+}
@@ -0,0 +1,283 @@
+// Package identity 生成或导入模拟床的设备身份，cmd/mock 和 cmd/gen-device-sql 共用，
+// 保证数据库种子数据和模拟设备一一对应。
+package identity
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	DefaultTemplate = "25MM111111110038100000-%d" // 默认 MAC 模板
+	DefaultModel    = "EK-E"                      // 默认床型
+)
+
+// 绑定模式，决定两侧绑定的用户以及模拟时哪一侧有人
+const (
+	ProfileCouple      = "couple"       // 两侧都有人
+	ProfileSingle      = "single"       // 只有左侧有人
+	ProfileSingleRight = "single-right" // 只有右侧有人
+	ProfileUnbound     = "unbound"      // 未绑定用户，空床
+)
+
+// Side 床的左右两侧，取值与协议中的 opt 一致
+type Side byte
+
+const (
+	Left  Side = 0x01
+	Right Side = 0x02
+)
+
+// Device 一张床的身份信息
+type Device struct {
+	Mac       string `json:"mac"`
+	Model     string `json:"model"`
+	Profile   string `json:"profile"`   // 模拟配置名
+	LeftUser  string `json:"leftUser"`  // 左侧绑定用户
+	RightUser string `json:"rightUser"` // 右侧绑定用户
+}
+
+// Occupied 判断某一侧是否有人：优先按 Profile，其次按绑定的用户，都没有时两侧都有人
+func (d Device) Occupied(side Side) bool {
+	switch d.Profile {
+	case ProfileCouple:
+		return true
+	case ProfileSingle:
+		return side == Left
+	case ProfileSingleRight:
+		return side == Right
+	case ProfileUnbound:
+		return false
+	}
+	if d.LeftUser != "" || d.RightUser != "" {
+		return (side == Left && d.LeftUser != "") || (side == Right && d.RightUser != "")
+	}
+	return true
+}
+
+// Options 设备身份相关的命令行参数
+type Options struct {
+	Template    string
+	Pad         int
+	Model       string
+	File        string
+	Bind        string
+	UserIDStart int
+}
+
+// RegisterFlags 注册 -macTemplate、-macPad、-model、-devices、-bind、-userIdStart 参数
+func (o *Options) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.Template, "macTemplate", DefaultTemplate, "MAC template, must contain one %d verb")
+	fs.IntVar(&o.Pad, "macPad", 0, "zero pad the MAC number to this width")
+	fs.StringVar(&o.Model, "model", DefaultModel, "bed model of generated devices")
+	fs.StringVar(&o.File, "devices", "", "load the device list from a CSV or JSON file instead of the MAC template")
+	fs.StringVar(&o.Bind, "bind", "", "user binding pattern of generated devices, e.g. couple:2,single:1,unbound:1")
+	fs.IntVar(&o.UserIDStart, "userIdStart", 100000, "first generated user id")
+}
+
+// Devices 有 -devices 时从文件加载，否则按模板生成 [start, end) 的设备
+func (o *Options) Devices(start, end int) ([]Device, error) {
+	if o.File != "" {
+		return Load(o.File)
+	}
+	devices, err := Range(o.Template, o.Pad, start, end)
+	if err != nil {
+		return nil, err
+	}
+	pattern, err := ParseBind(o.Bind)
+	if err != nil {
+		return nil, err
+	}
+	for i := range devices {
+		devices[i].Model = o.Model
+		if len(pattern) > 0 {
+			n := start + i
+			bindUsers(&devices[i], pattern[n%len(pattern)], o.UserIDStart+2*n)
+		}
+	}
+	return devices, nil
+}
+
+// ParseBind 解析 profile[:weight] 逗号分隔的绑定模式，按权重展开
+func ParseBind(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var pattern []string
+	for _, item := range strings.Split(s, ",") {
+		profile, weight, found := strings.Cut(strings.TrimSpace(item), ":")
+		n := 1
+		if found {
+			var err error
+			n, err = strconv.Atoi(weight)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("identity: invalid weight in %q", item)
+			}
+		}
+		if !validProfile(profile) {
+			return nil, fmt.Errorf("identity: unknown profile %q", profile)
+		}
+		for range n {
+			pattern = append(pattern, profile)
+		}
+	}
+	if len(pattern) == 0 {
+		return nil, fmt.Errorf("identity: bind %q has a total weight of 0", s)
+	}
+	return pattern, nil
+}
+
+func validProfile(profile string) bool {
+	switch profile {
+	case ProfileCouple, ProfileSingle, ProfileSingleRight, ProfileUnbound:
+		return true
+	}
+	return false
+}
+
+// 按 profile 绑定用户，编号为 n 的设备使用用户 id base（左）和 base+1（右），与设备范围无关
+func bindUsers(d *Device, profile string, base int) {
+	d.Profile = profile
+	if d.Occupied(Left) {
+		d.LeftUser = strconv.Itoa(base)
+	}
+	if d.Occupied(Right) {
+		d.RightUser = strconv.Itoa(base + 1)
+	}
+}
+
+// Format 按模板生成第 n 个 MAC，pad > 0 时数字补零到 pad 位
+func Format(template string, pad, n int) string {
+	if pad > 0 {
+		template = strings.Replace(template, "%d", fmt.Sprintf("%%0%dd", pad), 1)
+	}
+	return fmt.Sprintf(template, n)
+}
+
+// Range 按模板生成编号 [start, end) 的设备
+func Range(template string, pad, start, end int) ([]Device, error) {
+	if strings.Count(template, "%d") != 1 || strings.Count(template, "%") != 1 {
+		return nil, fmt.Errorf("identity: template %q must contain exactly one %%d", template)
+	}
+	if end < start {
+		return nil, fmt.Errorf("identity: invalid range [%d, %d)", start, end)
+	}
+	devices := make([]Device, 0, end-start)
+	for i := start; i < end; i++ {
+		devices = append(devices, Device{Mac: Format(template, pad, i), Model: DefaultModel})
+	}
+	return devices, nil
+}
+
+// Load 根据扩展名从 CSV 或 JSON 文件加载设备列表
+func Load(path string) ([]Device, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var devices []Device
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		devices, err = ReadJSON(file)
+	case ".csv":
+		devices, err = ReadCSV(file)
+	default:
+		return nil, fmt.Errorf("identity: unsupported device file %s", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("identity: %s: %w", path, err)
+	}
+	return devices, nil
+}
+
+// ReadJSON 读取 Device 数组
+func ReadJSON(r io.Reader) ([]Device, error) {
+	var devices []Device
+	if err := json.NewDecoder(r).Decode(&devices); err != nil {
+		return nil, err
+	}
+	return normalize(devices)
+}
+
+// ReadCSV 读取 mac,model,profile,left_user,right_user 格式的 CSV，
+// 只有 mac 列是必须的，第一行以 mac 开头时作为表头跳过。
+func ReadCSV(r io.Reader) ([]Device, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	reader.Comment = '#'
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	devices := make([]Device, 0, len(records))
+	for i, record := range records {
+		if i == 0 && strings.EqualFold(record[0], "mac") {
+			continue
+		}
+		field := func(n int) string {
+			if n < len(record) {
+				return strings.TrimSpace(record[n])
+			}
+			return ""
+		}
+		devices = append(devices, Device{
+			Mac:       field(0),
+			Model:     field(1),
+			Profile:   field(2),
+			LeftUser:  field(3),
+			RightUser: field(4),
+		})
+	}
+	return normalize(devices)
+}
+
+// CheckMac 检查 MAC 能否用在 MQTT 主题和客户端ID中：不能为空，不能包含空白、/ 和通配符 + #
+func CheckMac(mac string) error {
+	if mac == "" {
+		return errors.New("empty mac")
+	}
+	if strings.ContainsAny(mac, "/+#\x00") || strings.IndexFunc(mac, unicode.IsSpace) >= 0 {
+		return fmt.Errorf("invalid mac %q: must not contain whitespace, / + or #", mac)
+	}
+	return nil
+}
+
+// 补全默认床型，检查 MAC 为空、重复或不能用在主题中，以及未知的 profile
+func normalize(devices []Device) ([]Device, error) {
+	seen := make(map[string]bool, len(devices))
+	for i := range devices {
+		d := &devices[i]
+		if d.Mac == "" {
+			return nil, fmt.Errorf("device %d has no mac", i)
+		}
+		if err := CheckMac(d.Mac); err != nil {
+			return nil, fmt.Errorf("device %d: %w", i, err)
+		}
+		if seen[d.Mac] {
+			return nil, fmt.Errorf("duplicate mac %s", d.Mac)
+		}
+		seen[d.Mac] = true
+		if d.Profile != "" && !validProfile(d.Profile) {
+			return nil, fmt.Errorf("device %s: unknown profile %q", d.Mac, d.Profile)
+		}
+		if d.Model == "" {
+			d.Model = DefaultModel
+		}
+	}
+	if len(devices) == 0 {
+		return nil, errors.New("no devices")
+	}
+	return devices, nil
+}
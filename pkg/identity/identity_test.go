@@ -0,0 +1,103 @@
+package identity
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRange(t *testing.T) {
+	devices, err := Range(DefaultTemplate, 0, 38, 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 2 || devices[1].Mac != "25MM111111110038100000-39" || devices[1].Model != DefaultModel {
+		t.Fatalf("unexpected devices %+v", devices)
+	}
+
+	if mac := Format("BED-%d", 5, 42); mac != "BED-00042" {
+		t.Fatalf("Format = %s", mac)
+	}
+	if _, err := Range("BED-%s", 0, 0, 1); err == nil {
+		t.Fatal("expected error for template without a number verb")
+	}
+}
+
+func TestReadCSV(t *testing.T) {
+	devices, err := ReadCSV(strings.NewReader("mac,model,profile,left_user,right_user\nA-1,EK-F,couple,u1,u2\n# comment\nA-2\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Device{
+		{Mac: "A-1", Model: "EK-F", Profile: "couple", LeftUser: "u1", RightUser: "u2"},
+		{Mac: "A-2", Model: DefaultModel},
+	}
+	if len(devices) != len(want) {
+		t.Fatalf("got %d devices", len(devices))
+	}
+	for i := range want {
+		if devices[i] != want[i] {
+			t.Fatalf("device %d = %+v, want %+v", i, devices[i], want[i])
+		}
+	}
+
+	if _, err := ReadCSV(strings.NewReader("A-1\nA-1\n")); err == nil {
+		t.Fatal("expected duplicate mac error")
+	}
+	if _, err := ReadCSV(strings.NewReader("A-1,EK-F,coupel\n")); err == nil {
+		t.Fatal("expected unknown profile error")
+	}
+	if _, err := ReadJSON(strings.NewReader(`[{"mac":"A-1","profile":"singel"}]`)); err == nil {
+		t.Fatal("expected unknown profile error")
+	}
+}
+
+func TestReadJSON(t *testing.T) {
+	devices, err := ReadJSON(strings.NewReader(`[{"mac":"A-1","profile":"single","leftUser":"u1"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if devices[0].Model != DefaultModel || devices[0].LeftUser != "u1" {
+		t.Fatalf("unexpected device %+v", devices[0])
+	}
+}
+
+func TestBind(t *testing.T) {
+	o := Options{Template: DefaultTemplate, Model: DefaultModel, Bind: "couple:2,single,unbound", UserIDStart: 100}
+	devices, err := o.Devices(2, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 编号 2..5 依次对应 single、unbound、couple、couple
+	if d := devices[0]; d.Profile != ProfileSingle || d.LeftUser != "104" || d.RightUser != "" || d.Occupied(Right) {
+		t.Fatalf("unexpected single device %+v", d)
+	}
+	if d := devices[1]; d.Profile != ProfileUnbound || d.LeftUser != "" || d.Occupied(Left) {
+		t.Fatalf("unexpected unbound device %+v", d)
+	}
+	if d := devices[2]; d.LeftUser != "108" || d.RightUser != "109" || !d.Occupied(Right) {
+		t.Fatalf("unexpected couple device %+v", d)
+	}
+
+	for _, bind := range []string{"couple:x", "couple:0", "couple:0,single:0", "coupel"} {
+		if _, err := ParseBind(bind); err == nil {
+			t.Errorf("expected error for bind %q", bind)
+		}
+	}
+	if !(Device{Mac: "A"}).Occupied(Left) {
+		t.Fatal("device without profile should be occupied")
+	}
+}
+
+func TestCheckMac(t *testing.T) {
+	if err := CheckMac(DefaultTemplate); err != nil {
+		t.Fatal(err)
+	}
+	for _, mac := range []string{"", "#", "a/+", "A 1"} {
+		if err := CheckMac(mac); err == nil {
+			t.Errorf("expected error for %q", mac)
+		}
+	}
+	if _, err := ReadCSV(strings.NewReader("A-1\nA/2\n")); err == nil {
+		t.Error("expected error for a mac with /")
+	}
+}
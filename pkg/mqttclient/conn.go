@@ -0,0 +1,151 @@
+package mqttclient
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"golang.org/x/net/proxy"
+)
+
+// Will 遗嘱消息，客户端异常断开时由代理发布
+type Will struct {
+	Topic    string
+	Payload  []byte
+	QoS      byte
+	Retained bool
+}
+
+var errDropped = errors.New("mqttclient: connection dropped")
+
+// 建立并记录客户端的网络连接，两种协议版本共用；
+// Drop 时直接关闭连接，代理收不到 DISCONNECT，会发布遗嘱消息
+type dialer struct {
+	opts  Options
+	proxy func(*http.Request) (*url.URL, error)
+
+	mu      sync.Mutex
+	conn    net.Conn
+	server  string // 最近一次连接的代理地址
+	dropped bool   // 为 true 时拒绝建立新连接，防止客户端自动重连
+}
+
+// 按地址的协议建立连接，支持 tcp、ssl、ws、wss
+func (d *dialer) dial(ctx context.Context, u *url.URL) (net.Conn, error) {
+	d.mu.Lock()
+	dropped := d.dropped
+	d.mu.Unlock()
+	if dropped {
+		return nil, errDropped
+	}
+
+	var conn net.Conn
+	var err error
+	switch strings.ToLower(u.Scheme) {
+	case "tcp", "mqtt", "":
+		conn, err = dialTCP(ctx, u.Host)
+	case "ssl", "tls", "mqtts", "mqtt+ssl", "tcps":
+		conn, err = dialTCP(ctx, u.Host)
+		if err == nil {
+			tc := tls.Client(conn, d.tlsConfig(u))
+			if err = tc.HandshakeContext(ctx); err != nil {
+				conn.Close()
+			}
+			conn = tc
+		}
+	case "ws", "wss":
+		// gorilla websocket 不接受带用户信息的地址
+		wsURL := *u
+		wsURL.User = nil
+		var tlsc *tls.Config
+		if u.Scheme == "wss" {
+			tlsc = d.tlsConfig(u)
+		}
+		conn, err = MQTT.NewWebsocket(wsURL.String(), tlsc, d.opts.ConnectTimeout, d.opts.WSHeaders, &MQTT.WebsocketOptions{Proxy: d.proxy})
+	default:
+		return nil, fmt.Errorf("mqttclient: unsupported scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.dropped {
+		conn.Close()
+		return nil, errDropped
+	}
+	d.conn = conn
+	d.server = u.String()
+	if d.opts.WrapConn != nil {
+		// Drop 关闭的是未包装的连接，不经过包装层的排队
+		return d.opts.WrapConn(conn), nil
+	}
+	return conn, nil
+}
+
+// UsesTLS 代理地址的协议是否使用 TLS（ssl、tls、mqtts、mqtt+ssl、tcps、wss），只有这些协议会用到 Options.TLS
+func UsesTLS(broker string) bool {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "ssl", "tls", "mqtts", "mqtt+ssl", "tcps", "wss":
+		return true
+	}
+	return false
+}
+
+// 最近一次连接的代理地址
+func (d *dialer) current() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.server
+}
+
+func (d *dialer) tlsConfig(u *url.URL) *tls.Config {
+	cfg := &tls.Config{}
+	if d.opts.TLS != nil {
+		cfg = d.opts.TLS.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = u.Hostname()
+	}
+	return cfg
+}
+
+// 设置了 all_proxy 环境变量时通过 SOCKS 代理连接，与 paho 的行为一致
+func dialTCP(ctx context.Context, address string) (net.Conn, error) {
+	if os.Getenv("all_proxy") == "" {
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", address)
+	}
+	return proxy.Dial(ctx, "tcp", address)
+}
+
+// 关闭当前连接并禁止重连
+func (d *dialer) drop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dropped = true
+	if d.conn != nil {
+		d.conn.Close()
+		d.conn = nil
+	}
+}
+
+// 允许再次建立连接
+func (d *dialer) reset() {
+	d.mu.Lock()
+	d.dropped = false
+	d.mu.Unlock()
+}
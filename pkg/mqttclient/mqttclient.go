@@ -0,0 +1,271 @@
+// Package mqttclient 为 MQTT 3.1.1 和 MQTT 5 提供统一的客户端接口，
+// 模拟床和 cmd/sub 通过它连接代理，同一套场景可以在两种协议版本下运行。
+package mqttclient
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message 收到的一条消息
+type Message struct {
+	Topic    string
+	Payload  []byte
+	QoS      byte
+	Retained bool
+}
+
+// Handler 消息处理函数，在客户端的接收协程中调用，不应长时间阻塞
+type Handler func(c Client, msg Message)
+
+// ErrTimeout Publish 在 ConnectTimeout 内没有得到代理确认
+var ErrTimeout = errors.New("mqttclient: publish timed out")
+
+// Client MQTT 客户端，Publish 和 Subscribe 会等待代理确认后返回
+type Client interface {
+	Connect() error
+	Publish(topic string, qos byte, retained bool, payload []byte) error
+	Subscribe(topic string, qos byte, h Handler) error
+	IsConnected() bool
+	// Server 当前连接的代理地址，未连接时返回空字符串
+	Server() string
+	Disconnect(quiesce time.Duration)
+	// Drop 模拟设备掉电：直接关闭网络连接，不发送 DISCONNECT，代理会发布遗嘱消息；
+	// 之后不再自动重连，直到再次调用 Connect
+	Drop()
+}
+
+// Options 创建客户端的参数
+type Options struct {
+	Version           int // 3（默认，即 3.1.1）或 5
+	Broker            string
+	Failover          []string // Broker 不可用时依次尝试的其他代理地址
+	ClientID          string
+	Username          string
+	Password          string
+	TLS               *tls.Config
+	Will              *Will       // 遗嘱消息，为 nil 时不设置
+	PersistentSession bool        // 不清除会话，需要固定的客户端ID；MQTT 5 下还需要 SessionExpiry 大于 0
+	WSPath            string      // ws:// 和 wss:// 地址没有路径时使用的路径
+	WSHeaders         http.Header // WebSocket 握手时附加的请求头
+	Proxy             string      // WebSocket 连接使用的 HTTP 代理，为空时读取 HTTP_PROXY 等环境变量
+	ConnectTimeout    time.Duration
+	OnConnect         func(c Client)
+	OnConnectionLost  func(c Client, err error)
+
+	// WrapConn 包装建立的网络连接，用于模拟网络损伤
+	WrapConn func(net.Conn) net.Conn
+
+	// 以下参数只在 MQTT 5 下生效
+	SessionExpiry  uint32            // 会话过期时间（秒）
+	MessageExpiry  uint32            // 发布消息的过期时间（秒），0 表示不过期
+	UserProperties map[string]string // 附加在每条发布消息上的用户属性
+}
+
+// New 按协议版本创建客户端，创建后需要调用 Connect
+func New(o Options) (Client, error) {
+	if o.ConnectTimeout <= 0 {
+		o.ConnectTimeout = 30 * time.Second
+	}
+	var err error
+	if o.Broker, err = WithWSPath(o.Broker, o.WSPath); err != nil {
+		return nil, err
+	}
+	failover := make([]string, len(o.Failover))
+	for i, broker := range o.Failover {
+		if failover[i], err = WithWSPath(broker, o.WSPath); err != nil {
+			return nil, err
+		}
+	}
+	o.Failover = failover
+	proxy, err := o.proxyFunc()
+	if err != nil {
+		return nil, err
+	}
+	d := &dialer{opts: o, proxy: proxy}
+	switch o.Version {
+	case 0, 3, 4:
+		return newV3(o, d), nil
+	case 5:
+		return newV5(o, d)
+	}
+	return nil, fmt.Errorf("mqttclient: unsupported protocol version %d", o.Version)
+}
+
+// 代理地址是否使用 WebSocket 传输
+func isWebsocket(broker string) bool {
+	return strings.HasPrefix(broker, "ws://") || strings.HasPrefix(broker, "wss://")
+}
+
+// WithWSPath ws:// 和 wss:// 地址没有路径时补上 path，返回客户端实际连接的地址
+func WithWSPath(broker, path string) (string, error) {
+	if !isWebsocket(broker) || path == "" {
+		return broker, nil
+	}
+	u, err := url.Parse(broker)
+	if err != nil {
+		return "", fmt.Errorf("mqttclient: invalid broker url: %w", err)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = path
+	}
+	return u.String(), nil
+}
+
+// 按顺序尝试的代理地址
+func (o Options) servers() []string {
+	return append([]string{o.Broker}, o.Failover...)
+}
+
+// WebSocket 拨号使用的 HTTP 代理
+func (o Options) proxyFunc() (func(*http.Request) (*url.URL, error), error) {
+	if o.Proxy == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+	u, err := url.Parse(o.Proxy)
+	if err != nil {
+		return nil, fmt.Errorf("mqttclient: invalid proxy url: %w", err)
+	}
+	return http.ProxyURL(u), nil
+}
+
+// ProtocolOptions 协议版本和传输相关的命令行参数
+type ProtocolOptions struct {
+	Version        int
+	SessionExpiry  uint
+	MessageExpiry  uint
+	UserProperties Properties
+	Persistent     bool
+	WSPath         string
+	WSHeaders      Properties
+	Proxy          string
+}
+
+// RegisterFlags 注册 -mqttVersion、-sessionExpiry、-messageExpiry、-userProperty、-persistentSession、-wsPath、-wsHeader、-proxy 参数
+func (p *ProtocolOptions) RegisterFlags(fs *flag.FlagSet) {
+	fs.IntVar(&p.Version, "mqttVersion", 3, "MQTT protocol version: 3 (3.1.1) or 5")
+	fs.UintVar(&p.SessionExpiry, "sessionExpiry", 0, "MQTT 5 session expiry interval in seconds")
+	fs.UintVar(&p.MessageExpiry, "messageExpiry", 0, "MQTT 5 message expiry interval in seconds for published messages")
+	fs.Var(&p.UserProperties, "userProperty", "MQTT 5 user property key=value added to published messages, repeatable")
+	fs.BoolVar(&p.Persistent, "persistentSession", false, "keep the session on the broker (clean session off); with MQTT 5 -sessionExpiry defaults to 1 day")
+	fs.StringVar(&p.WSPath, "wsPath", "/mqtt", "path used for ws:// and wss:// broker URLs without a path")
+	fs.Var(&p.WSHeaders, "wsHeader", "HTTP header key=value sent in the websocket handshake, repeatable")
+	fs.StringVar(&p.Proxy, "proxy", "", "HTTP proxy for websocket connections (default from HTTP_PROXY/HTTPS_PROXY)")
+}
+
+// Apply 把协议参数写入 o
+func (p ProtocolOptions) Apply(o *Options) {
+	o.Version = p.Version
+	o.SessionExpiry = uint32(p.SessionExpiry)
+	o.MessageExpiry = uint32(p.MessageExpiry)
+	o.UserProperties = p.UserProperties
+	o.PersistentSession = p.Persistent
+	if p.Persistent && o.SessionExpiry == 0 {
+		o.SessionExpiry = 24 * 60 * 60
+	}
+	o.WSPath = p.WSPath
+	o.Proxy = p.Proxy
+	if len(p.WSHeaders) > 0 {
+		o.WSHeaders = make(http.Header, len(p.WSHeaders))
+		for k, v := range p.WSHeaders {
+			o.WSHeaders.Set(k, v)
+		}
+	}
+}
+
+// Properties 可重复的 key=value 命令行参数
+type Properties map[string]string
+
+func (p *Properties) String() string {
+	keys := make([]string, 0, len(*p))
+	for k := range *p {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	items := make([]string, 0, len(keys))
+	for _, k := range keys {
+		items = append(items, k+"="+(*p)[k])
+	}
+	return strings.Join(items, ",")
+}
+
+func (p *Properties) Set(s string) error {
+	k, v, ok := strings.Cut(s, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("expected key=value, got %q", s)
+	}
+	if *p == nil {
+		*p = make(Properties)
+	}
+	(*p)[k] = v
+	return nil
+}
+
+// 已订阅的主题，重连后重新订阅，收到消息时按主题分发
+type subscriptions struct {
+	mu   sync.RWMutex
+	subs map[string]subscription
+}
+
+type subscription struct {
+	qos     byte
+	handler Handler
+}
+
+func (s *subscriptions) add(topic string, qos byte, h Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.subs == nil {
+		s.subs = make(map[string]subscription)
+	}
+	s.subs[topic] = subscription{qos: qos, handler: h}
+}
+
+func (s *subscriptions) all() map[string]subscription {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	subs := make(map[string]subscription, len(s.subs))
+	for topic, sub := range s.subs {
+		subs[topic] = sub
+	}
+	return subs
+}
+
+// 找到第一个匹配主题的处理函数
+func (s *subscriptions) match(topic string) Handler {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if sub, ok := s.subs[topic]; ok {
+		return sub.handler
+	}
+	for filter, sub := range s.subs {
+		if TopicMatch(filter, topic) {
+			return sub.handler
+		}
+	}
+	return nil
+}
+
+// TopicMatch 判断主题是否匹配订阅过滤器，支持 + 和 # 通配符
+func TopicMatch(filter, topic string) bool {
+	fs := strings.Split(filter, "/")
+	ts := strings.Split(topic, "/")
+	for i, f := range fs {
+		if f == "#" {
+			return true
+		}
+		if i >= len(ts) || (f != "+" && f != ts[i]) {
+			return false
+		}
+	}
+	return len(fs) == len(ts)
+}
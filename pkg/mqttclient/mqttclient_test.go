@@ -0,0 +1,323 @@
+package mqttclient
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+)
+
+// 在随机端口上启动一个进程内代理，返回 tcp:// 地址
+func startBroker(t *testing.T) string {
+	addr := freeAddr(t)
+
+	server := mqtt.New(&mqtt.Options{InlineClient: true, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	if err := server.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.AddListener(listeners.NewTCP(listeners.Config{ID: "t1", Address: addr})); err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	t.Cleanup(func() { server.Close() })
+	return "tcp://" + addr
+}
+
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// 在随机端口上启动一个 WebSocket 监听的进程内代理，返回 ws:// 地址（不带路径）
+func startWebsocketBroker(t *testing.T) string {
+	addr := freeAddr(t)
+	server := mqtt.New(&mqtt.Options{InlineClient: true, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	if err := server.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.AddListener(listeners.NewWebsocket(listeners.Config{ID: "ws1", Address: addr})); err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	t.Cleanup(func() { server.Close() })
+	// 等待 http 服务开始监听
+	for i := 0; i < 50; i++ {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return "ws://" + addr
+}
+
+// 只支持 CONNECT 的 HTTP 代理，记录经过代理的连接数
+func startHTTPProxy(t *testing.T) (string, *atomic.Int32) {
+	var tunnels atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			upstream.Close()
+			return
+		}
+		tunnels.Add(1)
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go func() {
+			io.Copy(upstream, conn)
+			upstream.Close()
+		}()
+		io.Copy(conn, upstream)
+		conn.Close()
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, &tunnels
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	brokerURL := startBroker(t)
+	for _, version := range []int{3, 5} {
+		sub, err := New(Options{Version: version, Broker: brokerURL, ClientID: "sub", ConnectTimeout: 5 * time.Second})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sub.Connect(); err != nil {
+			t.Fatalf("v%d connect: %v", version, err)
+		}
+		received := make(chan Message, 1)
+		if err := sub.Subscribe("qrem/+/control", 1, func(c Client, msg Message) { received <- msg }); err != nil {
+			t.Fatalf("v%d subscribe: %v", version, err)
+		}
+
+		pub, _ := New(Options{
+			Version:        version,
+			Broker:         brokerURL,
+			ClientID:       "pub",
+			ConnectTimeout: 5 * time.Second,
+			MessageExpiry:  60,
+			UserProperties: map[string]string{"source": "mock"},
+		})
+		if err := pub.Connect(); err != nil {
+			t.Fatalf("v%d connect: %v", version, err)
+		}
+		if err := pub.Publish("qrem/BED-1/control", 1, false, []byte{0xa0, 0x00}); err != nil {
+			t.Fatalf("v%d publish: %v", version, err)
+		}
+		select {
+		case msg := <-received:
+			if msg.Topic != "qrem/BED-1/control" || len(msg.Payload) != 2 {
+				t.Fatalf("v%d unexpected message %+v", version, msg)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("v%d message not received", version)
+		}
+		if !pub.IsConnected() {
+			t.Fatalf("v%d client should be connected", version)
+		}
+		pub.Disconnect(100 * time.Millisecond)
+		sub.Disconnect(100 * time.Millisecond)
+	}
+}
+
+func TestWebsocket(t *testing.T) {
+	brokerURL := startWebsocketBroker(t)
+	proxyURL, tunnels := startHTTPProxy(t)
+	for i, version := range []int{3, 5} {
+		c, err := New(Options{
+			Version:        version,
+			Broker:         brokerURL,
+			ClientID:       "ws",
+			WSPath:         "/mqtt",
+			WSHeaders:      http.Header{"X-Mock-Bed": []string{"1"}},
+			Proxy:          proxyURL,
+			ConnectTimeout: 5 * time.Second,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Connect(); err != nil {
+			t.Fatalf("v%d connect: %v", version, err)
+		}
+		received := make(chan Message, 1)
+		if err := c.Subscribe("qrem/BED-1/control", 0, func(c Client, msg Message) { received <- msg }); err != nil {
+			t.Fatalf("v%d subscribe: %v", version, err)
+		}
+		if err := c.Publish("qrem/BED-1/control", 0, false, []byte{0xa0}); err != nil {
+			t.Fatalf("v%d publish: %v", version, err)
+		}
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("v%d message not received over websocket", version)
+		}
+		c.Disconnect(100 * time.Millisecond)
+		if got := tunnels.Load(); int(got) != i+1 {
+			t.Fatalf("v%d expected connection through proxy, tunnels=%d", version, got)
+		}
+	}
+}
+
+func TestWillOnDrop(t *testing.T) {
+	brokerURL := startBroker(t)
+	for _, version := range []int{3, 5} {
+		watcher, _ := New(Options{Version: version, Broker: brokerURL, ClientID: "watcher", ConnectTimeout: 5 * time.Second})
+		if err := watcher.Connect(); err != nil {
+			t.Fatalf("v%d connect: %v", version, err)
+		}
+		wills := make(chan Message, 2)
+		if err := watcher.Subscribe("qrem/+/run_status", 0, func(c Client, msg Message) { wills <- msg }); err != nil {
+			t.Fatalf("v%d subscribe: %v", version, err)
+		}
+
+		bed, _ := New(Options{
+			Version:        version,
+			Broker:         brokerURL,
+			ClientID:       "BED-1",
+			ConnectTimeout: 5 * time.Second,
+			Will:           &Will{Topic: "qrem/BED-1/run_status", Payload: []byte{0x55, 0x00}},
+		})
+		// 正常断开不发布遗嘱
+		if err := bed.Connect(); err != nil {
+			t.Fatalf("v%d connect: %v", version, err)
+		}
+		bed.Disconnect(100 * time.Millisecond)
+		select {
+		case msg := <-wills:
+			t.Fatalf("v%d unexpected will after clean disconnect: %+v", version, msg)
+		case <-time.After(300 * time.Millisecond):
+		}
+
+		// 掉电后发布遗嘱，并且不会自动重连
+		if err := bed.Connect(); err != nil {
+			t.Fatalf("v%d reconnect: %v", version, err)
+		}
+		bed.Drop()
+		select {
+		case msg := <-wills:
+			if msg.Topic != "qrem/BED-1/run_status" || len(msg.Payload) != 2 || msg.Payload[1] != 0x00 {
+				t.Fatalf("v%d unexpected will %+v", version, msg)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("v%d will not published after drop", version)
+		}
+		if bed.IsConnected() {
+			t.Fatalf("v%d client should stay offline after drop", version)
+		}
+		watcher.Disconnect(100 * time.Millisecond)
+	}
+}
+
+func TestPersistentSession(t *testing.T) {
+	brokerURL := startBroker(t)
+	for _, version := range []int{3, 5} {
+		bed, _ := New(Options{
+			Version:           version,
+			Broker:            brokerURL,
+			ClientID:          "BED-1",
+			ConnectTimeout:    5 * time.Second,
+			PersistentSession: true,
+			SessionExpiry:     60,
+		})
+		if err := bed.Connect(); err != nil {
+			t.Fatalf("v%d connect: %v", version, err)
+		}
+		received := make(chan Message, 1)
+		if err := bed.Subscribe("qrem/BED-1/control", 1, func(c Client, msg Message) { received <- msg }); err != nil {
+			t.Fatalf("v%d subscribe: %v", version, err)
+		}
+		bed.Disconnect(100 * time.Millisecond)
+
+		// 离线期间下发的命令在重连后送达
+		backend, _ := New(Options{Version: version, Broker: brokerURL, ClientID: "backend", ConnectTimeout: 5 * time.Second})
+		if err := backend.Connect(); err != nil {
+			t.Fatalf("v%d connect: %v", version, err)
+		}
+		if err := backend.Publish("qrem/BED-1/control", 1, false, []byte{0xa0, 0x00}); err != nil {
+			t.Fatalf("v%d publish: %v", version, err)
+		}
+		backend.Disconnect(100 * time.Millisecond)
+
+		if err := bed.Connect(); err != nil {
+			t.Fatalf("v%d reconnect: %v", version, err)
+		}
+		select {
+		case msg := <-received:
+			if msg.QoS != 1 {
+				t.Fatalf("v%d queued message delivered with QoS %d", version, msg.QoS)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("v%d queued message not delivered on reconnect", version)
+		}
+		bed.Disconnect(100 * time.Millisecond)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	brokerURL := startBroker(t)
+	down := "tcp://" + freeAddr(t) // 没有代理监听
+	for _, version := range []int{3, 5} {
+		c, _ := New(Options{Version: version, Broker: down, Failover: []string{brokerURL}, ClientID: "BED-1", ConnectTimeout: 5 * time.Second})
+		if err := c.Connect(); err != nil {
+			t.Fatalf("v%d connect: %v", version, err)
+		}
+		if got := c.Server(); got != brokerURL {
+			t.Fatalf("v%d connected to %q, want %q", version, got, brokerURL)
+		}
+		c.Disconnect(100 * time.Millisecond)
+		if got := c.Server(); got != "" {
+			t.Fatalf("v%d Server() after disconnect = %q", version, got)
+		}
+	}
+}
+
+func TestTopicMatch(t *testing.T) {
+	cases := []struct {
+		filter, topic string
+		want          bool
+	}{
+		{"qrem/a/control", "qrem/a/control", true},
+		{"qrem/+/control", "qrem/a/control", true},
+		{"qrem/+/control", "qrem/a/ota", false},
+		{"qrem/#", "qrem/a/control", true},
+		{"qrem/+", "qrem/a/control", false},
+	}
+	for _, c := range cases {
+		if got := TopicMatch(c.filter, c.topic); got != c.want {
+			t.Errorf("TopicMatch(%q, %q) = %v", c.filter, c.topic, got)
+		}
+	}
+}
+
+func TestUsesTLS(t *testing.T) {
+	for broker, want := range map[string]bool{
+		"tcp://127.0.0.1:1883":   false,
+		"ws://127.0.0.1:8083":    false,
+		"ssl://127.0.0.1:8883":   true,
+		"MQTTS://broker:8883":    true,
+		"wss://broker:8084/mqtt": true,
+	} {
+		if got := UsesTLS(broker); got != want {
+			t.Errorf("UsesTLS(%q) = %v", broker, got)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package mqttclient
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// MQTT 3.1.1 客户端，基于 paho.mqtt.golang
+type v3Client struct {
+	opts   Options
+	client MQTT.Client
+	subs   subscriptions
+	dialer *dialer
+}
+
+func newV3(o Options, d *dialer) *v3Client {
+	c := &v3Client{opts: o, dialer: d}
+	opts := MQTT.NewClientOptions()
+	for _, server := range o.servers() {
+		opts.AddBroker(server)
+	}
+	opts.SetUsername(o.Username)
+	opts.SetPassword(o.Password)
+	opts.SetClientID(o.ClientID)
+	opts.SetConnectTimeout(o.ConnectTimeout)
+	opts.SetCleanSession(!o.PersistentSession)
+	// 持久会话中代理可能在重新订阅之前就投递缓存的消息，按已记录的订阅分发
+	opts.SetDefaultPublishHandler(func(_ MQTT.Client, msg MQTT.Message) {
+		if h := c.subs.match(msg.Topic()); h != nil {
+			h(c, Message{Topic: msg.Topic(), Payload: msg.Payload(), QoS: msg.Qos(), Retained: msg.Retained()})
+		}
+	})
+	if o.Will != nil {
+		opts.SetBinaryWill(o.Will.Topic, o.Will.Payload, o.Will.QoS, o.Will.Retained)
+	}
+	// 由 dialer 建立连接，Drop 时可以直接关闭
+	opts.SetCustomOpenConnectionFn(func(uri *url.URL, _ MQTT.ClientOptions) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), o.ConnectTimeout)
+		defer cancel()
+		return d.dial(ctx, uri)
+	})
+	opts.SetOnConnectHandler(func(MQTT.Client) {
+		c.resubscribe()
+		if o.OnConnect != nil {
+			o.OnConnect(c)
+		}
+	})
+	opts.SetConnectionLostHandler(func(_ MQTT.Client, err error) {
+		if o.OnConnectionLost != nil {
+			o.OnConnectionLost(c, err)
+		}
+	})
+	c.client = MQTT.NewClient(opts)
+	return c
+}
+
+func (c *v3Client) Connect() error {
+	c.dialer.reset()
+	token := c.client.Connect()
+	token.Wait()
+	return token.Error()
+}
+
+func (c *v3Client) Publish(topic string, qos byte, retained bool, payload []byte) error {
+	token := c.client.Publish(topic, qos, retained, payload)
+	if !token.WaitTimeout(c.opts.ConnectTimeout) {
+		return ErrTimeout
+	}
+	return token.Error()
+}
+
+func (c *v3Client) Subscribe(topic string, qos byte, h Handler) error {
+	c.subs.add(topic, qos, h)
+	return c.subscribe(topic, qos, h)
+}
+
+func (c *v3Client) subscribe(topic string, qos byte, h Handler) error {
+	token := c.client.Subscribe(topic, qos, func(_ MQTT.Client, msg MQTT.Message) {
+		h(c, Message{Topic: msg.Topic(), Payload: msg.Payload(), QoS: msg.Qos(), Retained: msg.Retained()})
+	})
+	token.Wait()
+	return token.Error()
+}
+
+// 断线重连后重新订阅，持久会话下代理已保留订阅，重复订阅不影响；paho 在单独的协程中调用 OnConnect，可以阻塞
+func (c *v3Client) resubscribe() {
+	for topic, sub := range c.subs.all() {
+		_ = c.subscribe(topic, sub.qos, sub.handler)
+	}
+}
+
+func (c *v3Client) IsConnected() bool {
+	return c.client.IsConnected()
+}
+
+func (c *v3Client) Server() string {
+	if !c.client.IsConnected() {
+		return ""
+	}
+	return c.dialer.current()
+}
+
+func (c *v3Client) Disconnect(quiesce time.Duration) {
+	c.client.Disconnect(uint(quiesce / time.Millisecond))
+}
+
+// 先关闭连接再断开，代理已经检测到连接异常关闭，DISCONNECT 不会送达
+func (c *v3Client) Drop() {
+	c.dialer.drop()
+	c.client.Disconnect(0)
+}
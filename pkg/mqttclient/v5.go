@@ -0,0 +1,258 @@
+package mqttclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// MQTT 5 客户端，基于 paho.golang/autopaho，断线后自动重连
+type v5Client struct {
+	opts      Options
+	cfg       autopaho.ClientConfig
+	subs      subscriptions
+	connected atomic.Bool
+	dialer    *dialer
+
+	mu      sync.Mutex
+	cm      *autopaho.ConnectionManager
+	cancel  context.CancelFunc
+	lastErr error
+}
+
+func newV5(o Options, d *dialer) (*v5Client, error) {
+	var servers []*url.URL
+	for _, server := range o.servers() {
+		u, err := url.Parse(server)
+		if err != nil {
+			return nil, fmt.Errorf("mqttclient: invalid broker url: %w", err)
+		}
+		servers = append(servers, u)
+	}
+	c := &v5Client{opts: o, dialer: d}
+	c.cfg = autopaho.ClientConfig{
+		ServerUrls:                    servers,
+		TlsCfg:                        o.TLS,
+		KeepAlive:                     30,
+		CleanStartOnInitialConnection: !o.PersistentSession,
+		SessionExpiryInterval:         o.SessionExpiry,
+		ConnectTimeout:                o.ConnectTimeout,
+		ConnectUsername:               o.Username,
+		ConnectPassword:               []byte(o.Password),
+		AttemptConnection: func(ctx context.Context, _ autopaho.ClientConfig, u *url.URL) (net.Conn, error) {
+			conn, err := d.dial(ctx, u)
+			if err != nil {
+				return nil, err
+			}
+			// paho 要求连接的写操作是并发安全的
+			return packets.NewThreadSafeConn(conn), nil
+		},
+		OnConnectionUp: func(cm *autopaho.ConnectionManager, connack *paho.Connack) {
+			// 首次连接时 Connect 可能还没有返回，OnConnect 中就要能够订阅
+			c.mu.Lock()
+			if c.cm == nil {
+				c.cm = cm
+			}
+			c.mu.Unlock()
+			c.connected.Store(true)
+			go func() {
+				// 会话不存在时需要重新订阅
+				if !connack.SessionPresent {
+					c.resubscribe(cm)
+				}
+				if o.OnConnect != nil {
+					o.OnConnect(c)
+				}
+			}()
+		},
+		OnConnectionDown: func() bool {
+			c.connected.Store(false)
+			if o.OnConnectionLost != nil {
+				go o.OnConnectionLost(c, c.err())
+			}
+			return true
+		},
+		OnConnectError: func(err error) {
+			c.setErr(err)
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID: o.ClientID,
+			OnPublishReceived: []func(paho.PublishReceived) (bool, error){
+				func(pr paho.PublishReceived) (bool, error) {
+					h := c.subs.match(pr.Packet.Topic)
+					if h == nil {
+						return false, nil
+					}
+					h(c, Message{Topic: pr.Packet.Topic, Payload: pr.Packet.Payload, QoS: pr.Packet.QoS, Retained: pr.Packet.Retain})
+					return true, nil
+				},
+			},
+			OnClientError: func(err error) {
+				c.setErr(err)
+			},
+			OnServerDisconnect: func(d *paho.Disconnect) {
+				c.setErr(fmt.Errorf("server disconnect, reason code 0x%02X", d.ReasonCode))
+			},
+		},
+	}
+	if o.Will != nil {
+		c.cfg.WillMessage = &paho.WillMessage{Topic: o.Will.Topic, Payload: o.Will.Payload, QoS: o.Will.QoS, Retain: o.Will.Retained}
+	}
+	return c, nil
+}
+
+func (c *v5Client) setErr(err error) {
+	c.mu.Lock()
+	c.lastErr = err
+	c.mu.Unlock()
+}
+
+func (c *v5Client) err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastErr
+}
+
+// Connect 启动连接管理器并等待首次连接成功，超时后停止重试并返回最后一次错误
+func (c *v5Client) Connect() error {
+	c.dialer.reset()
+	ctx, cancel := context.WithCancel(context.Background())
+	cm, err := autopaho.NewConnection(ctx, c.cfg)
+	if err != nil {
+		cancel()
+		return err
+	}
+	waitCtx, waitCancel := context.WithTimeout(ctx, c.opts.ConnectTimeout)
+	defer waitCancel()
+	if err := cm.AwaitConnection(waitCtx); err != nil {
+		cancel()
+		if last := c.err(); last != nil {
+			return last
+		}
+		return err
+	}
+	c.mu.Lock()
+	c.cm, c.cancel = cm, cancel
+	c.mu.Unlock()
+	// AwaitConnection 可能先于 OnConnectionUp 返回
+	c.connected.Store(true)
+	return nil
+}
+
+func (c *v5Client) manager() (*autopaho.ConnectionManager, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cm == nil {
+		return nil, fmt.Errorf("mqttclient: %s not connected", c.opts.ClientID)
+	}
+	return c.cm, nil
+}
+
+func (c *v5Client) Publish(topic string, qos byte, retained bool, payload []byte) error {
+	cm, err := c.manager()
+	if err != nil {
+		return err
+	}
+	p := &paho.Publish{Topic: topic, QoS: qos, Retain: retained, Payload: payload}
+	if c.opts.MessageExpiry > 0 || len(c.opts.UserProperties) > 0 {
+		p.Properties = &paho.PublishProperties{}
+		if c.opts.MessageExpiry > 0 {
+			expiry := c.opts.MessageExpiry
+			p.Properties.MessageExpiry = &expiry
+		}
+		for k, v := range c.opts.UserProperties {
+			p.Properties.User.Add(k, v)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.opts.ConnectTimeout)
+	defer cancel()
+	resp, err := cm.Publish(ctx, p)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrTimeout
+	}
+	if err != nil {
+		return err
+	}
+	if resp != nil && resp.ReasonCode >= 0x80 {
+		return fmt.Errorf("publish %s rejected, reason code 0x%02X", topic, resp.ReasonCode)
+	}
+	return nil
+}
+
+func (c *v5Client) Subscribe(topic string, qos byte, h Handler) error {
+	c.subs.add(topic, qos, h)
+	cm, err := c.manager()
+	if err != nil {
+		return err
+	}
+	return c.subscribe(cm, map[string]subscription{topic: {qos: qos, handler: h}})
+}
+
+func (c *v5Client) subscribe(cm *autopaho.ConnectionManager, subs map[string]subscription) error {
+	if len(subs) == 0 {
+		return nil
+	}
+	s := &paho.Subscribe{}
+	for topic, sub := range subs {
+		s.Subscriptions = append(s.Subscriptions, paho.SubscribeOptions{Topic: topic, QoS: sub.qos})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.opts.ConnectTimeout)
+	defer cancel()
+	suback, err := cm.Subscribe(ctx, s)
+	if err != nil {
+		return err
+	}
+	for i, code := range suback.Reasons {
+		if code >= 0x80 {
+			return fmt.Errorf("subscribe %s rejected, reason code 0x%02X", s.Subscriptions[i].Topic, code)
+		}
+	}
+	return nil
+}
+
+func (c *v5Client) resubscribe(cm *autopaho.ConnectionManager) {
+	if err := c.subscribe(cm, c.subs.all()); err != nil {
+		c.setErr(err)
+	}
+}
+
+func (c *v5Client) IsConnected() bool {
+	return c.connected.Load()
+}
+
+func (c *v5Client) Server() string {
+	if !c.connected.Load() {
+		return ""
+	}
+	return c.dialer.current()
+}
+
+func (c *v5Client) Disconnect(quiesce time.Duration) {
+	c.mu.Lock()
+	cm, cancel := c.cm, c.cancel
+	c.cm = nil
+	c.mu.Unlock()
+	c.connected.Store(false)
+	if cm == nil {
+		return
+	}
+	ctx, done := context.WithTimeout(context.Background(), quiesce+time.Second)
+	defer done()
+	_ = cm.Disconnect(ctx)
+	cancel()
+}
+
+// 先关闭连接再停止连接管理器，代理收不到 DISCONNECT
+func (c *v5Client) Drop() {
+	c.dialer.drop()
+	c.Disconnect(0)
+}
@@ -0,0 +1,358 @@
+// Package netem 在进程内模拟较差的网络（延迟、抖动、带宽限制、卡顿和随机断线），
+// 包装床客户端的网络连接，不需要 root 权限或 tc。
+package netem
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Profile 网络损伤参数，零值表示不做任何处理
+type Profile struct {
+	Latency   time.Duration // 单向附加延迟
+	Jitter    time.Duration // 延迟抖动，在 ±Jitter 内均匀分布
+	Bandwidth int           // 上行带宽，字节/秒，0 表示不限制
+	StallProb float64       // 每次写入后卡顿的概率
+	StallTime time.Duration // 卡顿时长，期间之后的数据都不发送
+	ResetMTBF time.Duration // 平均多久随机断开一次连接，0 表示不断开
+}
+
+// Enabled 是否设置了任何损伤
+func (p Profile) Enabled() bool {
+	return p != Profile{}
+}
+
+// ParseProfile 解析 "latency=200ms,jitter=50ms,bandwidth=32k,stall=0.02,stallTime=3s,reset=5m"，
+// bandwidth 支持 k、m 后缀（1024 进制）
+func ParseProfile(spec string) (Profile, error) {
+	var p Profile
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(item, "=")
+		if !ok {
+			return p, fmt.Errorf("netem: expected key=value, got %q", item)
+		}
+		var err error
+		switch k {
+		case "latency":
+			p.Latency, err = time.ParseDuration(v)
+		case "jitter":
+			p.Jitter, err = time.ParseDuration(v)
+		case "bandwidth":
+			p.Bandwidth, err = parseBytes(v)
+		case "stall":
+			p.StallProb, err = strconv.ParseFloat(v, 64)
+			if err == nil && (p.StallProb < 0 || p.StallProb > 1) {
+				err = errors.New("probability must be in [0, 1]")
+			}
+		case "stallTime":
+			p.StallTime, err = time.ParseDuration(v)
+		case "reset":
+			p.ResetMTBF, err = time.ParseDuration(v)
+		default:
+			return p, fmt.Errorf("netem: unknown key %q", k)
+		}
+		if err != nil {
+			return p, fmt.Errorf("netem: %s: %w", k, err)
+		}
+	}
+	if p.StallProb > 0 && p.StallTime <= 0 {
+		p.StallTime = time.Second
+	}
+	return p, nil
+}
+
+func parseBytes(s string) (int, error) {
+	mult := 1
+	switch {
+	case strings.HasSuffix(s, "k"), strings.HasSuffix(s, "K"):
+		mult, s = 1024, s[:len(s)-1]
+	case strings.HasSuffix(s, "m"), strings.HasSuffix(s, "M"):
+		mult, s = 1024*1024, s[:len(s)-1]
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid byte rate %q", s)
+	}
+	return n * mult, nil
+}
+
+// 随机延迟，不小于 0
+func (p Profile) delay() time.Duration {
+	d := p.Latency
+	if p.Jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(2*p.Jitter))) - p.Jitter
+	}
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+var errReset = errors.New("netem: connection reset")
+
+// 写入队列中的一段数据及其到达时间
+type packet struct {
+	data []byte
+	at   time.Time
+}
+
+// conn 损伤后的连接：写入的数据按带宽和延迟排队后由单独的协程发送，
+// 收到的数据由接收协程打上到达时间，到时后才能读到
+type conn struct {
+	net.Conn
+	p Profile
+
+	queue   chan packet
+	done    chan struct{} // 发送协程退出时关闭
+	closing chan struct{} // Close 时关闭，发送协程发送完已排队的数据后退出
+	stop    chan struct{} // 通知发送协程立即退出
+
+	rx       chan packet // 接收协程关闭时表示底层连接已出错
+	rxErr    error
+	pending  packet // 还没读完的数据
+	rmu      sync.Mutex
+	deadline atomic.Pointer[time.Time] // 读超时，由包装层处理
+
+	// wmu 让数据按写入的顺序入队，等待队列时一直持有；Close 和发送协程都不使用，不会被阻塞。
+	// mu 只保护计算到达时间的状态，入队之前释放
+	wmu    sync.Mutex
+	mu     sync.Mutex
+	txEnd  time.Time // 上一段数据按带宽发送完的时间
+	lastAt time.Time // 上一段数据的到达时间，保证顺序
+
+	// 出错不需要 mu：Write 持锁等待队列时，发送协程和断线定时器仍然要能报告错误
+	err      atomic.Pointer[error]
+	failed   chan struct{} // 出错时关闭
+	failOnce sync.Once
+
+	closeOnce sync.Once
+	reset     *time.Timer
+}
+
+// Wrap 按 p 包装连接，p 未设置任何损伤时原样返回
+func Wrap(c net.Conn, p Profile) net.Conn {
+	if !p.Enabled() {
+		return c
+	}
+	w := &conn{
+		Conn:    c,
+		p:       p,
+		queue:   make(chan packet, 256),
+		done:    make(chan struct{}),
+		closing: make(chan struct{}),
+		stop:    make(chan struct{}),
+		rx:      make(chan packet, 256),
+		failed:  make(chan struct{}),
+	}
+	go w.send()
+	go w.receive()
+	if p.ResetMTBF > 0 {
+		w.reset = time.AfterFunc(time.Duration(rand.ExpFloat64()*float64(p.ResetMTBF)), func() {
+			w.fail(errReset)
+			w.Conn.Close()
+		})
+	}
+	return w
+}
+
+func (c *conn) fail(err error) {
+	c.failOnce.Do(func() {
+		c.err.Store(&err)
+		close(c.failed)
+	})
+}
+
+// 第一次出错的原因，没有出错时为 nil
+func (c *conn) failure() error {
+	if err := c.err.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if err := c.failure(); err != nil {
+		return 0, err
+	}
+	select {
+	case <-c.closing:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	c.mu.Lock()
+	now := time.Now()
+	start := now
+	if c.txEnd.After(start) {
+		start = c.txEnd
+	}
+	if c.p.Bandwidth > 0 {
+		start = start.Add(time.Duration(len(b)) * time.Second / time.Duration(c.p.Bandwidth))
+	}
+	c.txEnd = start
+	at := start.Add(c.p.delay())
+	if at.Before(c.lastAt) {
+		at = c.lastAt
+	}
+	c.lastAt = at
+	c.mu.Unlock()
+
+	// 队列满时阻塞，相当于发送缓冲区已满
+	select {
+	case c.queue <- packet{data: append([]byte(nil), b...), at: at}:
+		return len(b), nil
+	case <-c.closing:
+		return 0, net.ErrClosed
+	case <-c.failed:
+		return 0, c.failure()
+	case <-c.done:
+		return 0, net.ErrClosed
+	}
+}
+
+// 发送协程，按到达时间依次写入底层连接
+func (c *conn) send() {
+	defer close(c.done)
+	for {
+		var pkt packet
+		select {
+		case pkt = <-c.queue:
+		case <-c.closing:
+			// 发送完已排队的数据后退出
+			select {
+			case pkt = <-c.queue:
+			default:
+				return
+			}
+		case <-c.stop:
+			return
+		}
+		if !c.wait(time.Until(pkt.at)) {
+			return
+		}
+		if _, err := c.Conn.Write(pkt.data); err != nil {
+			c.fail(err)
+			return
+		}
+		if c.p.StallProb > 0 && rand.Float64() < c.p.StallProb {
+			if !c.wait(c.p.StallTime) {
+				return
+			}
+		}
+	}
+}
+
+func (c *conn) wait(d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-c.stop:
+		return false
+	}
+}
+
+// 接收协程，为收到的数据计算到达时间
+func (c *conn) receive() {
+	defer close(c.rx)
+	var lastAt time.Time
+	for {
+		buf := make([]byte, 4096)
+		n, err := c.Conn.Read(buf)
+		if n > 0 {
+			at := time.Now().Add(c.p.delay())
+			if at.Before(lastAt) {
+				at = lastAt
+			}
+			lastAt = at
+			c.rx <- packet{data: buf[:n], at: at}
+		}
+		if err != nil {
+			if failure := c.failure(); failure != nil {
+				err = failure
+			}
+			c.rxErr = err
+			return
+		}
+	}
+}
+
+// Read 返回已到达的数据，没有时等待下一段数据到达
+func (c *conn) Read(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	var timeout <-chan time.Time
+	if dl := c.deadline.Load(); dl != nil && !dl.IsZero() {
+		t := time.NewTimer(time.Until(*dl))
+		defer t.Stop()
+		timeout = t.C
+	}
+	if len(c.pending.data) == 0 {
+		select {
+		case pkt, ok := <-c.rx:
+			if !ok {
+				return 0, c.rxErr
+			}
+			c.pending = pkt
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+	if d := time.Until(c.pending.at); d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+	n := copy(b, c.pending.data)
+	c.pending.data = c.pending.data[n:]
+	return n, nil
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error {
+	c.deadline.Store(&t)
+	return nil
+}
+
+func (c *conn) SetDeadline(t time.Time) error {
+	c.deadline.Store(&t)
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// Close 等待已排队的数据发送完（最多 2 秒）后关闭，保证 DISCONNECT 能送达；
+// 对端不再读取、发送协程阻塞在底层连接的写入时，超时后关闭底层连接使其返回
+func (c *conn) Close() error {
+	c.closeOnce.Do(func() {
+		if c.reset != nil {
+			c.reset.Stop()
+		}
+		close(c.closing)
+		select {
+		case <-c.done:
+		case <-time.After(2 * time.Second):
+			close(c.stop)
+		}
+	})
+	return c.Conn.Close()
+}
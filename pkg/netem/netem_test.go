@@ -0,0 +1,171 @@
+package netem
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseProfile(t *testing.T) {
+	p, err := ParseProfile("latency=200ms,jitter=50ms,bandwidth=32k,stall=0.02,reset=5m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Profile{Latency: 200 * time.Millisecond, Jitter: 50 * time.Millisecond, Bandwidth: 32 * 1024, StallProb: 0.02, StallTime: time.Second, ResetMTBF: 5 * time.Minute}
+	if p != want {
+		t.Fatalf("got %+v, want %+v", p, want)
+	}
+	for _, spec := range []string{"latency", "latency=abc", "stall=2", "loss=0.1"} {
+		if _, err := ParseProfile(spec); err == nil {
+			t.Errorf("expected error for %q", spec)
+		}
+	}
+	if p, _ := ParseProfile(""); p.Enabled() {
+		t.Error("empty spec should not be enabled")
+	}
+}
+
+// 建立一对本地 TCP 连接，返回客户端和服务端
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := ln.Accept()
+		accepted <- c
+	}()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := <-accepted
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestLatencyAndBandwidth(t *testing.T) {
+	client, server := tcpPair(t)
+	c := Wrap(client, Profile{Latency: 100 * time.Millisecond, Bandwidth: 10 * 1024})
+
+	start := time.Now()
+	if _, err := c.Write(make([]byte, 5*1024)); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > 50*time.Millisecond {
+		t.Fatal("write should not block while the data is queued")
+	}
+	if _, err := io.ReadFull(server, make([]byte, 5*1024)); err != nil {
+		t.Fatal(err)
+	}
+	// 5k 在 10k/s 下需要 500ms，再加 100ms 延迟
+	if d := time.Since(start); d < 600*time.Millisecond {
+		t.Fatalf("data arrived after %s, expected at least 600ms", d)
+	}
+}
+
+func TestCloseFlushesQueue(t *testing.T) {
+	client, server := tcpPair(t)
+	c := Wrap(client, Profile{Latency: 100 * time.Millisecond})
+	c.Write([]byte{0xe0, 0x00}) // DISCONNECT
+	c.Close()
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(server, buf); err != nil || buf[0] != 0xe0 {
+		t.Fatalf("queued data lost on close: %v %x", err, buf)
+	}
+}
+
+func TestReset(t *testing.T) {
+	client, _ := tcpPair(t)
+	c := Wrap(client, Profile{ResetMTBF: 10 * time.Millisecond})
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := c.Read(make([]byte, 1))
+	if !errors.Is(err, errReset) {
+		t.Fatalf("expected reset error, got %v", err)
+	}
+}
+
+// 发送队列已满、写入方持锁等待时底层连接出错，所有写入和 Close 都要返回
+func TestWriteFailsWhenQueueFull(t *testing.T) {
+	client, server := net.Pipe()
+	server.Close()
+	c := Wrap(client, Profile{Bandwidth: 1024})
+
+	// 写入数多于队列长度，保证有写入阻塞在满的队列上
+	const writers = 400
+	errs := make(chan error, writers)
+	for range writers {
+		go func() {
+			_, err := c.Write(make([]byte, 100))
+			errs <- err
+		}()
+	}
+	timeout := time.After(5 * time.Second)
+	failed := 0
+	for range writers {
+		select {
+		case err := <-errs:
+			if err != nil {
+				failed++
+			}
+		case <-timeout:
+			t.Fatal("Write blocked after the underlying connection failed")
+		}
+	}
+	if failed == 0 {
+		t.Error("expected writes to fail")
+	}
+	closed := make(chan struct{})
+	go func() {
+		c.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close blocked after the underlying connection failed")
+	}
+}
+
+// 对端不再读取时，发送协程阻塞在底层连接的写入，Close 仍然要在超时后返回，等待入队的写入也要返回
+func TestCloseWhenPeerStopsReading(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	c := Wrap(client, Profile{Latency: time.Millisecond})
+
+	const writers = 400
+	errs := make(chan error, writers)
+	for range writers {
+		go func() {
+			_, err := c.Write(make([]byte, 100))
+			errs <- err
+		}()
+	}
+	// 等发送协程阻塞在写入、队列写满
+	time.Sleep(100 * time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		c.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close blocked while the peer is not reading")
+	}
+	for range writers {
+		select {
+		case <-errs:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Write blocked after Close")
+		}
+	}
+}
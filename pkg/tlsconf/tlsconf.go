@@ -0,0 +1,117 @@
+// Package tlsconf 根据命令行参数构造连接 MQTT 代理使用的 TLS 配置，
+// 支持自定义 CA、共享或每台设备独立的客户端证书（双向认证）。
+package tlsconf
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Options TLS 相关的命令行参数，CertFile/KeyFile 中的 %s 会替换为设备 MAC
+type Options struct {
+	CAFile     string
+	CertFile   string
+	KeyFile    string
+	ServerName string
+	Insecure   bool
+}
+
+// RegisterFlags 注册 -tlsCA、-tlsCert、-tlsKey、-tlsServerName、-tlsInsecure 参数
+func (o *Options) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.CAFile, "tlsCA", "", "PEM CA bundle used to verify the broker")
+	fs.StringVar(&o.CertFile, "tlsCert", "", "PEM client certificate, %s is replaced by the device MAC for per-device certificates")
+	fs.StringVar(&o.KeyFile, "tlsKey", "", "PEM client key, %s is replaced by the device MAC")
+	fs.StringVar(&o.ServerName, "tlsServerName", "", "override the server name used to verify the broker certificate")
+	fs.BoolVar(&o.Insecure, "tlsInsecure", false, "skip broker certificate verification")
+}
+
+// Enabled 是否配置了任意 TLS 参数
+func (o Options) Enabled() bool {
+	return o.CAFile != "" || o.CertFile != "" || o.KeyFile != "" || o.ServerName != "" || o.Insecure
+}
+
+// Source 加载好的 CA 和共享证书，按设备生成 tls.Config
+type Source struct {
+	opts      Options
+	pool      *x509.CertPool
+	perDevice bool
+
+	mu    sync.Mutex
+	certs map[string]tls.Certificate
+}
+
+// Load 读取 CA 和证书文件，未启用 TLS 时返回 nil
+func (o Options) Load() (*Source, error) {
+	if !o.Enabled() {
+		return nil, nil
+	}
+	if (o.CertFile == "") != (o.KeyFile == "") {
+		return nil, errors.New("tlsconf: -tlsCert and -tlsKey must be set together")
+	}
+	s := &Source{opts: o, certs: make(map[string]tls.Certificate)}
+	if o.CAFile != "" {
+		pem, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		s.pool = x509.NewCertPool()
+		if !s.pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("tlsconf: no certificate found in %s", o.CAFile)
+		}
+	}
+	s.perDevice = strings.Contains(o.CertFile, "%s") || strings.Contains(o.KeyFile, "%s")
+	if o.CertFile != "" && !s.perDevice {
+		// 共享证书提前加载，尽早暴露路径错误
+		if _, err := s.certificate(""); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Config 返回设备 mac 使用的 TLS 配置
+func (s *Source) Config(mac string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		RootCAs:            s.pool,
+		ServerName:         s.opts.ServerName,
+		InsecureSkipVerify: s.opts.Insecure,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if s.opts.CertFile != "" {
+		cert, err := s.certificate(mac)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// 共享证书缓存在空字符串下，每台设备的证书按 mac 缓存
+func (s *Source) certificate(mac string) (tls.Certificate, error) {
+	if !s.perDevice {
+		mac = ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cert, ok := s.certs[mac]; ok {
+		return cert, nil
+	}
+	certFile, keyFile := s.opts.CertFile, s.opts.KeyFile
+	if s.perDevice {
+		certFile = strings.ReplaceAll(certFile, "%s", mac)
+		keyFile = strings.ReplaceAll(keyFile, "%s", mac)
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("tlsconf: %w", err)
+	}
+	s.certs[mac] = cert
+	return cert, nil
+}
@@ -0,0 +1,135 @@
+package tlsconf
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 生成自签名 CA，以及由它签发的证书
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "mock-bed test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// 签发证书并写入 dir/name.crt、dir/name.key
+func (ca *testCA) issue(t *testing.T, dir, name string, usage x509.ExtKeyUsage) tls.Certificate {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	os.WriteFile(filepath.Join(dir, name+".crt"), certPEM, 0o600)
+	os.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0o600)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	os.WriteFile(filepath.Join(dir, "ca.pem"), ca.pem, 0o600)
+	serverCert := ca.issue(t, dir, "broker.local", x509.ExtKeyUsageServerAuth)
+	ca.issue(t, dir, "BED-1", x509.ExtKeyUsageClientAuth)
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca.pem)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	peer := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tc := conn.(*tls.Conn)
+		if tc.Handshake() == nil && len(tc.ConnectionState().PeerCertificates) > 0 {
+			peer <- tc.ConnectionState().PeerCertificates[0].Subject.CommonName
+		}
+		close(peer)
+	}()
+
+	src, err := Options{
+		CAFile:     filepath.Join(dir, "ca.pem"),
+		CertFile:   filepath.Join(dir, "%s.crt"),
+		KeyFile:    filepath.Join(dir, "%s.key"),
+		ServerName: "broker.local",
+	}.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := src.Config("BED-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := tls.Dial("tcp", ln.Addr().String(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if cn := <-peer; cn != "BED-1" {
+		t.Fatalf("server saw client certificate %q", cn)
+	}
+
+	if _, err := src.Config("BED-2"); err == nil {
+		t.Fatal("expected error for missing per-device certificate")
+	}
+	if src, _ := (Options{}).Load(); src != nil {
+		t.Fatal("expected nil source when TLS is disabled")
+	}
+	if _, err := (Options{KeyFile: filepath.Join(dir, "%s.key")}).Load(); err == nil {
+		t.Fatal("expected error for -tlsKey without -tlsCert")
+	}
+}
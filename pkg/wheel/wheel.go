@@ -0,0 +1,130 @@
+// Package wheel 哈希时间轮，用于给大量设备各自安排周期性任务。
+// 每个任务按到期时间落在对应的槽里，每个刻度只处理一个槽，
+// 任务数量到几十万时开销也只和到期的任务数有关。
+package wheel
+
+import (
+	"sync"
+	"time"
+)
+
+// Func 任务函数，参数为本次的计划触发时间，返回下一次的触发时间，返回零值表示不再触发
+type Func func(at time.Time) time.Time
+
+type entry struct {
+	due int64 // 到期的刻度
+	at  time.Time
+	fn  Func
+}
+
+// Wheel 时间轮，精度为一个刻度，任务在时间轮的协程里依次执行，不能阻塞太久
+type Wheel struct {
+	tick  time.Duration
+	start time.Time
+
+	mu    sync.Mutex
+	slots [][]*entry
+	cur   int64 // 已处理到的刻度
+
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// New 创建刻度为 tick、共 slots 个槽的时间轮，需要调用 Start 才开始运行
+func New(tick time.Duration, slots int) *Wheel {
+	return &Wheel{
+		tick:  tick,
+		start: time.Now(),
+		slots: make([][]*entry, slots),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+}
+
+// Schedule 在 at 时刻执行 fn，之后按 fn 的返回值继续触发；at 已经过去时在下一个刻度执行
+func (w *Wheel) Schedule(at time.Time, fn Func) {
+	w.mu.Lock()
+	w.add(&entry{at: at, fn: fn})
+	w.mu.Unlock()
+}
+
+// 调用方持有 mu
+func (w *Wheel) add(e *entry) {
+	e.due = int64(e.at.Sub(w.start) / w.tick)
+	if e.due <= w.cur {
+		e.due = w.cur + 1
+	}
+	i := e.due % int64(len(w.slots))
+	w.slots[i] = append(w.slots[i], e)
+}
+
+// Start 开始运行
+func (w *Wheel) Start() {
+	go w.run()
+}
+
+// Stop 停止运行并等待正在执行的任务返回
+func (w *Wheel) Stop() {
+	w.once.Do(func() {
+		close(w.stop)
+	})
+	<-w.done
+}
+
+func (w *Wheel) run() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case now := <-ticker.C:
+			// 任务执行太久时会落后，一次补上所有错过的刻度
+			target := int64(now.Sub(w.start) / w.tick)
+			for w.cur < target {
+				select {
+				case <-w.stop:
+					return
+				default:
+				}
+				w.advance()
+			}
+		}
+	}
+}
+
+// 处理下一个刻度的槽，未到期（还要再转几圈）的任务留在槽里
+func (w *Wheel) advance() {
+	w.mu.Lock()
+	w.cur++
+	i := w.cur % int64(len(w.slots))
+	slot := w.slots[i]
+	var due []*entry
+	keep := slot[:0]
+	for _, e := range slot {
+		if e.due <= w.cur {
+			due = append(due, e)
+		} else {
+			keep = append(keep, e)
+		}
+	}
+	// 清掉尾部的引用，避免已移走的任务无法回收
+	for j := len(keep); j < len(slot); j++ {
+		slot[j] = nil
+	}
+	w.slots[i] = keep
+	w.mu.Unlock()
+
+	for _, e := range due {
+		next := e.fn(e.at)
+		if next.IsZero() {
+			continue
+		}
+		e.at = next
+		w.mu.Lock()
+		w.add(e)
+		w.mu.Unlock()
+	}
+}
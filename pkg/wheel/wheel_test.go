@@ -0,0 +1,79 @@
+package wheel
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPeriodic(t *testing.T) {
+	w := New(5*time.Millisecond, 16)
+	w.Start()
+	defer w.Stop()
+
+	var n atomic.Int64
+	start := time.Now()
+	w.Schedule(start.Add(20*time.Millisecond), func(at time.Time) time.Time {
+		n.Add(1)
+		return at.Add(50 * time.Millisecond)
+	})
+	time.Sleep(520 * time.Millisecond)
+	// 20ms 开始，每 50ms 一次，520ms 内应触发 11 次，允许一个刻度的误差
+	if got := n.Load(); got < 10 || got > 11 {
+		t.Fatalf("fired %d times, expected 10-11", got)
+	}
+}
+
+func TestLongDelayAndStop(t *testing.T) {
+	// 超过一圈的延迟需要转多圈才到期
+	w := New(time.Millisecond, 8)
+	w.Start()
+	fired := make(chan time.Duration, 1)
+	start := time.Now()
+	w.Schedule(start.Add(50*time.Millisecond), func(at time.Time) time.Time {
+		fired <- time.Since(start)
+		return time.Time{}
+	})
+	select {
+	case d := <-fired:
+		if d < 50*time.Millisecond {
+			t.Fatalf("fired after %s, expected at least 50ms", d)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("task never fired")
+	}
+	w.Stop()
+	w.Stop()
+}
+
+func TestSpread(t *testing.T) {
+	// 100 个任务均匀分布在 100ms 内，每个刻度只有少量任务到期
+	w := New(10*time.Millisecond, 64)
+	var mu sync.Mutex
+	perTick := make(map[int64]int)
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		w.Schedule(start.Add(time.Duration(i)*time.Millisecond), func(at time.Time) time.Time {
+			mu.Lock()
+			perTick[int64(at.Sub(start)/(10*time.Millisecond))]++
+			mu.Unlock()
+			return time.Time{}
+		})
+	}
+	w.Start()
+	time.Sleep(200 * time.Millisecond)
+	w.Stop()
+	mu.Lock()
+	defer mu.Unlock()
+	total := 0
+	for tick, n := range perTick {
+		if n > 10 {
+			t.Errorf("tick %d fired %d tasks", tick, n)
+		}
+		total += n
+	}
+	if total != 100 {
+		t.Fatalf("fired %d tasks, expected 100", total)
+	}
+}